@@ -714,6 +714,50 @@ func TestProcessAttesterSlashings_AppliesCorrectStatus(t *testing.T) {
 	}
 }
 
+func TestProcessAttesterSlashings_SlashesIntersectionOfAttesters(t *testing.T) {
+	beaconState, privKeys := testutil.DeterministicGenesisState(t, 100)
+	domain := helpers.Domain(beaconState.Fork(), 0, params.BeaconConfig().DomainBeaconAttester)
+	signedAtt := func(data *ethpb.AttestationData, indices []uint64) *ethpb.IndexedAttestation {
+		hashTreeRoot, err := ssz.HashTreeRoot(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sigs := make([]*bls.Signature, len(indices))
+		for i, idx := range indices {
+			sigs[i] = privKeys[idx].Sign(hashTreeRoot[:], domain)
+		}
+		return &ethpb.IndexedAttestation{
+			Data:             data,
+			AttestingIndices: indices,
+			Signature:        bls.AggregateSignatures(sigs).Marshal(),
+		}
+	}
+	// A double vote of validator 1, validators 0 and 2 only cast one of the votes.
+	att1 := signedAtt(&ethpb.AttestationData{
+		BeaconBlockRoot: []byte{'A'},
+		Source:          &ethpb.Checkpoint{Epoch: 0},
+		Target:          &ethpb.Checkpoint{Epoch: 0},
+	}, []uint64{0, 1})
+	att2 := signedAtt(&ethpb.AttestationData{
+		BeaconBlockRoot: []byte{'B'},
+		Source:          &ethpb.Checkpoint{Epoch: 0},
+		Target:          &ethpb.Checkpoint{Epoch: 0},
+	}, []uint64{1, 2})
+
+	body := &ethpb.BeaconBlockBody{
+		AttesterSlashings: []*ethpb.AttesterSlashing{{Attestation_1: att1, Attestation_2: att2}},
+	}
+	newState, err := blocks.ProcessAttesterSlashings(context.Background(), beaconState, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for idx, wanted := range []bool{false, true, false} {
+		if newState.Validators()[idx].Slashed != wanted {
+			t.Errorf("Expected validator %d slashed to be %t, received %t", idx, wanted, newState.Validators()[idx].Slashed)
+		}
+	}
+}
+
 func TestProcessAttestations_InclusionDelayFailure(t *testing.T) {
 	attestations := []*ethpb.Attestation{
 		{
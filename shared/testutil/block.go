@@ -1,23 +1,80 @@
 package testutil
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"log"
-	"math"
 	"math/rand"
+	"sort"
+	"sync"
 
+	"github.com/gogo/protobuf/proto"
 	"github.com/pkg/errors"
 	ethpb "github.com/prysmaticlabs/ethereumapis/eth/v1alpha1"
 	"github.com/prysmaticlabs/go-bitfield"
 	"github.com/prysmaticlabs/go-ssz"
+	"github.com/prysmaticlabs/prysm/beacon-chain/core/blocks"
 	"github.com/prysmaticlabs/prysm/beacon-chain/core/helpers"
 	"github.com/prysmaticlabs/prysm/beacon-chain/core/state"
 	stateTrie "github.com/prysmaticlabs/prysm/beacon-chain/state"
+	pb "github.com/prysmaticlabs/prysm/proto/beacon/p2p/v1"
+	"github.com/prysmaticlabs/prysm/shared/attestationutil"
 	"github.com/prysmaticlabs/prysm/shared/bls"
+	"github.com/prysmaticlabs/prysm/shared/bytesutil"
+	"github.com/prysmaticlabs/prysm/shared/mputil"
 	"github.com/prysmaticlabs/prysm/shared/params"
+	"github.com/prysmaticlabs/prysm/shared/sliceutil"
 )
 
+// BlockCorruption defines a deliberately invalid element placed in an otherwise
+// well-formed generated block, used for testing block processing error paths.
+type BlockCorruption int
+
+const (
+	// NoCorruption generates a fully valid block.
+	NoCorruption BlockCorruption = iota
+	// CorruptProposerSigningRoot signs the block with the correct proposer key and domain,
+	// but over the parent root instead of the root of the block itself.
+	CorruptProposerSigningRoot
+	// CorruptAttestationTargetRoot sets the target root of the block's attestations to the
+	// root of the attested block instead of the epoch boundary block, and signs over that
+	// data. Since the target root is not part of attestation validity, the block passes the
+	// transition but its attesters are not credited with a correct target vote.
+	CorruptAttestationTargetRoot
+	// CorruptAttesterSlashingIdenticalAttestations makes both attestations of every attester
+	// slashing identical, which is not a slashable offense.
+	CorruptAttesterSlashingIdenticalAttestations
+	// CorruptRandaoRevealEpoch signs the randao reveal with the proposer key over the epoch
+	// following the epoch of the block.
+	CorruptRandaoRevealEpoch
+	// CorruptStateRoot sets a state root other than the root of the post state in the block,
+	// and signs the block over that root.
+	CorruptStateRoot
+	// CorruptAttestationSignature replaces the signature of the first attestation of the
+	// block by a signature of the first validator over the zero hash, under the correct
+	// attester domain. The block must contain at least one attestation.
+	CorruptAttestationSignature
+)
+
+// AttesterSlashingType defines the Casper FFG rule violated by generated attester slashings.
+type AttesterSlashingType int
+
+const (
+	// DoubleVote slashings contain two different attestations for the same target epoch.
+	DoubleVote AttesterSlashingType = iota
+	// SurroundVote slashings contain an attestation whose source and target epochs
+	// surround those of the other attestation.
+	SurroundVote
+)
+
+// PlaceholderRandaoReveal returns the RANDAO reveal of blocks generated with Unsigned. It has
+// the length of a BLS signature but is all zeros, which is intentionally not a valid
+// signature, so the block is well-formed and only fails RANDAO verification.
+func PlaceholderRandaoReveal() []byte {
+	return make([]byte, params.BeaconConfig().BLSSignatureLength)
+}
+
 // BlockGenConfig is used to define the requested conditions
 // for block generation.
 type BlockGenConfig struct {
@@ -26,6 +83,60 @@ type BlockGenConfig struct {
 	NumAttestations      uint64
 	NumDeposits          uint64
 	NumVoluntaryExits    uint64
+	// AttesterSlashingType is the rule violated by the generated attester slashings.
+	AttesterSlashingType AttesterSlashingType
+	// ProposerSlashingIndices, when set, are the validators slashed by the generated
+	// proposer slashings. Any remaining slashings target random validators.
+	ProposerSlashingIndices []uint64
+	// VoluntaryExitIndices, when set, are the validators exited by the generated
+	// voluntary exits. Any remaining exits are assigned to random validators.
+	VoluntaryExitIndices []uint64
+	// Seed seeds the source of randomness used to pick the validators of generated
+	// operations, so the same seed generates the same block. It is ignored when Rand is set.
+	Seed int64
+	// Rand, when set, is the source of randomness used instead of one seeded with Seed.
+	Rand *rand.Rand
+	// WithdrawalCredentials, when set, are the withdrawal credentials of the generated
+	// deposits in order. A nil entry keeps the default BLS withdrawal credentials.
+	WithdrawalCredentials [][]byte
+	// TopUpDeposits is the number of deposits topping up the balance of random validators
+	// already in the registry, following the NumDeposits deposits of new validators.
+	TopUpDeposits uint64
+	// Eth1Data, when set, is the eth1 data voted for by the block instead of the eth1 data
+	// of the state or of the generated deposits. The deposits are generated regardless.
+	Eth1Data *ethpb.Eth1Data
+	// Graffiti is the graffiti of the block, padded or truncated to 32 bytes.
+	Graffiti []byte
+	// Attestations are included in the block in addition to the generated ones.
+	Attestations []*ethpb.Attestation
+	// Corruption makes the generated block invalid in exactly one way.
+	Corruption BlockCorruption
+	// AttestationSlotOffset is the number of slots between the slot of the generated
+	// attestations and the slot of the block, at most SLOTS_PER_EPOCH. It defaults to
+	// MIN_ATTESTATION_INCLUSION_DELAY when zero.
+	AttestationSlotOffset uint64
+	// SkipStateRoot skips the state transition computing the state root of the block, which
+	// is the most expensive part of generation, and signs the block with a zero state root
+	// instead. The body is complete, but the block fails processing on the state root check,
+	// so it must only be used by tests inspecting the block itself, never passed to
+	// ProcessBlock or ExecuteStateTransition. No post state is returned for such a block.
+	SkipStateRoot bool
+	// Unsigned leaves the RANDAO reveal and the proposer signature of the block zero-filled
+	// rather than signed, the reveal being PlaceholderRandaoReveal. The block is well-formed
+	// and commits to the state after it, but fails signature verification, so it is only
+	// valid for processing that skips it.
+	Unsigned bool
+	// ForkVersion, when set, is the fork version the block and its operations are signed
+	// under instead of the fork of the state, e.g. to generate blocks signed for another
+	// fork. The signatures of such a block fail verification against the state.
+	ForkVersion []byte
+	// VerifyTransition runs ExecuteStateTransition on a copy of the state with the generated
+	// block, and fails generation unless the block is processed into the state it commits
+	// to. It is ignored for blocks generated to fail processing.
+	VerifyTransition bool
+	// proposers caches the proposers of the slots of the state the config is used with,
+	// and is only set by BlockGenerator, which never mutates its state.
+	proposers proposerCache
 }
 
 // DefaultBlockGenConfig returns the block config that utilizes the
@@ -40,118 +151,948 @@ func DefaultBlockGenConfig() *BlockGenConfig {
 	}
 }
 
+// BlockGenOption sets a field of a BlockGenConfig built by NewBlockGenConfig.
+type BlockGenOption func(*BlockGenConfig)
+
+// WithNumAttestations sets the number of attestations of the generated block.
+func WithNumAttestations(n uint64) BlockGenOption {
+	return func(conf *BlockGenConfig) {
+		conf.NumAttestations = n
+	}
+}
+
+// WithNumDeposits sets the number of deposits of the generated block.
+func WithNumDeposits(n uint64) BlockGenOption {
+	return func(conf *BlockGenConfig) {
+		conf.NumDeposits = n
+	}
+}
+
+// WithNumProposerSlashings sets the number of proposer slashings of the generated block.
+func WithNumProposerSlashings(n uint64) BlockGenOption {
+	return func(conf *BlockGenConfig) {
+		conf.NumProposerSlashings = n
+	}
+}
+
+// WithNumAttesterSlashings sets the number of attester slashings of the generated block.
+func WithNumAttesterSlashings(n uint64) BlockGenOption {
+	return func(conf *BlockGenConfig) {
+		conf.NumAttesterSlashings = n
+	}
+}
+
+// WithNumVoluntaryExits sets the number of voluntary exits of the generated block.
+func WithNumVoluntaryExits(n uint64) BlockGenOption {
+	return func(conf *BlockGenConfig) {
+		conf.NumVoluntaryExits = n
+	}
+}
+
+// WithSeed sets the seed used to pick the validators of the generated operations.
+func WithSeed(seed int64) BlockGenOption {
+	return func(conf *BlockGenConfig) {
+		conf.Seed = seed
+	}
+}
+
+// WithGraffiti sets the graffiti of the generated block.
+func WithGraffiti(graffiti []byte) BlockGenOption {
+	return func(conf *BlockGenConfig) {
+		conf.Graffiti = graffiti
+	}
+}
+
+// NewBlockGenConfig returns DefaultBlockGenConfig with the given options applied. It
+// returns an error when the resulting config is invalid, see Validate, or sets a graffiti
+// longer than 32 bytes.
+func NewBlockGenConfig(opts ...BlockGenOption) (*BlockGenConfig, error) {
+	conf := DefaultBlockGenConfig()
+	for _, opt := range opts {
+		opt(conf)
+	}
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+	if len(conf.Graffiti) > 32 {
+		return nil, fmt.Errorf("graffiti of %d bytes is longer than 32 bytes", len(conf.Graffiti))
+	}
+	return conf, nil
+}
+
+// Validate returns an error naming the offending field when the config requests more
+// operations of a kind than a block can contain under the current beacon config, a fork
+// version other than 4 bytes or an attestation slot offset beyond SLOTS_PER_EPOCH.
+// Whether the attestations can be split across the committees of the slot depends on the
+// state, so it is only checked on generation.
+func (conf *BlockGenConfig) Validate() error {
+	cfg := params.BeaconConfig()
+	limits := []struct {
+		field     string
+		name      string
+		requested uint64
+		max       uint64
+	}{
+		{
+			field:     "NumAttestations and Attestations",
+			name:      "attestations",
+			requested: conf.NumAttestations + uint64(len(conf.Attestations)),
+			max:       cfg.MaxAttestations,
+		},
+		{
+			field:     "NumDeposits and TopUpDeposits",
+			name:      "deposits",
+			requested: conf.NumDeposits + conf.TopUpDeposits,
+			max:       cfg.MaxDeposits,
+		},
+		{
+			field:     "NumProposerSlashings",
+			name:      "proposer slashings",
+			requested: conf.NumProposerSlashings,
+			max:       cfg.MaxProposerSlashings,
+		},
+		{
+			field:     "NumAttesterSlashings",
+			name:      "attester slashings",
+			requested: conf.NumAttesterSlashings,
+			max:       cfg.MaxAttesterSlashings,
+		},
+		{
+			field:     "NumVoluntaryExits",
+			name:      "voluntary exits",
+			requested: conf.NumVoluntaryExits,
+			max:       cfg.MaxVoluntaryExits,
+		},
+	}
+	for _, limit := range limits {
+		if limit.requested > limit.max {
+			return fmt.Errorf(
+				"requested %d %s with %s, a block can contain at most %d",
+				limit.requested,
+				limit.name,
+				limit.field,
+				limit.max,
+			)
+		}
+	}
+	if conf.ForkVersion != nil && len(conf.ForkVersion) != 4 {
+		return fmt.Errorf("fork version set with ForkVersion must be 4 bytes, received %d", len(conf.ForkVersion))
+	}
+	if conf.AttestationSlotOffset > cfg.SlotsPerEpoch {
+		return fmt.Errorf(
+			"attestation slot offset of %d slots set with AttestationSlotOffset is beyond the inclusion range of %d slots",
+			conf.AttestationSlotOffset,
+			cfg.SlotsPerEpoch,
+		)
+	}
+	return nil
+}
+
 // GenerateFullBlock generates a fully valid block with the requested parameters.
 // Use BlockGenConfig to declare the conditions you would like the block generated under.
+//
+// The generated operations are in a canonical order, so the body root only depends on
+// the config: proposer slashings are sorted by proposer index, attester slashings by the
+// first attesting index of their first attestation and voluntary exits by validator index.
 func GenerateFullBlock(
 	bState *stateTrie.BeaconState,
 	privs []*bls.SecretKey,
 	conf *BlockGenConfig,
 	slot uint64,
 ) (*ethpb.SignedBeaconBlock, error) {
+	return GenerateFullBlockWithContext(context.Background(), bState, privs, conf, slot)
+}
+
+// GenerateFullBlockWithState generates a block like GenerateFullBlock and also returns the
+// state after the block, which is computed anyway to fill in the block state root. The
+// state is nil for blocks generated with CorruptAttesterSlashingIdenticalAttestations or
+// SkipStateRoot, which commit to no post state. For other corrupted blocks it is the
+// state the block commits to, even though the block fails the state transition.
+func GenerateFullBlockWithState(
+	bState *stateTrie.BeaconState,
+	privs []*bls.SecretKey,
+	conf *BlockGenConfig,
+	slot uint64,
+) (*ethpb.SignedBeaconBlock, *stateTrie.BeaconState, error) {
+	return generateFullBlock(context.Background(), bState, nil, privs, conf, slot)
+}
+
+// GenerateFullBlockWithContext is GenerateFullBlock with a context which aborts the
+// generation, including the state transitions it runs, once it is cancelled.
+func GenerateFullBlockWithContext(
+	ctx context.Context,
+	bState *stateTrie.BeaconState,
+	privs []*bls.SecretKey,
+	conf *BlockGenConfig,
+	slot uint64,
+) (*ethpb.SignedBeaconBlock, error) {
+	block, _, err := generateFullBlock(ctx, bState, nil, privs, conf, slot)
+	return block, err
+}
+
+// GenerateFullBlockWithHeadState generates a block like GenerateFullBlock given the head
+// state, which is the given state advanced to the slot of the block by state.ProcessSlots.
+// The state root of the block is computed by processing the block on a copy of the head
+// state, without processing the slots again, which saves most of the cost of generating
+// a block when the caller has the head state at hand anyway, e.g. when generating a chain.
+func GenerateFullBlockWithHeadState(
+	bState *stateTrie.BeaconState,
+	headState *stateTrie.BeaconState,
+	privs []*bls.SecretKey,
+	conf *BlockGenConfig,
+	slot uint64,
+) (*ethpb.SignedBeaconBlock, error) {
+	blockSlot := slot
+	if blockSlot == bState.Slot() {
+		blockSlot++
+	}
+	if headState.Slot() != blockSlot {
+		return nil, fmt.Errorf("head state is at slot %d instead of the block slot %d", headState.Slot(), blockSlot)
+	}
+	block, _, err := generateFullBlock(context.Background(), bState, headState, privs, conf, slot)
+	return block, err
+}
+
+// RequiredSignerIndices returns the sorted indices of the validators whose private keys
+// GenerateFullBlock signs with when generating a block with the given config at the given
+// slot on top of the given state: the proposer, the attesters of the generated
+// attestations and the validators slashed, exited or topped up by the block. A block
+// generated with keys for these validators only is identical to one generated with all
+// keys. The config must not set Rand, as its draws would differ between the calls.
+func RequiredSignerIndices(bState *stateTrie.BeaconState, conf *BlockGenConfig, slot uint64) ([]uint64, error) {
+	if conf == nil {
+		conf = &BlockGenConfig{}
+	}
+	if conf.Rand != nil {
+		return nil, errors.New("signers can't be predicted for a config with a source of randomness set")
+	}
+	blockSlot := slot
+	if blockSlot == bState.Slot() {
+		blockSlot++
+	}
+	headState, err := state.ProcessSlots(context.Background(), bState.Copy(), blockSlot)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not process slot")
+	}
+
+	// The operations don't depend on the keys they are signed with, so the block is
+	// generated with a single placeholder key, and neither signed nor processed.
+	key := bls.RandKey()
+	placeholderPrivs := make([]*bls.SecretKey, bState.NumValidators())
+	for i := range placeholderPrivs {
+		placeholderPrivs[i] = key
+	}
+	genConf := *conf
+	genConf.Attestations = nil
+	genConf.Unsigned = true
+	genConf.SkipStateRoot = true
+	genConf.VerifyTransition = false
+	block, err := GenerateFullBlock(bState, placeholderPrivs, &genConf, slot)
+	if err != nil {
+		return nil, err
+	}
+	body := block.Block.Body
+
+	signers := make(map[uint64]bool)
+	if !conf.Unsigned {
+		proposerIdx, _, err := proposerAndDomain(bState, blockSlot)
+		if err != nil {
+			return nil, err
+		}
+		signers[proposerIdx] = true
+	}
+	attesters, err := ParticipatingIndices(headState, body.Attestations)
+	if err != nil {
+		return nil, err
+	}
+	for _, idx := range attesters {
+		signers[idx] = true
+	}
+	if conf.Corruption == CorruptAttestationSignature && len(body.Attestations) > 0 {
+		signers[0] = true
+	}
+	for _, slashing := range body.ProposerSlashings {
+		signers[slashing.ProposerIndex] = true
+	}
+	for _, slashing := range body.AttesterSlashings {
+		for _, att := range []*ethpb.IndexedAttestation{slashing.Attestation_1, slashing.Attestation_2} {
+			for _, idx := range att.AttestingIndices {
+				signers[idx] = true
+			}
+		}
+	}
+	for _, exit := range body.VoluntaryExits {
+		signers[exit.Exit.ValidatorIndex] = true
+	}
+	for _, deposit := range body.Deposits {
+		if idx, ok := bState.ValidatorIndexByPubkey(bytesutil.ToBytes48(deposit.Data.PublicKey)); ok {
+			signers[idx] = true
+		}
+	}
+
+	indices := make([]uint64, 0, len(signers))
+	for idx := range signers {
+		indices = append(indices, idx)
+	}
+	sort.Slice(indices, func(i, j int) bool {
+		return indices[i] < indices[j]
+	})
+	return indices, nil
+}
+
+// BlockGenerator generates blocks on top of a fixed state like GenerateFullBlock, for
+// benchmarks generating many blocks. It caches the state advanced to the slot of every
+// block it generates and the proposer of that slot, so generating another block at the
+// same slot skips the slot processing and the state copies looking up the proposer.
+// The body slices end up in the returned blocks, so they are allocated for every block.
+// A BlockGenerator is not safe for concurrent use.
+type BlockGenerator struct {
+	bState     *stateTrie.BeaconState
+	privs      []*bls.SecretKey
+	conf       *BlockGenConfig
+	headStates map[uint64]*stateTrie.BeaconState
+}
+
+// NewBlockGenerator returns a generator of blocks with the given config on top of a copy of
+// the given state, so later changes to the state don't affect the generated blocks.
+func NewBlockGenerator(bState *stateTrie.BeaconState, privs []*bls.SecretKey, conf *BlockGenConfig) *BlockGenerator {
+	if conf == nil {
+		conf = &BlockGenConfig{}
+	}
+	genConf := *conf
+	genConf.proposers = make(proposerCache)
+	return &BlockGenerator{
+		bState:     bState.Copy(),
+		privs:      privs,
+		conf:       &genConf,
+		headStates: make(map[uint64]*stateTrie.BeaconState),
+	}
+}
+
+// Generate generates a block at the given slot like GenerateFullBlock, or at the next slot
+// when the slot is the slot of the state of the generator.
+func (g *BlockGenerator) Generate(slot uint64) (*ethpb.SignedBeaconBlock, error) {
+	if slot < g.bState.Slot() {
+		return nil, fmt.Errorf("current slot in state is larger than given slot. %d > %d", g.bState.Slot(), slot)
+	}
+	blockSlot := slot
+	if blockSlot == g.bState.Slot() {
+		blockSlot++
+	}
+	headState, ok := g.headStates[blockSlot]
+	if !ok {
+		var err error
+		headState, err = state.ProcessSlots(context.Background(), g.bState.Copy(), blockSlot)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not process slot")
+		}
+		g.headStates[blockSlot] = headState
+	}
+	block, _, err := generateFullBlock(context.Background(), g.bState, headState, g.privs, g.conf, slot)
+	return block, err
+}
+
+// generateFullBlock generates a block on top of the given state. The head state, when set,
+// is the state at the slot of the block the block is processed on for the state root.
+func generateFullBlock(
+	ctx context.Context,
+	bState *stateTrie.BeaconState,
+	headState *stateTrie.BeaconState,
+	privs []*bls.SecretKey,
+	conf *BlockGenConfig,
+	slot uint64,
+) (*ethpb.SignedBeaconBlock, *stateTrie.BeaconState, error) {
+	if ctx.Err() != nil {
+		return nil, nil, ctx.Err()
+	}
 	currentSlot := bState.Slot()
 	if currentSlot > slot {
-		return nil, fmt.Errorf("current slot in state is larger than given slot. %d > %d", currentSlot, slot)
+		return nil, nil, fmt.Errorf("current slot in state is larger than given slot. %d > %d", currentSlot, slot)
 	}
 	bState = bState.Copy()
 
 	if conf == nil {
 		conf = &BlockGenConfig{}
 	}
+	if err := conf.Validate(); err != nil {
+		return nil, nil, err
+	}
+	signingState, err := signingStateOf(bState, conf)
+	if err != nil {
+		return nil, nil, err
+	}
+	body, err := generateBlockBody(ctx, signingState, privs, conf, slot)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	parentRoot, err := latestBlockRoot(bState)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if slot == currentSlot {
+		slot = currentSlot + 1
+	}
+	block := &ethpb.BeaconBlock{
+		Slot:       slot,
+		ParentRoot: parentRoot[:],
+		Body:       body,
+	}
+
+	var postState *stateTrie.BeaconState
+	switch {
+	case conf.Corruption == CorruptAttesterSlashingIdenticalAttestations:
+		// The block operations can't be processed, so there is no post state root to
+		// commit to. The block is signed as is, it is rejected before the root is checked.
+	case conf.SkipStateRoot:
+		block.StateRoot = params.BeaconConfig().ZeroHash[:]
+	case headState != nil:
+		postState, err = processBlockOnHeadState(ctx, headState.Copy(), block)
+		if err != nil {
+			return nil, nil, err
+		}
+	default:
+		postState, err = processBlockForStateRoot(ctx, bState, block)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	if conf.Corruption == CorruptStateRoot {
+		block.StateRoot = params.BeaconConfig().ZeroHash[:]
+	}
+
+	blockSig := make([]byte, params.BeaconConfig().BLSSignatureLength)
+	if !conf.Unsigned {
+		signingRoot, err := ssz.HashTreeRoot(block)
+		if err != nil {
+			return nil, nil, err
+		}
+		if conf.Corruption == CorruptProposerSigningRoot {
+			signingRoot = bytesutil.ToBytes32(block.ParentRoot)
+		}
+		proposerIdx, domain, err := conf.proposers.proposerAndDomain(signingState, block.Slot)
+		if err != nil {
+			return nil, nil, err
+		}
+		blockSig = privs[proposerIdx].Sign(signingRoot[:], domain).Marshal()
+	}
+	signed := &ethpb.SignedBeaconBlock{Block: block, Signature: blockSig}
+	if conf.VerifyTransition && generatesProcessableBlock(conf) {
+		if err := blockProcessable(ctx, bState, signed); err != nil {
+			return nil, nil, errors.Wrap(err, "generated block fails the state transition")
+		}
+	}
+	return signed, postState, nil
+}
+
+// generatesProcessableBlock returns whether blocks generated with the config are expected
+// to pass the state transition.
+func generatesProcessableBlock(conf *BlockGenConfig) bool {
+	if conf.SkipStateRoot || conf.Unsigned || conf.ForkVersion != nil {
+		return false
+	}
+	return conf.Corruption == NoCorruption || conf.Corruption == CorruptAttestationTargetRoot
+}
+
+// latestBlockRoot returns the root of the latest block header of the state, which is the
+// parent root of the next block.
+func latestBlockRoot(bState *stateTrie.BeaconState) ([32]byte, error) {
+	// The state root of the latest block header is only filled in by the slot processing
+	// that follows the block, so it is still unset unless the state went past empty slots.
+	header := bState.LatestBlockHeader()
+	if bytes.Equal(header.StateRoot, params.BeaconConfig().ZeroHash[:]) {
+		stateRoot, err := bState.HashTreeRoot()
+		if err != nil {
+			return [32]byte{}, err
+		}
+		header.StateRoot = stateRoot[:]
+	}
+	return ssz.HashTreeRoot(header)
+}
+
+// GenerateBlockBody generates the body of a fully valid block with the requested parameters
+// at the given slot, like GenerateFullBlock does, for tests that only need the body. The
+// operations and RANDAO reveal of the body are valid for a block at that slot on top of
+// the given state, which is not mutated.
+func GenerateBlockBody(
+	bState *stateTrie.BeaconState,
+	privs []*bls.SecretKey,
+	conf *BlockGenConfig,
+	slot uint64,
+) (*ethpb.BeaconBlockBody, error) {
+	if bState.Slot() > slot {
+		return nil, fmt.Errorf("current slot in state is larger than given slot. %d > %d", bState.Slot(), slot)
+	}
+	if conf == nil {
+		conf = &BlockGenConfig{}
+	}
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+	signingState, err := signingStateOf(bState.Copy(), conf)
+	if err != nil {
+		return nil, err
+	}
+	return generateBlockBody(context.Background(), signingState, privs, conf, slot)
+}
+
+// signingStateOf returns the state whose fork the block elements are signed under, which
+// is a copy of the given state with the fork of conf.ForkVersion when it is set.
+func signingStateOf(bState *stateTrie.BeaconState, conf *BlockGenConfig) (*stateTrie.BeaconState, error) {
+	if conf.ForkVersion == nil {
+		return bState, nil
+	}
+	if len(conf.ForkVersion) != 4 {
+		return nil, fmt.Errorf("fork version must be 4 bytes, received %d", len(conf.ForkVersion))
+	}
+	signingState := bState.Copy()
+	fork := &pb.Fork{
+		PreviousVersion: conf.ForkVersion,
+		CurrentVersion:  conf.ForkVersion,
+		Epoch:           bState.Fork().Epoch,
+	}
+	if err := signingState.SetFork(fork); err != nil {
+		return nil, err
+	}
+	return signingState, nil
+}
+
+// generateBlockBody generates the body of a block at the given slot on top of the given
+// state, or at the next slot if the state is at that slot already. The state is used as
+// scratch space and must be a copy owned by the caller.
+func generateBlockBody(
+	ctx context.Context,
+	bState *stateTrie.BeaconState,
+	privs []*bls.SecretKey,
+	conf *BlockGenConfig,
+	slot uint64,
+) (*ethpb.BeaconBlockBody, error) {
+	currentSlot := bState.Slot()
+	blockSlot := slot
+	if blockSlot == currentSlot {
+		blockSlot = currentSlot + 1
+	}
+	randGen := conf.Rand
+	if randGen == nil {
+		randGen = rand.New(rand.NewSource(conf.Seed))
+	}
+
+	// Every validator is affected by at most one slashing or exit of the block, otherwise
+	// the block fails processing as the validator is already slashed or exited.
+	activeCount, err := helpers.ActiveValidatorCount(bState, helpers.CurrentEpoch(bState))
+	if err != nil {
+		return nil, err
+	}
+	if activeCount == 0 {
+		return nil, fmt.Errorf("no active validators at epoch %d to propose a block", helpers.CurrentEpoch(bState))
+	}
+	if numAffected := conf.NumProposerSlashings + conf.NumAttesterSlashings + conf.NumVoluntaryExits; numAffected > activeCount {
+		return nil, fmt.Errorf(
+			"requested %d slashings and exits of distinct validators, but there are only %d active validators",
+			numAffected,
+			activeCount,
+		)
+	}
+	usedIndices := make(map[uint64]bool)
+	if err := reserveIndices(usedIndices, conf.ProposerSlashingIndices, conf.NumProposerSlashings); err != nil {
+		return nil, err
+	}
+	if err := reserveIndices(usedIndices, conf.VoluntaryExitIndices, conf.NumVoluntaryExits); err != nil {
+		return nil, err
+	}
 
-	var err error
 	pSlashings := []*ethpb.ProposerSlashing{}
 	numToGen := conf.NumProposerSlashings
 	if numToGen > 0 {
-		pSlashings, err = generateProposerSlashings(bState, privs, numToGen)
+		pSlashings, err = generateProposerSlashings(bState, privs, numToGen, conf.ProposerSlashingIndices, usedIndices, randGen)
 		if err != nil {
-			return nil, errors.Wrapf(err, "failed generating %d proposer slashings:", numToGen)
+			return nil, errors.Wrapf(err, "failed generating %d proposer slashings", numToGen)
 		}
 	}
 
 	numToGen = conf.NumAttesterSlashings
 	aSlashings := []*ethpb.AttesterSlashing{}
 	if numToGen > 0 {
-		aSlashings, err = generateAttesterSlashings(bState, privs, numToGen)
+		aSlashings, err = generateAttesterSlashings(bState, privs, numToGen, conf.AttesterSlashingType, usedIndices, randGen)
 		if err != nil {
-			return nil, errors.Wrapf(err, "failed generating %d attester slashings:", numToGen)
+			return nil, errors.Wrapf(err, "failed generating %d attester slashings", numToGen)
+		}
+		if conf.Corruption == CorruptAttesterSlashingIdenticalAttestations {
+			for _, slashing := range aSlashings {
+				slashing.Attestation_2 = proto.Clone(slashing.Attestation_1).(*ethpb.IndexedAttestation)
+			}
 		}
 	}
 
 	numToGen = conf.NumAttestations
 	atts := []*ethpb.Attestation{}
 	if numToGen > 0 {
-		atts, err = GenerateAttestations(bState, privs, numToGen, slot, false)
+		offset := conf.AttestationSlotOffset
+		if offset == 0 || offset == params.BeaconConfig().MinAttestationInclusionDelay {
+			atts, _, err = generateAttestations(ctx, bState, privs, numToGen, slot, false)
+		} else {
+			atts, err = generateAttestationsWithOffset(ctx, bState, privs, numToGen, blockSlot, offset)
+		}
 		if err != nil {
-			return nil, errors.Wrapf(err, "failed generating %d attestations:", numToGen)
+			return nil, errors.Wrapf(err, "failed generating %d attestations", numToGen)
+		}
+		if conf.Corruption == CorruptAttestationTargetRoot {
+			if err := setAttestationTargetToHead(bState, privs, atts); err != nil {
+				return nil, errors.Wrap(err, "failed corrupting attestation target roots")
+			}
+		}
+	}
+	atts = append(atts, conf.Attestations...)
+	if conf.Corruption == CorruptAttestationSignature {
+		if len(atts) == 0 {
+			return nil, errors.New("no attestation to corrupt the signature of")
 		}
+		// The attestation may be provided by the caller, so it is replaced rather than modified.
+		att := proto.Clone(atts[0]).(*ethpb.Attestation)
+		domain := helpers.Domain(bState.Fork(), att.Data.Target.Epoch, params.BeaconConfig().DomainBeaconAttester)
+		att.Signature = privs[0].Sign(params.BeaconConfig().ZeroHash[:], domain).Marshal()
+		atts[0] = att
+	}
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
 	}
 
 	numToGen = conf.NumDeposits
 	newDeposits, eth1Data := []*ethpb.Deposit{}, bState.Eth1Data()
-	if numToGen > 0 {
-		newDeposits, eth1Data, err = generateDepositsAndEth1Data(bState, numToGen)
+	if numToGen > 0 || conf.TopUpDeposits > 0 {
+		newDeposits, eth1Data, err = generateDepositsAndEth1Data(
+			bState,
+			privs,
+			numToGen,
+			conf.WithdrawalCredentials,
+			conf.TopUpDeposits,
+			randGen,
+		)
 		if err != nil {
-			return nil, errors.Wrapf(err, "failed generating %d deposits:", numToGen)
+			return nil, errors.Wrapf(err, "failed generating %d deposits and %d top up deposits", numToGen, conf.TopUpDeposits)
 		}
 	}
+	if conf.Eth1Data != nil {
+		eth1Data = conf.Eth1Data
+	}
 
 	numToGen = conf.NumVoluntaryExits
 	exits := []*ethpb.SignedVoluntaryExit{}
 	if numToGen > 0 {
-		exits, err = generateVoluntaryExits(bState, privs, numToGen)
+		exits, err = generateVoluntaryExits(bState, privs, numToGen, conf.VoluntaryExitIndices, usedIndices, randGen)
 		if err != nil {
-			return nil, errors.Wrapf(err, "failed generating %d attester slashings:", numToGen)
+			return nil, errors.Wrapf(err, "failed generating %d voluntary exits", numToGen)
 		}
 	}
 
-	newHeader := bState.LatestBlockHeader()
-	prevStateRoot, err := bState.HashTreeRoot()
-	if err != nil {
-		return nil, err
+	revealEpoch := helpers.SlotToEpoch(blockSlot)
+	if conf.Corruption == CorruptRandaoRevealEpoch {
+		revealEpoch++
 	}
-	newHeader.StateRoot = prevStateRoot[:]
-	parentRoot, err := ssz.HashTreeRoot(newHeader)
-	if err != nil {
-		return nil, err
+	reveal := PlaceholderRandaoReveal()
+	if !conf.Unsigned {
+		proposerIdx, _, err := conf.proposers.proposerAndDomain(bState, blockSlot)
+		if err != nil {
+			return nil, err
+		}
+		reveal, err = RandaoRevealForProposer(bState, revealEpoch, proposerIdx, privs)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	if slot == currentSlot {
-		slot = currentSlot + 1
-	}
+	sortBlockOperations(pSlashings, aSlashings, exits)
+	graffiti := bytesutil.ToBytes32(conf.Graffiti)
+	return &ethpb.BeaconBlockBody{
+		Eth1Data:          eth1Data,
+		RandaoReveal:      reveal,
+		Graffiti:          graffiti[:],
+		ProposerSlashings: pSlashings,
+		AttesterSlashings: aSlashings,
+		Attestations:      atts,
+		VoluntaryExits:    exits,
+		Deposits:          newDeposits,
+	}, nil
+}
 
-	// Temporarily incrementing the beacon state slot here since BeaconProposerIndex is a
-	// function deterministic on beacon state slot.
-	if err := bState.SetSlot(slot); err != nil {
-		return nil, err
+// sortBlockOperations sorts the slashings and exits of a block in the canonical order of
+// generated blocks, as the validators they target are picked at random.
+func sortBlockOperations(
+	pSlashings []*ethpb.ProposerSlashing,
+	aSlashings []*ethpb.AttesterSlashing,
+	exits []*ethpb.SignedVoluntaryExit,
+) {
+	sort.SliceStable(pSlashings, func(i, j int) bool {
+		return pSlashings[i].ProposerIndex < pSlashings[j].ProposerIndex
+	})
+	firstIndex := func(slashing *ethpb.AttesterSlashing) uint64 {
+		if len(slashing.Attestation_1.AttestingIndices) == 0 {
+			return 0
+		}
+		return slashing.Attestation_1.AttestingIndices[0]
 	}
-	reveal, err := RandaoReveal(bState, helpers.CurrentEpoch(bState), privs)
+	sort.SliceStable(aSlashings, func(i, j int) bool {
+		return firstIndex(aSlashings[i]) < firstIndex(aSlashings[j])
+	})
+	sort.SliceStable(exits, func(i, j int) bool {
+		return exits[i].Exit.ValidatorIndex < exits[j].Exit.ValidatorIndex
+	})
+}
+
+// GenerateFullBlockAtSlotSkipping generates a fully valid block on top of the given state
+// after skipSlots slots without a block, so the block is at slot bState.Slot()+skipSlots+1
+// and its parent is the latest block of the given state. The block operations, proposer and
+// RANDAO reveal are computed on a copy of the state advanced through the skipped slots, and
+// attestations are made for the last skipped slot.
+func GenerateFullBlockAtSlotSkipping(
+	bState *stateTrie.BeaconState,
+	privs []*bls.SecretKey,
+	conf *BlockGenConfig,
+	skipSlots uint64,
+) (*ethpb.SignedBeaconBlock, error) {
+	ctx := context.Background()
+	headState, err := state.ProcessSlots(ctx, bState.Copy(), bState.Slot()+skipSlots)
 	if err != nil {
-		return nil, err
+		return nil, errors.Wrapf(err, "could not process %d skipped slots", skipSlots)
 	}
+	return GenerateFullBlockWithContext(ctx, headState, privs, conf, headState.Slot())
+}
 
-	block := &ethpb.BeaconBlock{
-		Slot:       slot,
-		ParentRoot: parentRoot[:],
-		Body: &ethpb.BeaconBlockBody{
-			Eth1Data:          eth1Data,
-			RandaoReveal:      reveal,
-			ProposerSlashings: pSlashings,
-			AttesterSlashings: aSlashings,
-			Attestations:      atts,
-			VoluntaryExits:    exits,
-			Deposits:          newDeposits,
-		},
-	}
-	if err := bState.SetSlot(currentSlot); err != nil {
-		return nil, err
+// GenerateFullBlockWithAttestations generates a block like GenerateFullBlock whose
+// attestations are exactly the given ones, in order, instead of generated attestations,
+// e.g. for testing how attestations of a pool are packed into a block. The attestations
+// are included as is and the state root accounts for them.
+func GenerateFullBlockWithAttestations(
+	bState *stateTrie.BeaconState,
+	privs []*bls.SecretKey,
+	conf *BlockGenConfig,
+	slot uint64,
+	atts []*ethpb.Attestation,
+) (*ethpb.SignedBeaconBlock, error) {
+	if uint64(len(atts)) > params.BeaconConfig().MaxAttestations {
+		return nil, fmt.Errorf("%d attestations exceed the maximum of %d", len(atts), params.BeaconConfig().MaxAttestations)
+	}
+	attsConf := &BlockGenConfig{}
+	if conf != nil {
+		*attsConf = *conf
+	}
+	attsConf.NumAttestations = 0
+	attsConf.Attestations = atts
+	return GenerateFullBlock(bState, privs, attsConf, slot)
+}
+
+// GenerateFullBlockFromParent generates a block like GenerateFullBlock on top of the block
+// with the given root. The state must be the state after that block, a block can only
+// extend the latest block header of its pre state, so an error is returned when the root
+// is not the root of that header. To build competing chains from a common ancestor, keep
+// the state of the ancestor, e.g. as returned by GenerateFullBlockWithState, and generate
+// every branch from it.
+func GenerateFullBlockFromParent(
+	bState *stateTrie.BeaconState,
+	privs []*bls.SecretKey,
+	conf *BlockGenConfig,
+	slot uint64,
+	parentRoot [32]byte,
+) (*ethpb.SignedBeaconBlock, error) {
+	latestRoot, err := latestBlockRoot(bState)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not get root of latest block header")
+	}
+	if latestRoot != parentRoot {
+		return nil, fmt.Errorf("parent root %#x is not the root %#x of the latest block header of the state", parentRoot, latestRoot)
+	}
+	return GenerateFullBlock(bState, privs, conf, slot)
+}
+
+// GenerateForkTransitionBlock schedules a fork to the given version at forkEpoch on a copy
+// of the state, the current fork version of the state becoming the previous version, and
+// generates a block with the given config at the first slot of forkEpoch on top of it. The
+// block is signed under the new version, while its operations of earlier epochs are signed
+// under the previous one. The block is returned along with the state with the fork
+// scheduled, which is the state to process it on.
+func GenerateForkTransitionBlock(
+	bState *stateTrie.BeaconState,
+	privs []*bls.SecretKey,
+	conf *BlockGenConfig,
+	forkEpoch uint64,
+	version []byte,
+) (*ethpb.SignedBeaconBlock, *stateTrie.BeaconState, error) {
+	if len(version) != 4 {
+		return nil, nil, fmt.Errorf("fork version must be 4 bytes, received %d", len(version))
+	}
+	forkSlot := helpers.StartSlot(forkEpoch)
+	if forkSlot <= bState.Slot() {
+		return nil, nil, fmt.Errorf("fork slot %d is not after the slot of the state %d", forkSlot, bState.Slot())
+	}
+	forkState := bState.Copy()
+	fork := &pb.Fork{
+		PreviousVersion: bState.Fork().CurrentVersion,
+		CurrentVersion:  version,
+		Epoch:           forkEpoch,
+	}
+	if err := forkState.SetFork(fork); err != nil {
+		return nil, nil, err
+	}
+	block, err := GenerateFullBlock(forkState, privs, conf, forkSlot)
+	if err != nil {
+		return nil, nil, err
 	}
+	return block, forkState, nil
+}
+
+// GenerateForkedBlocks generates numBlocks valid sibling blocks at the same slot on top of
+// the given state, e.g. for testing fork choice. The blocks are generated like
+// GenerateFullBlock with the given config, except the i-th block has the graffiti "fork i",
+// so they share their parent root and proposer but have distinct bodies and state roots.
+func GenerateForkedBlocks(
+	bState *stateTrie.BeaconState,
+	privs []*bls.SecretKey,
+	conf *BlockGenConfig,
+	slot uint64,
+	numBlocks uint64,
+) ([]*ethpb.SignedBeaconBlock, error) {
+	forkConf := &BlockGenConfig{}
+	if conf != nil {
+		*forkConf = *conf
+	}
+	blocks := make([]*ethpb.SignedBeaconBlock, numBlocks)
+	for i := range blocks {
+		forkConf.Graffiti = []byte(fmt.Sprintf("fork %d", i))
+		block, err := GenerateFullBlock(bState, privs, forkConf, slot)
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not generate forked block %d", i)
+		}
+		blocks[i] = block
+	}
+	return blocks, nil
+}
 
-	signature, err := BlockSignature(bState, block, privs)
+// GenerateDoubleProposal generates two valid blocks at the given slot on top of the given
+// state, signed by the proposer of the slot, with different bodies. Their headers make up
+// a proposer slashing of that proposer, e.g. for testing the detection of double proposals.
+func GenerateDoubleProposal(
+	bState *stateTrie.BeaconState,
+	privs []*bls.SecretKey,
+	slot uint64,
+) (*ethpb.SignedBeaconBlock, *ethpb.SignedBeaconBlock, error) {
+	proposals, err := GenerateForkedBlocks(bState, privs, nil, slot, 2)
+	if err != nil {
+		return nil, nil, err
+	}
+	return proposals[0], proposals[1], nil
+}
+
+// GenerateValidBlock generates a block at the given slot containing only operations that
+// are valid for the given state, so the block always passes the state transition without
+// the caller knowing what the state allows. It inspects the state at the block slot and
+// includes all pending deposits, which are mandatory, a proposer slashing of the first
+// slashable validator and a voluntary exit of the first other validator eligible to exit.
+// Attestations for every committee of the previous slot are included when the block is in
+// the same epoch as the state, so their source is unaffected by epoch processing.
+//
+// Pending deposits must be deterministic deposits and fit in a single block.
+func GenerateValidBlock(
+	bState *stateTrie.BeaconState,
+	privs []*bls.SecretKey,
+	slot uint64,
+) (*ethpb.SignedBeaconBlock, error) {
+	if slot <= bState.Slot() {
+		return nil, fmt.Errorf("block slot %d must be after state slot %d", slot, bState.Slot())
+	}
+	headState, err := state.ProcessSlots(context.Background(), bState.Copy(), slot)
 	if err != nil {
 		return nil, err
 	}
+	epoch := helpers.CurrentEpoch(headState)
+	conf := &BlockGenConfig{}
 
-	return &ethpb.SignedBeaconBlock{Block: block, Signature: signature.Marshal()}, nil
+	pendingDeposits := headState.Eth1Data().DepositCount - headState.Eth1DepositIndex()
+	if pendingDeposits > params.BeaconConfig().MaxDeposits {
+		return nil, fmt.Errorf(
+			"%d pending deposits do not fit in a block of at most %d deposits",
+			pendingDeposits,
+			params.BeaconConfig().MaxDeposits,
+		)
+	}
+	conf.NumDeposits = pendingDeposits
+
+	// The exit is generated on the given state and processed on the head state, which
+	// may be in a later epoch, so the exiting validator must be eligible in both.
+	preEpoch := helpers.CurrentEpoch(bState)
+	slashedIdx := uint64(headState.NumValidators())
+	exitIdx := uint64(headState.NumValidators())
+	if err := headState.ReadFromEveryValidator(func(idx int, val *stateTrie.ReadOnlyValidator) error {
+		i := uint64(idx)
+		slashable := !val.Slashed() && val.ActivationEpoch() <= epoch && epoch < val.WithdrawableEpoch()
+		if slashable && slashedIdx == uint64(headState.NumValidators()) {
+			slashedIdx = i
+			return nil
+		}
+		if exitIdx < uint64(headState.NumValidators()) || !canExit(val, epoch) {
+			return nil
+		}
+		preVal, err := bState.ValidatorAtIndexReadOnly(i)
+		if err != nil {
+			return err
+		}
+		if canExit(preVal, preEpoch) {
+			exitIdx = i
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	if slashedIdx < uint64(headState.NumValidators()) {
+		conf.NumProposerSlashings = 1
+		conf.ProposerSlashingIndices = []uint64{slashedIdx}
+	}
+	if exitIdx < uint64(headState.NumValidators()) {
+		conf.NumVoluntaryExits = 1
+		conf.VoluntaryExitIndices = []uint64{exitIdx}
+	}
+
+	if helpers.SlotToEpoch(bState.Slot()) == epoch {
+		activeCount, err := helpers.ActiveValidatorCount(headState, epoch)
+		if err != nil {
+			return nil, err
+		}
+		conf.NumAttestations = helpers.SlotCommitteeCount(activeCount)
+	}
+	return GenerateFullBlock(bState, privs, conf, slot)
+}
+
+// GenerateBlockWithMaxProposerSlashings generates an otherwise empty block at the given
+// slot containing MAX_PROPOSER_SLASHINGS proposer slashings, each against a different
+// validator scheduled to propose a block in the current epoch of the state. This is the
+// realistic worst case for proposer slashing processing.
+func GenerateBlockWithMaxProposerSlashings(
+	bState *stateTrie.BeaconState,
+	privs []*bls.SecretKey,
+	slot uint64,
+) (*ethpb.SignedBeaconBlock, error) {
+	schedule, err := ProposerSchedule(bState)
+	if err != nil {
+		return nil, err
+	}
+	maxSlashings := params.BeaconConfig().MaxProposerSlashings
+	indices := make([]uint64, 0, maxSlashings)
+	seen := make(map[uint64]bool)
+	for _, idx := range schedule {
+		if seen[idx] || uint64(len(indices)) == maxSlashings {
+			continue
+		}
+		seen[idx] = true
+		indices = append(indices, idx)
+	}
+	if uint64(len(indices)) < maxSlashings {
+		return nil, fmt.Errorf("only %d distinct proposers in the current epoch, need %d", len(indices), maxSlashings)
+	}
+	conf := &BlockGenConfig{
+		NumProposerSlashings:    maxSlashings,
+		ProposerSlashingIndices: indices,
+	}
+	return GenerateFullBlock(bState, privs, conf, slot)
 }
 
 // GenerateProposerSlashingForValidator for a specific validator index.
@@ -159,6 +1100,18 @@ func GenerateProposerSlashingForValidator(
 	bState *stateTrie.BeaconState,
 	priv *bls.SecretKey,
 	idx uint64,
+) (*ethpb.ProposerSlashing, error) {
+	domain := helpers.Domain(bState.Fork(), helpers.CurrentEpoch(bState), params.BeaconConfig().DomainBeaconProposer)
+	return proposerSlashingForValidator(bState, priv, idx, domain)
+}
+
+// proposerSlashingForValidator is GenerateProposerSlashingForValidator with the proposer
+// domain of the current epoch precomputed by the caller.
+func proposerSlashingForValidator(
+	bState *stateTrie.BeaconState,
+	priv *bls.SecretKey,
+	idx uint64,
+	domain uint64,
 ) (*ethpb.ProposerSlashing, error) {
 	header1 := &ethpb.SignedBeaconBlockHeader{
 		Header: &ethpb.BeaconBlockHeader{
@@ -170,190 +1123,1013 @@ func GenerateProposerSlashingForValidator(
 	if err != nil {
 		return nil, err
 	}
-	currentEpoch := helpers.CurrentEpoch(bState)
-	domain := helpers.Domain(bState.Fork(), currentEpoch, params.BeaconConfig().DomainBeaconProposer)
-	header1.Signature = priv.Sign(root[:], domain).Marshal()
+	header1.Signature = priv.Sign(root[:], domain).Marshal()
+
+	header2 := &ethpb.SignedBeaconBlockHeader{
+		Header: &ethpb.BeaconBlockHeader{
+			Slot:     bState.Slot(),
+			BodyRoot: []byte{0, 2, 0},
+		},
+	}
+	root, err = ssz.HashTreeRoot(header2.Header)
+	if err != nil {
+		return nil, err
+	}
+	header2.Signature = priv.Sign(root[:], domain).Marshal()
+
+	return &ethpb.ProposerSlashing{
+		ProposerIndex: idx,
+		Header_1:      header1,
+		Header_2:      header2,
+	}, nil
+}
+
+func generateProposerSlashings(
+	bState *stateTrie.BeaconState,
+	privs []*bls.SecretKey,
+	numSlashings uint64,
+	indices []uint64,
+	usedIndices map[uint64]bool,
+	randGen *rand.Rand,
+) ([]*ethpb.ProposerSlashing, error) {
+	domain := helpers.Domain(bState.Fork(), helpers.CurrentEpoch(bState), params.BeaconConfig().DomainBeaconProposer)
+	proposerSlashings := make([]*ethpb.ProposerSlashing, numSlashings)
+	for i := uint64(0); i < numSlashings; i++ {
+		var proposerIndex uint64
+		if i < uint64(len(indices)) {
+			proposerIndex = indices[i]
+			if proposerIndex >= uint64(len(privs)) {
+				return nil, fmt.Errorf("no private key for requested proposer slashing index %d", proposerIndex)
+			}
+		} else {
+			var err error
+			proposerIndex, err = randValIndex(bState, usedIndices, randGen)
+			if err != nil {
+				return nil, err
+			}
+		}
+		slashing, err := proposerSlashingForValidator(bState, privs[proposerIndex], proposerIndex, domain)
+		if err != nil {
+			return nil, err
+		}
+		proposerSlashings[i] = slashing
+	}
+	return proposerSlashings, nil
+}
+
+// GenerateAttesterSlashingForValidator for a specific validator index, as a double vote.
+func GenerateAttesterSlashingForValidator(
+	bState *stateTrie.BeaconState,
+	priv *bls.SecretKey,
+	idx uint64,
+) (*ethpb.AttesterSlashing, error) {
+	return GenerateTypedAttesterSlashingForValidator(bState, priv, idx, DoubleVote)
+}
+
+// GenerateTypedAttesterSlashingForValidator for a specific validator index, violating the
+// requested Casper FFG rule relative to the current epoch of the state.
+func GenerateTypedAttesterSlashingForValidator(
+	bState *stateTrie.BeaconState,
+	priv *bls.SecretKey,
+	idx uint64,
+	slashingType AttesterSlashingType,
+) (*ethpb.AttesterSlashing, error) {
+	return typedAttesterSlashingForValidator(bState, bState.Fork(), priv, idx, slashingType)
+}
+
+// GenerateSurroundSlashing generates an attester slashing of two attestations by the same
+// validator where the first, from surroundSource to surroundTarget, surrounds the second,
+// from sourceEpoch to targetEpoch. The attester is the first active validator of the
+// current epoch of the state which isn't slashed, and both attestations are signed by it.
+func GenerateSurroundSlashing(
+	bState *stateTrie.BeaconState,
+	privs []*bls.SecretKey,
+	sourceEpoch uint64,
+	targetEpoch uint64,
+	surroundSource uint64,
+	surroundTarget uint64,
+) (*ethpb.AttesterSlashing, error) {
+	if sourceEpoch > targetEpoch || surroundSource > surroundTarget {
+		return nil, errors.New("source epochs must not be after target epochs")
+	}
+	if surroundSource >= sourceEpoch || targetEpoch >= surroundTarget {
+		return nil, fmt.Errorf(
+			"votes from epoch %d to %d do not surround votes from epoch %d to %d",
+			surroundSource, surroundTarget, sourceEpoch, targetEpoch,
+		)
+	}
+	currentEpoch := helpers.CurrentEpoch(bState)
+	var attester uint64
+	found := false
+	for i := 0; i < bState.NumValidators() && i < len(privs); i++ {
+		val, err := bState.ValidatorAtIndexReadOnly(uint64(i))
+		if err != nil {
+			return nil, err
+		}
+		if helpers.IsActiveValidatorUsingTrie(val, currentEpoch) && !val.Slashed() {
+			attester = uint64(i)
+			found = true
+			break
+		}
+	}
+	if !found {
+		return nil, errors.New("no active validator with a private key to attest")
+	}
+
+	fork := bState.Fork()
+	att1, err := signedIndexedAttestation(fork, privs[attester], attester, attesterSlashingData(bState.Slot(), surroundSource, surroundTarget))
+	if err != nil {
+		return nil, err
+	}
+	att2, err := signedIndexedAttestation(fork, privs[attester], attester, attesterSlashingData(bState.Slot(), sourceEpoch, targetEpoch))
+	if err != nil {
+		return nil, err
+	}
+	return &ethpb.AttesterSlashing{
+		Attestation_1: att1,
+		Attestation_2: att2,
+	}, nil
+}
+
+// GenerateOverlappingAttesterSlashing generates a double vote attester slashing whose
+// first attestation is signed by the validators of indices1 and the second by those of
+// indices2, so only the validators in both sets are slashed by it. The attesting indices
+// of each attestation are sorted, as required by indexed attestation verification.
+func GenerateOverlappingAttesterSlashing(
+	bState *stateTrie.BeaconState,
+	privs []*bls.SecretKey,
+	indices1 []uint64,
+	indices2 []uint64,
+) (*ethpb.AttesterSlashing, error) {
+	if len(sliceutil.IntersectionUint64(indices1, indices2)) == 0 {
+		return nil, errors.New("attester indices of the attestations do not overlap")
+	}
+	currentEpoch := helpers.CurrentEpoch(bState)
+	data1 := attesterSlashingData(bState.Slot(), currentEpoch, currentEpoch)
+	data2 := attesterSlashingData(bState.Slot(), currentEpoch, currentEpoch)
+	data2.BeaconBlockRoot = bytesutil.Bytes32(1)
+
+	fork := bState.Fork()
+	att1, err := aggregateIndexedAttestation(fork, privs, indices1, data1)
+	if err != nil {
+		return nil, err
+	}
+	att2, err := aggregateIndexedAttestation(fork, privs, indices2, data2)
+	if err != nil {
+		return nil, err
+	}
+	return &ethpb.AttesterSlashing{
+		Attestation_1: att1,
+		Attestation_2: att2,
+	}, nil
+}
+
+// aggregateIndexedAttestation returns the indexed attestation of the given data signed by
+// all the given validators, with the attesting indices sorted.
+func aggregateIndexedAttestation(
+	fork *pb.Fork,
+	privs []*bls.SecretKey,
+	indices []uint64,
+	data *ethpb.AttestationData,
+) (*ethpb.IndexedAttestation, error) {
+	sorted := make([]uint64, len(indices))
+	copy(sorted, indices)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i] < sorted[j]
+	})
+	for i, idx := range sorted {
+		if idx >= uint64(len(privs)) {
+			return nil, fmt.Errorf("no private key for validator %d", idx)
+		}
+		if i > 0 && sorted[i-1] == idx {
+			return nil, fmt.Errorf("duplicate attester index %d", idx)
+		}
+	}
+	dataRoot, err := ssz.HashTreeRoot(data)
+	if err != nil {
+		return nil, err
+	}
+	domain := helpers.Domain(fork, data.Target.Epoch, params.BeaconConfig().DomainBeaconAttester)
+	sigs, err := signInParallel(privs, sorted, dataRoot[:], domain)
+	if err != nil {
+		return nil, err
+	}
+	return &ethpb.IndexedAttestation{
+		Data:             data,
+		AttestingIndices: sorted,
+		Signature:        bls.AggregateSignatures(sigs).Marshal(),
+	}, nil
+}
+
+// typedAttesterSlashingForValidator is GenerateTypedAttesterSlashingForValidator with the
+// fork of the state fetched by the caller, as the signing domain of each attestation
+// depends on its target epoch.
+func typedAttesterSlashingForValidator(
+	bState *stateTrie.BeaconState,
+	fork *pb.Fork,
+	priv *bls.SecretKey,
+	idx uint64,
+	slashingType AttesterSlashingType,
+) (*ethpb.AttesterSlashing, error) {
+	currentEpoch := helpers.CurrentEpoch(bState)
+	var data1, data2 *ethpb.AttestationData
+	switch slashingType {
+	case DoubleVote:
+		// Two votes for different heads with the same source and target.
+		data1 = attesterSlashingData(bState.Slot(), currentEpoch, currentEpoch)
+		data2 = attesterSlashingData(bState.Slot(), currentEpoch, currentEpoch)
+		data2.BeaconBlockRoot = bytesutil.Bytes32(1)
+	case SurroundVote:
+		// The first vote's source and target epochs surround the second's.
+		data1 = attesterSlashingData(bState.Slot(), currentEpoch, currentEpoch+3)
+		data2 = attesterSlashingData(bState.Slot(), currentEpoch+1, currentEpoch+2)
+	default:
+		return nil, fmt.Errorf("unknown attester slashing type %d", slashingType)
+	}
+
+	att1, err := signedIndexedAttestation(fork, priv, idx, data1)
+	if err != nil {
+		return nil, err
+	}
+	att2, err := signedIndexedAttestation(fork, priv, idx, data2)
+	if err != nil {
+		return nil, err
+	}
+	return &ethpb.AttesterSlashing{
+		Attestation_1: att1,
+		Attestation_2: att2,
+	}, nil
+}
+
+func attesterSlashingData(slot uint64, sourceEpoch uint64, targetEpoch uint64) *ethpb.AttestationData {
+	return &ethpb.AttestationData{
+		Slot:            slot,
+		CommitteeIndex:  0,
+		BeaconBlockRoot: params.BeaconConfig().ZeroHash[:],
+		Source: &ethpb.Checkpoint{
+			Epoch: sourceEpoch,
+			Root:  params.BeaconConfig().ZeroHash[:],
+		},
+		Target: &ethpb.Checkpoint{
+			Epoch: targetEpoch,
+			Root:  params.BeaconConfig().ZeroHash[:],
+		},
+	}
+}
+
+func signedIndexedAttestation(
+	fork *pb.Fork,
+	priv *bls.SecretKey,
+	idx uint64,
+	data *ethpb.AttestationData,
+) (*ethpb.IndexedAttestation, error) {
+	dataRoot, err := ssz.HashTreeRoot(data)
+	if err != nil {
+		return nil, err
+	}
+	domain := helpers.Domain(fork, data.Target.Epoch, params.BeaconConfig().DomainBeaconAttester)
+	sig := priv.Sign(dataRoot[:], domain)
+	return &ethpb.IndexedAttestation{
+		Data:             data,
+		AttestingIndices: []uint64{idx},
+		Signature:        bls.AggregateSignatures([]*bls.Signature{sig}).Marshal(),
+	}, nil
+}
+
+// SlashedValidatorIndices returns the indices of the validators slashed by the proposer
+// slashings and attester slashings of the given block body, in the order they are slashed
+// by block processing, so tests can assert the balance changes of the slashings.
+func SlashedValidatorIndices(body *ethpb.BeaconBlockBody) []uint64 {
+	indices := make([]uint64, 0, len(body.ProposerSlashings)+len(body.AttesterSlashings))
+	for _, slashing := range body.ProposerSlashings {
+		indices = append(indices, slashing.ProposerIndex)
+	}
+	for _, slashing := range body.AttesterSlashings {
+		slashedIndices := sliceutil.IntersectionUint64(
+			slashing.Attestation_1.AttestingIndices,
+			slashing.Attestation_2.AttestingIndices,
+		)
+		sort.Slice(slashedIndices, func(i, j int) bool {
+			return slashedIndices[i] < slashedIndices[j]
+		})
+		indices = append(indices, slashedIndices...)
+	}
+	return indices
+}
+
+// ExpectedBalanceDeltas returns the balance changes that processing the given block makes
+// to the state at the slot of the block, by validator index, so tests can predict the post
+// state balances instead of computing them by hand. It follows the block processing rules:
+//
+//	slashed validators lose their effective balance / MIN_SLASHING_PENALTY_QUOTIENT.
+//	the proposer, as whistleblower, gains effective balance / WHISTLEBLOWER_REWARD_QUOTIENT
+//	of every slashed validator.
+//	deposits credit their amount to their validator, new validators being given the index
+//	they are appended at, unless the deposit of a new validator has an invalid signature.
+//
+// Attestations and voluntary exits don't change balances when the block is processed, the
+// rewards and penalties of attestations are applied by epoch processing. The balances the
+// deltas apply to are those after processing the slots up to the block, which includes
+// epoch processing when the block is in a later epoch than the given state.
+func ExpectedBalanceDeltas(bState *stateTrie.BeaconState, block *ethpb.BeaconBlock) (map[uint64]int64, error) {
+	preState, err := state.ProcessSlots(context.Background(), bState.Copy(), block.Slot)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not process slots up to the block")
+	}
+	proposerIdx, err := helpers.BeaconProposerIndex(preState)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not get beacon proposer index")
+	}
+	currentEpoch := helpers.CurrentEpoch(preState)
+	cfg := params.BeaconConfig()
+
+	deltas := make(map[uint64]int64)
+	slashed := make(map[uint64]bool)
+	slash := func(idx uint64, onlyIfSlashable bool) error {
+		val, err := preState.ValidatorAtIndexReadOnly(idx)
+		if err != nil {
+			return err
+		}
+		slashable := val.ActivationEpoch() <= currentEpoch && currentEpoch < val.WithdrawableEpoch() &&
+			!val.Slashed() && !slashed[idx]
+		if onlyIfSlashable && !slashable {
+			return nil
+		}
+		deltas[idx] -= int64(val.EffectiveBalance() / cfg.MinSlashingPenaltyQuotient)
+		deltas[proposerIdx] += int64(val.EffectiveBalance() / cfg.WhistleBlowerRewardQuotient)
+		slashed[idx] = true
+		return nil
+	}
+	body := block.Body
+	for _, slashing := range body.ProposerSlashings {
+		if err := slash(slashing.ProposerIndex, false); err != nil {
+			return nil, errors.Wrapf(err, "could not get slashed proposer %d", slashing.ProposerIndex)
+		}
+	}
+	for _, slashing := range body.AttesterSlashings {
+		slashedIndices := sliceutil.IntersectionUint64(
+			slashing.Attestation_1.AttestingIndices,
+			slashing.Attestation_2.AttestingIndices,
+		)
+		sort.Slice(slashedIndices, func(i, j int) bool {
+			return slashedIndices[i] < slashedIndices[j]
+		})
+		for _, idx := range slashedIndices {
+			if err := slash(idx, true); err != nil {
+				return nil, errors.Wrapf(err, "could not get slashed attester %d", idx)
+			}
+		}
+	}
+
+	numVals := uint64(preState.NumValidators())
+	newIndices := make(map[[48]byte]uint64)
+	for _, deposit := range body.Deposits {
+		pubKey := bytesutil.ToBytes48(deposit.Data.PublicKey)
+		idx, ok := preState.ValidatorIndexByPubkey(pubKey)
+		if !ok {
+			idx, ok = newIndices[pubKey]
+		}
+		if !ok {
+			if !validDepositSignature(deposit.Data) {
+				continue
+			}
+			idx = numVals
+			numVals++
+			newIndices[pubKey] = idx
+		}
+		deltas[idx] += int64(deposit.Data.Amount)
+	}
+	return deltas, nil
+}
+
+func generateAttesterSlashings(
+	bState *stateTrie.BeaconState,
+	privs []*bls.SecretKey,
+	numSlashings uint64,
+	slashingType AttesterSlashingType,
+	usedIndices map[uint64]bool,
+	randGen *rand.Rand,
+) ([]*ethpb.AttesterSlashing, error) {
+	committees, err := CommitteesAtSlot(bState, bState.Slot())
+	if err != nil {
+		return nil, err
+	}
+	committeeCount := uint64(len(committees))
+	fork := bState.Fork()
+	attesterSlashings := make([]*ethpb.AttesterSlashing, numSlashings)
+	for i := uint64(0); i < numSlashings; i++ {
+		// Start from a random committee of the slot and move on to the next committees
+		// when it has no validator left to slash.
+		startIndex := randGen.Uint64() % committeeCount
+		var valIndex uint64
+		ok := false
+		for c := uint64(0); c < committeeCount && !ok; c++ {
+			valIndex, ok = unusedCommitteeMember(committees[(startIndex+c)%committeeCount], usedIndices, randGen)
+		}
+		if !ok {
+			// Any active validator can be slashed, the committee is only a convenient pick.
+			valIndex, err = randValIndex(bState, usedIndices, randGen)
+			if err != nil {
+				return nil, err
+			}
+		}
+		slashing, err := typedAttesterSlashingForValidator(bState, fork, privs[valIndex], valIndex, slashingType)
+		if err != nil {
+			return nil, err
+		}
+		attesterSlashings[i] = slashing
+	}
+	return attesterSlashings, nil
+}
+
+// GenerateAttestations creates attestations that are entirely valid, for all
+// the committees of the current state slot. This function expects attestations
+// requested to be cleanly divisible by committees per slot. If there is 1 committee
+// in the slot, and numToGen is set to 4, then it will return 4 attestations
+// for the same data with their aggregation bits split uniformly.
+//
+// If you request 4 attestations, but there are 8 committees, you will get 4 fully aggregated attestations.
+func GenerateAttestations(bState *stateTrie.BeaconState, privs []*bls.SecretKey, numToGen uint64, slot uint64, randomRoot bool) ([]*ethpb.Attestation, error) {
+	atts, _, err := generateAttestations(context.Background(), bState, privs, numToGen, slot, randomRoot)
+	return atts, err
+}
+
+// AttestationCheckpoints overrides the source and target checkpoints voted for by generated
+// attestations. A nil checkpoint keeps the checkpoint computed from the state.
+type AttestationCheckpoints struct {
+	Source *ethpb.Checkpoint
+	Target *ethpb.Checkpoint
+}
+
+// GenerateAttestationsWithCheckpoints creates attestations like GenerateAttestations, with
+// their source and target checkpoints replaced by the given ones and signed over the
+// modified data, e.g. to vote for a non-canonical branch in fork choice tests. The
+// attestations only pass ProcessAttestation if the checkpoints match the state.
+func GenerateAttestationsWithCheckpoints(
+	bState *stateTrie.BeaconState,
+	privs []*bls.SecretKey,
+	numToGen uint64,
+	slot uint64,
+	checkpoints *AttestationCheckpoints,
+) ([]*ethpb.Attestation, error) {
+	atts, err := GenerateAttestations(bState, privs, numToGen, slot, false)
+	if err != nil {
+		return nil, err
+	}
+	if checkpoints == nil || (checkpoints.Source == nil && checkpoints.Target == nil) {
+		return atts, nil
+	}
+	for _, att := range atts {
+		if checkpoints.Source != nil {
+			att.Data.Source = proto.Clone(checkpoints.Source).(*ethpb.Checkpoint)
+		}
+		if checkpoints.Target != nil {
+			att.Data.Target = proto.Clone(checkpoints.Target).(*ethpb.Checkpoint)
+		}
+		if err := signAttestation(bState, privs, att); err != nil {
+			return nil, err
+		}
+	}
+	return atts, nil
+}
+
+// AttestationSigner is the contribution of a single committee member to the aggregate
+// signature of a generated attestation.
+type AttestationSigner struct {
+	ValidatorIndex uint64
+	PublicKey      *bls.PublicKey
+	Signature      *bls.Signature
+}
+
+// GenerateAttestationsVerbose creates attestations like GenerateAttestations, and also
+// returns for every attestation the signers aggregated into its signature, in the order of
+// their aggregation bits. This helps isolating the committee member of an attestation
+// with a bad signature.
+func GenerateAttestationsVerbose(
+	bState *stateTrie.BeaconState,
+	privs []*bls.SecretKey,
+	numToGen uint64,
+	slot uint64,
+	randomRoot bool,
+) ([]*ethpb.Attestation, [][]*AttestationSigner, error) {
+	return generateAttestations(context.Background(), bState, privs, numToGen, slot, randomRoot)
+}
+
+func generateAttestations(
+	ctx context.Context,
+	bState *stateTrie.BeaconState,
+	privs []*bls.SecretKey,
+	numToGen uint64,
+	slot uint64,
+	randomRoot bool,
+) ([]*ethpb.Attestation, [][]*AttestationSigner, error) {
+	currentEpoch := helpers.SlotToEpoch(slot)
+	generateHeadState := false
+	bState = bState.Copy()
+	if slot > bState.Slot() {
+		// Going back a slot here so there's no inclusion delay issues.
+		slot--
+		generateHeadState = true
+	}
+
+	targetRoot := make([]byte, 32)
+	headRoot := make([]byte, 32)
+	var err error
+	// Only calculate head state if its an attestation for the current slot or future slot.
+	if generateHeadState || slot == bState.Slot() {
+		headState, err := stateTrie.InitializeFromProtoUnsafe(bState.CloneInnerState())
+		if err != nil {
+			return nil, nil, err
+		}
+		headState, err = state.ProcessSlots(ctx, headState, slot+1)
+		if err != nil {
+			return nil, nil, err
+		}
+		headRoot, err = helpers.BlockRootAtSlot(headState, slot)
+		if err != nil {
+			return nil, nil, err
+		}
+		targetRoot, err = helpers.BlockRoot(headState, currentEpoch)
+		if err != nil {
+			return nil, nil, err
+		}
+	} else {
+		headRoot, err = helpers.BlockRootAtSlot(bState, slot)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	if randomRoot {
+		b := make([]byte, 32)
+		_, err := rand.Read(b)
+		if err != nil {
+			return nil, nil, err
+		}
+		headRoot = b
+	}
+
+	source := bState.CurrentJustifiedCheckpoint()
+	target := &ethpb.Checkpoint{
+		Epoch: currentEpoch,
+		Root:  targetRoot,
+	}
+	return generateAttestationsForData(bState, privs, numToGen, slot, headRoot, source, target)
+}
+
+// generateAttestationsWithOffset creates attestations for the slot offset slots before the
+// block slot, advancing a copy of the state through that slot if it has not processed it yet.
+func generateAttestationsWithOffset(
+	ctx context.Context,
+	bState *stateTrie.BeaconState,
+	privs []*bls.SecretKey,
+	numToGen uint64,
+	blockSlot uint64,
+	offset uint64,
+) ([]*ethpb.Attestation, error) {
+	if offset > params.BeaconConfig().SlotsPerEpoch {
+		return nil, fmt.Errorf(
+			"attestation slot offset %d exceeds the inclusion range of %d slots",
+			offset,
+			params.BeaconConfig().SlotsPerEpoch,
+		)
+	}
+	if offset > blockSlot {
+		return nil, fmt.Errorf("attestation slot offset %d is larger than block slot %d", offset, blockSlot)
+	}
+	attSlot := blockSlot - offset
+	if attSlot >= bState.Slot() {
+		var err error
+		bState, err = state.ProcessSlots(ctx, bState.Copy(), attSlot+1)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return GenerateAttestationsForSlot(bState, privs, numToGen, attSlot)
+}
+
+// GenerateAttestationsForSlot creates attestations that are entirely valid for all
+// the committees of a slot that has already been processed by the given state, using
+// the block roots recorded in the state. The slot must be in the current or previous
+// epoch of the state. Attestations targeting the current epoch use the current justified
+// checkpoint as source, while attestations targeting the previous epoch use the previous
+// justified checkpoint, matching what ProcessAttestation expects.
+func GenerateAttestationsForSlot(
+	bState *stateTrie.BeaconState,
+	privs []*bls.SecretKey,
+	numToGen uint64,
+	slot uint64,
+) ([]*ethpb.Attestation, error) {
+	data, err := processedSlotAttestationData(bState, slot, 0)
+	if err != nil {
+		return nil, err
+	}
+	atts, _, err := generateAttestationsForData(bState, privs, numToGen, slot, data.BeaconBlockRoot, data.Source, data.Target)
+	return atts, err
+}
+
+// GenerateAttestation creates a single valid attestation for the given committee of a slot
+// that has already been processed by the given state, like GenerateAttestationsForSlot.
+// Only the committee members at the given positions in the committee participate, so their
+// bits are set in the aggregation bits and their signatures are aggregated.
+func GenerateAttestation(
+	bState *stateTrie.BeaconState,
+	privs []*bls.SecretKey,
+	slot uint64,
+	committeeIndex uint64,
+	participants []uint64,
+) (*ethpb.Attestation, error) {
+	if len(participants) == 0 {
+		return nil, errors.New("attestation needs at least one participant")
+	}
+	activeCount, err := helpers.ActiveValidatorCount(bState, helpers.SlotToEpoch(slot))
+	if err != nil {
+		return nil, err
+	}
+	committeeCount := helpers.SlotCommitteeCount(activeCount)
+	if committeeIndex >= committeeCount {
+		return nil, fmt.Errorf("committee index %d is out of range of %d committees at slot %d", committeeIndex, committeeCount, slot)
+	}
+	data, err := processedSlotAttestationData(bState, slot, committeeIndex)
+	if err != nil {
+		return nil, err
+	}
+	committee, err := helpers.BeaconCommitteeFromState(bState, slot, committeeIndex)
+	if err != nil {
+		return nil, err
+	}
+
+	aggregationBits := bitfield.NewBitlist(uint64(len(committee)))
+	for _, position := range participants {
+		if position >= uint64(len(committee)) {
+			return nil, fmt.Errorf("participant position %d is out of range of committee of size %d", position, len(committee))
+		}
+		aggregationBits.SetBitAt(position, true)
+	}
+	att := &ethpb.Attestation{
+		Data:            data,
+		AggregationBits: aggregationBits,
+	}
+	if err := signAttestation(bState, privs, att); err != nil {
+		return nil, err
+	}
+	return att, nil
+}
+
+// GenerateAttestationWithBits is GenerateAttestation with the participants given as the
+// aggregation bits of the attestation, e.g. to reproduce the bits of an observed aggregate.
+// The bitlist must have the length of the committee.
+func GenerateAttestationWithBits(
+	bState *stateTrie.BeaconState,
+	privs []*bls.SecretKey,
+	slot uint64,
+	committeeIndex uint64,
+	bits bitfield.Bitlist,
+) (*ethpb.Attestation, error) {
+	var participants []uint64
+	for i := uint64(0); i < bits.Len(); i++ {
+		if bits.BitAt(i) {
+			participants = append(participants, i)
+		}
+	}
+	att, err := GenerateAttestation(bState, privs, slot, committeeIndex, participants)
+	if err != nil {
+		return nil, err
+	}
+	if att.AggregationBits.Len() != bits.Len() {
+		return nil, fmt.Errorf("aggregation bits of length %d do not match committee of size %d", bits.Len(), att.AggregationBits.Len())
+	}
+	return att, nil
+}
+
+// GenerateAggregateAndProof creates the aggregate and proof of an aggregator of the given
+// committee of a slot that has already been processed by the given state. The aggregate is
+// the attestation of the whole committee, like GenerateAttestation, and the aggregator is
+// the first member of the committee whose selection proof, its signature of the slot,
+// selects it as an aggregator.
+//
+// The proto and config versions of this tree define neither SignedAggregateAttestationAndProof
+// nor DomainAggregateAndProof, so the aggregate and proof is returned unsigned.
+func GenerateAggregateAndProof(
+	bState *stateTrie.BeaconState,
+	privs []*bls.SecretKey,
+	slot uint64,
+	committeeIndex uint64,
+) (*ethpb.AggregateAttestationAndProof, error) {
+	committee, err := helpers.BeaconCommitteeFromState(bState, slot, committeeIndex)
+	if err != nil {
+		return nil, err
+	}
+	participants := make([]uint64, len(committee))
+	for i := range participants {
+		participants[i] = uint64(i)
+	}
+	aggregate, err := GenerateAttestation(bState, privs, slot, committeeIndex, participants)
+	if err != nil {
+		return nil, err
+	}
+
+	slotRoot, err := ssz.HashTreeRoot(slot)
+	if err != nil {
+		return nil, err
+	}
+	domain := helpers.Domain(bState.Fork(), helpers.SlotToEpoch(slot), params.BeaconConfig().DomainBeaconAttester)
+	for _, idx := range committee {
+		selectionProof := privs[idx].Sign(slotRoot[:], domain).Marshal()
+		isAggregator, err := helpers.IsAggregator(uint64(len(committee)), selectionProof)
+		if err != nil {
+			return nil, err
+		}
+		if isAggregator {
+			return &ethpb.AggregateAttestationAndProof{
+				AggregatorIndex: idx,
+				Aggregate:       aggregate,
+				SelectionProof:  selectionProof,
+			}, nil
+		}
+	}
+	return nil, fmt.Errorf("no aggregator in committee %d of slot %d", committeeIndex, slot)
+}
 
-	header2 := &ethpb.SignedBeaconBlockHeader{
-		Header: &ethpb.BeaconBlockHeader{
-			Slot:     bState.Slot(),
-			BodyRoot: []byte{0, 2, 0},
-		},
+// GenerateIndexedAttestation creates a valid indexed attestation of the full given committee
+// for a slot that has already been processed by the given state, e.g. for testing indexed
+// attestation verification directly.
+func GenerateIndexedAttestation(
+	bState *stateTrie.BeaconState,
+	privs []*bls.SecretKey,
+	slot uint64,
+	committeeIndex uint64,
+) (*ethpb.IndexedAttestation, error) {
+	committee, err := helpers.BeaconCommitteeFromState(bState, slot, committeeIndex)
+	if err != nil {
+		return nil, err
 	}
-	root, err = ssz.HashTreeRoot(header2.Header)
+	participants := make([]uint64, len(committee))
+	for i := range participants {
+		participants[i] = uint64(i)
+	}
+	att, err := GenerateAttestation(bState, privs, slot, committeeIndex, participants)
 	if err != nil {
 		return nil, err
 	}
-	header2.Signature = priv.Sign(root[:], domain).Marshal()
-
-	return &ethpb.ProposerSlashing{
-		ProposerIndex: idx,
-		Header_1:      header1,
-		Header_2:      header2,
-	}, nil
+	return attestationutil.ConvertToIndexed(context.Background(), att, committee)
 }
 
-func generateProposerSlashings(
-	bState *stateTrie.BeaconState,
-	privs []*bls.SecretKey,
-	numSlashings uint64,
-) ([]*ethpb.ProposerSlashing, error) {
-	proposerSlashings := make([]*ethpb.ProposerSlashing, numSlashings)
-	for i := uint64(0); i < numSlashings; i++ {
-		proposerIndex, err := randValIndex(bState)
-		if err != nil {
-			return nil, err
+// AggregateAttestations combines attestations over the same attestation data into a single
+// aggregate, the way an aggregator would, by merging their aggregation bits and aggregating
+// their signatures. It fails if the data differs or any two attestations share a bit.
+func AggregateAttestations(atts []*ethpb.Attestation) (*ethpb.Attestation, error) {
+	if len(atts) == 0 {
+		return nil, errors.New("no attestations to aggregate")
+	}
+	aggregationBits := append(bitfield.Bitlist{}, atts[0].AggregationBits...)
+	sigs := make([]*bls.Signature, len(atts))
+	for i, att := range atts {
+		if !proto.Equal(att.Data, atts[0].Data) {
+			return nil, fmt.Errorf("attestation %d has different data than attestation 0", i)
+		}
+		if i > 0 {
+			if att.AggregationBits.Len() != aggregationBits.Len() {
+				return nil, errors.Wrapf(helpers.ErrAttestationAggregationBitsDifferentLen, "attestation %d", i)
+			}
+			if att.AggregationBits.Overlaps(aggregationBits) {
+				return nil, errors.Wrapf(helpers.ErrAttestationAggregationBitsOverlap, "attestation %d", i)
+			}
+			aggregationBits = aggregationBits.Or(att.AggregationBits)
 		}
-		slashing, err := GenerateProposerSlashingForValidator(bState, privs[proposerIndex], proposerIndex)
+		sig, err := bls.SignatureFromBytes(att.Signature)
 		if err != nil {
-			return nil, err
+			return nil, errors.Wrapf(err, "could not deserialize signature of attestation %d", i)
 		}
-		proposerSlashings[i] = slashing
+		sigs[i] = sig
 	}
-	return proposerSlashings, nil
+	return &ethpb.Attestation{
+		Data:            proto.Clone(atts[0].Data).(*ethpb.AttestationData),
+		AggregationBits: aggregationBits,
+		Signature:       bls.AggregateSignatures(sigs).Marshal(),
+	}, nil
 }
 
-// GenerateAttesterSlashingForValidator for a specific validator index.
-func GenerateAttesterSlashingForValidator(
+// processedSlotAttestationData returns the attestation data voting for the block roots
+// recorded in the state for a slot that has already been processed by the state. The
+// slot must be in the current or previous epoch of the state.
+func processedSlotAttestationData(
 	bState *stateTrie.BeaconState,
-	priv *bls.SecretKey,
-	idx uint64,
-) (*ethpb.AttesterSlashing, error) {
+	slot uint64,
+	committeeIndex uint64,
+) (*ethpb.AttestationData, error) {
+	if slot >= bState.Slot() {
+		return nil, fmt.Errorf("attestation slot %d must be before state slot %d", slot, bState.Slot())
+	}
+	targetEpoch := helpers.SlotToEpoch(slot)
 	currentEpoch := helpers.CurrentEpoch(bState)
-
-	att1 := &ethpb.IndexedAttestation{
-		Data: &ethpb.AttestationData{
-			Slot:           bState.Slot(),
-			CommitteeIndex: 0,
-			Target: &ethpb.Checkpoint{
-				Epoch: currentEpoch,
-				Root:  params.BeaconConfig().ZeroHash[:],
-			},
-			Source: &ethpb.Checkpoint{
-				Epoch: currentEpoch + 1,
-				Root:  params.BeaconConfig().ZeroHash[:],
-			},
-		},
-		AttestingIndices: []uint64{idx},
+	if targetEpoch != currentEpoch && targetEpoch != helpers.PrevEpoch(bState) {
+		return nil, fmt.Errorf(
+			"attestation epoch %d must be the current epoch %d or the previous epoch %d",
+			targetEpoch,
+			currentEpoch,
+			helpers.PrevEpoch(bState),
+		)
 	}
-	dataRoot, err := ssz.HashTreeRoot(att1.Data)
+
+	headRoot, err := helpers.BlockRootAtSlot(bState, slot)
 	if err != nil {
 		return nil, err
 	}
-	domain := helpers.Domain(bState.Fork(), currentEpoch, params.BeaconConfig().DomainBeaconAttester)
-	sig := priv.Sign(dataRoot[:], domain)
-	att1.Signature = bls.AggregateSignatures([]*bls.Signature{sig}).Marshal()
-
-	att2 := &ethpb.IndexedAttestation{
-		Data: &ethpb.AttestationData{
-			Slot:           bState.Slot(),
-			CommitteeIndex: 0,
-			Target: &ethpb.Checkpoint{
-				Epoch: currentEpoch,
-				Root:  params.BeaconConfig().ZeroHash[:],
-			},
-			Source: &ethpb.Checkpoint{
-				Epoch: currentEpoch,
-				Root:  params.BeaconConfig().ZeroHash[:],
-			},
-		},
-		AttestingIndices: []uint64{idx},
-	}
-	dataRoot, err = ssz.HashTreeRoot(att2.Data)
+	targetRoot, err := helpers.BlockRoot(bState, targetEpoch)
 	if err != nil {
 		return nil, err
 	}
-	sig = priv.Sign(dataRoot[:], domain)
-	att2.Signature = bls.AggregateSignatures([]*bls.Signature{sig}).Marshal()
-
-	return &ethpb.AttesterSlashing{
-		Attestation_1: att1,
-		Attestation_2: att2,
+	source := bState.CurrentJustifiedCheckpoint()
+	if targetEpoch < currentEpoch {
+		source = bState.PreviousJustifiedCheckpoint()
+	}
+	return &ethpb.AttestationData{
+		Slot:            slot,
+		CommitteeIndex:  committeeIndex,
+		BeaconBlockRoot: headRoot,
+		Source:          source,
+		Target: &ethpb.Checkpoint{
+			Epoch: targetEpoch,
+			Root:  targetRoot,
+		},
 	}, nil
 }
 
-func generateAttesterSlashings(
+// GenerateAttestationsWithInclusionDistances creates valid attestations meant to be included
+// in a block at inclusionSlot, spread over every inclusion distance from
+// MIN_ATTESTATION_INCLUSION_DELAY up to maxDistance. numPerSlot attestations are generated
+// for each distance. Alongside the attestations, the intended inclusion distance of each
+// attestation is returned so rewards scaling with the inclusion delay can be asserted.
+func GenerateAttestationsWithInclusionDistances(
 	bState *stateTrie.BeaconState,
 	privs []*bls.SecretKey,
-	numSlashings uint64,
-) ([]*ethpb.AttesterSlashing, error) {
-	attesterSlashings := make([]*ethpb.AttesterSlashing, numSlashings)
-	for i := uint64(0); i < numSlashings; i++ {
-		committeeIndex := rand.Uint64() % params.BeaconConfig().MaxCommitteesPerSlot
-		committee, err := helpers.BeaconCommitteeFromState(bState, bState.Slot(), committeeIndex)
+	numPerSlot uint64,
+	inclusionSlot uint64,
+	maxDistance uint64,
+) ([]*ethpb.Attestation, []uint64, error) {
+	if maxDistance > params.BeaconConfig().SlotsPerEpoch {
+		return nil, nil, fmt.Errorf(
+			"max inclusion distance %d exceeds the inclusion window of %d slots",
+			maxDistance,
+			params.BeaconConfig().SlotsPerEpoch,
+		)
+	}
+	if maxDistance > inclusionSlot {
+		return nil, nil, fmt.Errorf("max inclusion distance %d reaches before genesis from slot %d", maxDistance, inclusionSlot)
+	}
+	headState := bState.Copy()
+	if headState.Slot() < inclusionSlot {
+		var err error
+		headState, err = state.ProcessSlots(context.Background(), headState, inclusionSlot)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
-		randIndex := rand.Uint64() % uint64(len(committee))
-		valIndex := committee[randIndex]
-		slashing, err := GenerateAttesterSlashingForValidator(bState, privs[valIndex], valIndex)
+	}
+
+	attestations := []*ethpb.Attestation{}
+	distances := []uint64{}
+	for d := params.BeaconConfig().MinAttestationInclusionDelay; d <= maxDistance; d++ {
+		atts, err := GenerateAttestationsForSlot(headState, privs, numPerSlot, inclusionSlot-d)
 		if err != nil {
-			return nil, err
+			return nil, nil, errors.Wrapf(err, "could not generate attestations with inclusion distance %d", d)
 		}
-		attesterSlashings[i] = slashing
+		for range atts {
+			distances = append(distances, d)
+		}
+		attestations = append(attestations, atts...)
 	}
-	return attesterSlashings, nil
+	return attestations, distances, nil
 }
 
-// GenerateAttestations creates attestations that are entirely valid, for all
-// the committees of the current state slot. This function expects attestations
-// requested to be cleanly divisible by committees per slot. If there is 1 committee
-// in the slot, and numToGen is set to 4, then it will return 4 attestations
-// for the same data with their aggregation bits split uniformly.
-//
-// If you request 4 attestations, but there are 8 committees, you will get 4 fully aggregated attestations.
-func GenerateAttestations(bState *stateTrie.BeaconState, privs []*bls.SecretKey, numToGen uint64, slot uint64, randomRoot bool) ([]*ethpb.Attestation, error) {
-	currentEpoch := helpers.SlotToEpoch(slot)
-	attestations := []*ethpb.Attestation{}
-	generateHeadState := false
-	bState = bState.Copy()
-	if slot > bState.Slot() {
-		// Going back a slot here so there's no inclusion delay issues.
-		slot--
-		generateHeadState = true
+// GenerateExpiredAttestations creates attestations like GenerateAttestationsForSlot for the
+// most recent slot which is too old for its attestations to be included in a block at
+// inclusionSlot, SLOTS_PER_EPOCH + 1 slots before it. The attestations are well-formed and
+// correctly signed, only their inclusion window has passed, so they can be mixed with valid
+// attestations to test the inclusion window check. The expired slot must be in the epoch
+// before the epoch of inclusionSlot, so inclusionSlot can't be the first slot of an epoch.
+func GenerateExpiredAttestations(
+	bState *stateTrie.BeaconState,
+	privs []*bls.SecretKey,
+	numToGen uint64,
+	inclusionSlot uint64,
+) ([]*ethpb.Attestation, error) {
+	slotsPerEpoch := params.BeaconConfig().SlotsPerEpoch
+	if inclusionSlot <= slotsPerEpoch || inclusionSlot%slotsPerEpoch == 0 {
+		return nil, fmt.Errorf("no expired slot in the previous epoch of inclusion slot %d", inclusionSlot)
 	}
-
-	targetRoot := make([]byte, 32)
-	headRoot := make([]byte, 32)
-	var err error
-	// Only calculate head state if its an attestation for the current slot or future slot.
-	if generateHeadState || slot == bState.Slot() {
-		headState, err := stateTrie.InitializeFromProtoUnsafe(bState.CloneInnerState())
+	headState := bState.Copy()
+	if headState.Slot() < inclusionSlot {
+		var err error
+		headState, err = state.ProcessSlots(context.Background(), headState, inclusionSlot)
 		if err != nil {
 			return nil, err
 		}
-		headState, err = state.ProcessSlots(context.Background(), headState, slot+1)
+	}
+	return GenerateAttestationsForSlot(headState, privs, numToGen, inclusionSlot-slotsPerEpoch-1)
+}
+
+// StreamAttestations generates one fully aggregated attestation per committee for each of
+// the given slots, slot by slot, and invokes fn with every attestation as soon as it is
+// generated. Unlike the other attestation generators it never holds more than one slot's
+// worth of attestations, so large fixtures such as attestation pools can be seeded with
+// bounded memory. The slots have the same requirements as in GenerateAttestationsForSlot.
+func StreamAttestations(
+	bState *stateTrie.BeaconState,
+	privs []*bls.SecretKey,
+	slots []uint64,
+	fn func(*ethpb.Attestation),
+) error {
+	for _, slot := range slots {
+		activeCount, err := helpers.ActiveValidatorCount(bState, helpers.SlotToEpoch(slot))
 		if err != nil {
-			return nil, err
+			return err
 		}
-		headRoot, err = helpers.BlockRootAtSlot(headState, slot)
+		atts, err := GenerateAttestationsForSlot(bState, privs, helpers.SlotCommitteeCount(activeCount), slot)
 		if err != nil {
-			return nil, err
+			return errors.Wrapf(err, "could not generate attestations for slot %d", slot)
 		}
-		targetRoot, err = helpers.BlockRoot(headState, currentEpoch)
+		for _, att := range atts {
+			fn(att)
+		}
+	}
+	return nil
+}
+
+// GenerateDistinctAttestations creates MAX_ATTESTATIONS valid attestations for a block at
+// the given slot, no two of which share the same attestation data. Every committee of every
+// slot within the inclusion window of the block is attested to fully, first voting for the
+// head recorded in the state and then for made up head roots, until the block is full.
+func GenerateDistinctAttestations(
+	bState *stateTrie.BeaconState,
+	privs []*bls.SecretKey,
+	slot uint64,
+) ([]*ethpb.Attestation, error) {
+	if slot <= bState.Slot() {
+		return nil, fmt.Errorf("block slot %d must be after state slot %d", slot, bState.Slot())
+	}
+	headState, err := state.ProcessSlots(context.Background(), bState.Copy(), slot)
+	if err != nil {
+		return nil, err
+	}
+	lowestSlot := uint64(0)
+	if slot > params.BeaconConfig().SlotsPerEpoch {
+		lowestSlot = slot - params.BeaconConfig().SlotsPerEpoch
+	}
+	if lowestSlot < helpers.StartSlot(helpers.PrevEpoch(headState)) {
+		lowestSlot = helpers.StartSlot(helpers.PrevEpoch(headState))
+	}
+	baseAtts := []*ethpb.Attestation{}
+	for s := lowestSlot; s+params.BeaconConfig().MinAttestationInclusionDelay <= slot; s++ {
+		activeCount, err := helpers.ActiveValidatorCount(headState, helpers.SlotToEpoch(s))
 		if err != nil {
 			return nil, err
 		}
-	} else {
-		headRoot, err = helpers.BlockRootAtSlot(bState, slot)
+		atts, err := GenerateAttestationsForSlot(headState, privs, helpers.SlotCommitteeCount(activeCount), s)
 		if err != nil {
-			return nil, err
+			return nil, errors.Wrapf(err, "could not generate attestations for slot %d", s)
 		}
+		baseAtts = append(baseAtts, atts...)
 	}
-	if randomRoot {
-		b := make([]byte, 32)
-		_, err := rand.Read(b)
-		if err != nil {
-			return nil, err
+	if len(baseAtts) == 0 {
+		return nil, fmt.Errorf("no slot can be attested to in a block at slot %d", slot)
+	}
+
+	maxAtts := params.BeaconConfig().MaxAttestations
+	attestations := make([]*ethpb.Attestation, 0, maxAtts)
+	for round := uint64(0); uint64(len(attestations)) < maxAtts; round++ {
+		for _, base := range baseAtts {
+			if uint64(len(attestations)) == maxAtts {
+				break
+			}
+			if round == 0 {
+				attestations = append(attestations, base)
+				continue
+			}
+			att := proto.Clone(base).(*ethpb.Attestation)
+			att.Data.BeaconBlockRoot = bytesutil.Bytes32(round)
+			if err := signAttestation(headState, privs, att); err != nil {
+				return nil, err
+			}
+			attestations = append(attestations, att)
 		}
-		headRoot = b
 	}
+	return attestations, nil
+}
 
-	activeValidatorCount, err := helpers.ActiveValidatorCount(bState, currentEpoch)
+func generateAttestationsForData(
+	bState *stateTrie.BeaconState,
+	privs []*bls.SecretKey,
+	numToGen uint64,
+	slot uint64,
+	headRoot []byte,
+	source *ethpb.Checkpoint,
+	target *ethpb.Checkpoint,
+) ([]*ethpb.Attestation, [][]*AttestationSigner, error) {
+	committees, err := CommitteesAtSlot(bState, slot)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	committeesPerSlot := helpers.SlotCommitteeCount(activeValidatorCount)
+	committeesPerSlot := uint64(len(committees))
 
 	if numToGen < committeesPerSlot {
 		log.Printf(
@@ -369,54 +2145,57 @@ func GenerateAttestations(bState *stateTrie.BeaconState, privs []*bls.SecretKey,
 		)
 	}
 
-	attsPerCommittee := math.Max(float64(numToGen/committeesPerSlot), 1)
-	if math.Trunc(attsPerCommittee) != attsPerCommittee {
-		return nil, fmt.Errorf(
-			"requested attestations %d must be easily divisible by committees in slot %d, calculated %f",
+	if numToGen > committeesPerSlot && numToGen%committeesPerSlot != 0 {
+		return nil, nil, fmt.Errorf(
+			"requested attestations %d must be easily divisible by committees in slot %d",
 			numToGen,
 			committeesPerSlot,
-			attsPerCommittee,
 		)
 	}
+	attsPerCommittee := uint64(1)
+	if numToGen > committeesPerSlot {
+		attsPerCommittee = numToGen / committeesPerSlot
+	}
 
-	domain := helpers.Domain(bState.Fork(), currentEpoch, params.BeaconConfig().DomainBeaconAttester)
-	fmt.Printf("Justified: %d\n", bState.CurrentJustifiedCheckpoint().Epoch)
+	attestations := make([]*ethpb.Attestation, 0, committeesPerSlot*attsPerCommittee)
+	signers := make([][]*AttestationSigner, 0, committeesPerSlot*attsPerCommittee)
+	domain := helpers.Domain(bState.Fork(), target.Epoch, params.BeaconConfig().DomainBeaconAttester)
 	for c := uint64(0); c < committeesPerSlot && c < numToGen; c++ {
-		committee, err := helpers.BeaconCommitteeFromState(bState, slot, c)
-		if err != nil {
-			return nil, err
-		}
-
+		committee := committees[c]
 		attData := &ethpb.AttestationData{
 			Slot:            slot,
 			CommitteeIndex:  c,
 			BeaconBlockRoot: headRoot,
-			Source:          bState.CurrentJustifiedCheckpoint(),
-			Target: &ethpb.Checkpoint{
-				Epoch: currentEpoch,
-				Root:  targetRoot,
-			},
+			Source:          source,
+			Target:          target,
 		}
 
 		dataRoot, err := ssz.HashTreeRoot(attData)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 
 		committeeSize := uint64(len(committee))
-		bitsPerAtt := committeeSize / uint64(attsPerCommittee)
-		for i := uint64(0); i < committeeSize; i += bitsPerAtt {
-			aggregationBits := bitfield.NewBitlist(committeeSize)
-			sigs := []*bls.Signature{}
-			for b := i; b < i+bitsPerAtt; b++ {
-				aggregationBits.SetBitAt(b, true)
-				sigs = append(sigs, privs[committee[b]].Sign(dataRoot[:], domain))
+		bitsPerAtt := committeeSize / attsPerCommittee
+		for a := uint64(0); a < attsPerCommittee; a++ {
+			start := a * bitsPerAtt
+			end := start + bitsPerAtt
+			// The last attestation of the committee takes the remaining validators.
+			if a == attsPerCommittee-1 {
+				end = committeeSize
 			}
-
 			// bls.AggregateSignatures will return nil if sigs is 0.
-			if len(sigs) == 0 {
+			if start == end {
 				continue
 			}
+			aggregationBits := bitfield.NewBitlist(committeeSize)
+			for b := start; b < end; b++ {
+				aggregationBits.SetBitAt(b, true)
+			}
+			sigs, err := signInParallel(privs, committee[start:end], dataRoot[:], domain)
+			if err != nil {
+				return nil, nil, err
+			}
 
 			att := &ethpb.Attestation{
 				Data:            attData,
@@ -424,65 +2203,313 @@ func GenerateAttestations(bState *stateTrie.BeaconState, privs []*bls.SecretKey,
 				Signature:       bls.AggregateSignatures(sigs).Marshal(),
 			}
 			attestations = append(attestations, att)
+
+			attSigners := make([]*AttestationSigner, len(sigs))
+			for i, sig := range sigs {
+				valIndex := committee[start+uint64(i)]
+				attSigners[i] = &AttestationSigner{
+					ValidatorIndex: valIndex,
+					PublicKey:      privs[valIndex].PublicKey(),
+					Signature:      sig,
+				}
+			}
+			signers = append(signers, attSigners)
 		}
 	}
-	return attestations, nil
+	return attestations, signers, nil
+}
+
+// setAttestationTargetToHead replaces the target root of the given attestations with
+// their head block root and re-signs them over the modified data.
+func setAttestationTargetToHead(bState *stateTrie.BeaconState, privs []*bls.SecretKey, atts []*ethpb.Attestation) error {
+	for _, att := range atts {
+		if bytes.Equal(att.Data.BeaconBlockRoot, att.Data.Target.Root) {
+			return fmt.Errorf("attested block at slot %d is the epoch boundary block", att.Data.Slot)
+		}
+		att.Data = proto.Clone(att.Data).(*ethpb.AttestationData)
+		att.Data.Target.Root = att.Data.BeaconBlockRoot
+
+		if err := signAttestation(bState, privs, att); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// signAttestation sets the signature of the given attestation to the aggregate signature
+// of its attesting validators over its data.
+func signAttestation(bState *stateTrie.BeaconState, privs []*bls.SecretKey, att *ethpb.Attestation) error {
+	committee, err := helpers.BeaconCommitteeFromState(bState, att.Data.Slot, att.Data.CommitteeIndex)
+	if err != nil {
+		return err
+	}
+	indices, err := attestationutil.AttestingIndices(att.AggregationBits, committee)
+	if err != nil {
+		return err
+	}
+	dataRoot, err := ssz.HashTreeRoot(att.Data)
+	if err != nil {
+		return err
+	}
+	domain := helpers.Domain(bState.Fork(), att.Data.Target.Epoch, params.BeaconConfig().DomainBeaconAttester)
+	sigs, err := signInParallel(privs, indices, dataRoot[:], domain)
+	if err != nil {
+		return err
+	}
+	att.Signature = bls.AggregateSignatures(sigs).Marshal()
+	return nil
+}
+
+// signInParallel signs the message with the keys of the given validators, spreading the
+// signing across GOMAXPROCS workers. The signatures are returned in the order of indices.
+func signInParallel(privs []*bls.SecretKey, indices []uint64, msg []byte, domain uint64) ([]*bls.Signature, error) {
+	sigs := make([]*bls.Signature, len(indices))
+	if len(indices) == 0 {
+		return sigs, nil
+	}
+	if _, err := mputil.Scatter(len(indices), func(offset int, entries int, _ *sync.RWMutex) (interface{}, error) {
+		for i := offset; i < offset+entries; i++ {
+			sigs[i] = privs[indices[i]].Sign(msg, domain)
+		}
+		return nil, nil
+	}); err != nil {
+		return nil, errors.Wrap(err, "could not sign in parallel")
+	}
+	return sigs, nil
 }
 
 func generateDepositsAndEth1Data(
 	bState *stateTrie.BeaconState,
+	privs []*bls.SecretKey,
 	numDeposits uint64,
+	credentials [][]byte,
+	numTopUps uint64,
+	randGen *rand.Rand,
 ) (
 	[]*ethpb.Deposit,
 	*ethpb.Eth1Data,
 	error,
 ) {
 	previousDepsLen := bState.Eth1DepositIndex()
-	currentDeposits, _, err := DeterministicDepositsAndKeys(previousDepsLen + numDeposits)
+	if numTopUps == 0 && len(credentials) == 0 {
+		deposits, eth1Data, err := DeterministicDepositsFrom(previousDepsLen, numDeposits)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "could not get deposits")
+		}
+		return deposits, eth1Data, nil
+	}
+
+	depositDatas, err := deterministicDepositData(previousDepsLen, numDeposits, credentials)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "could not get deposit data")
+	}
+	for i := uint64(0); i < numTopUps; i++ {
+		valIndex := randGen.Uint64() % uint64(bState.NumValidators())
+		val, err := bState.ValidatorAtIndexReadOnly(valIndex)
+		if err != nil {
+			return nil, nil, err
+		}
+		pubKey := val.PublicKey()
+		depositData := &ethpb.Deposit_Data{
+			PublicKey:             pubKey[:],
+			WithdrawalCredentials: val.WithdrawalCredentials(),
+			Amount:                params.BeaconConfig().MaxEffectiveBalance,
+		}
+		if err := signDepositData(depositData, privs[valIndex]); err != nil {
+			return nil, nil, err
+		}
+		depositDatas = append(depositDatas, depositData)
+	}
+	return depositsFollowingDeterministic(previousDepsLen, depositDatas)
+}
+
+// GenerateVoluntaryExitForValidator for a specific validator index.
+func GenerateVoluntaryExitForValidator(
+	bState *stateTrie.BeaconState,
+	priv *bls.SecretKey,
+	idx uint64,
+) (*ethpb.SignedVoluntaryExit, error) {
+	epoch := helpers.PrevEpoch(bState)
+	domain := helpers.Domain(bState.Fork(), epoch, params.BeaconConfig().DomainVoluntaryExit)
+	return voluntaryExitForValidator(epoch, priv, idx, domain)
+}
+
+// GenerateValidatorExitWithWithdrawal generates a voluntary exit of the validator at the
+// given index and processes it on a copy of the state, which is returned with the validator
+// queued for exit. Its exit epoch and withdrawable epoch are set by the exit queue of the
+// state, as by block processing, so exits generated in turn on the returned state are
+// queued in order.
+func GenerateValidatorExitWithWithdrawal(
+	bState *stateTrie.BeaconState,
+	priv *bls.SecretKey,
+	idx uint64,
+) (*ethpb.SignedVoluntaryExit, *stateTrie.BeaconState, error) {
+	exit, err := GenerateVoluntaryExitForValidator(bState, priv, idx)
 	if err != nil {
-		return nil, nil, errors.Wrap(err, "could not get deposits")
+		return nil, nil, err
+	}
+	body := &ethpb.BeaconBlockBody{VoluntaryExits: []*ethpb.SignedVoluntaryExit{exit}}
+	postState, err := blocks.ProcessVoluntaryExits(context.Background(), bState.Copy(), body)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "could not process exit of validator %d", idx)
+	}
+	return exit, postState, nil
+}
+
+// voluntaryExitForValidator signs an exit of the validator at the given epoch with the
+// voluntary exit domain of that epoch precomputed by the caller.
+func voluntaryExitForValidator(
+	epoch uint64,
+	priv *bls.SecretKey,
+	idx uint64,
+	domain uint64,
+) (*ethpb.SignedVoluntaryExit, error) {
+	exit := &ethpb.SignedVoluntaryExit{
+		Exit: &ethpb.VoluntaryExit{
+			Epoch:          epoch,
+			ValidatorIndex: idx,
+		},
 	}
-	eth1Data, err := DeterministicEth1Data(len(currentDeposits))
+	root, err := ssz.HashTreeRoot(exit.Exit)
 	if err != nil {
-		return nil, nil, errors.Wrap(err, "could not get eth1data")
+		return nil, err
 	}
-	return currentDeposits[previousDepsLen:], eth1Data, nil
+	exit.Signature = priv.Sign(root[:], domain).Marshal()
+	return exit, nil
 }
 
 func generateVoluntaryExits(
 	bState *stateTrie.BeaconState,
 	privs []*bls.SecretKey,
 	numExits uint64,
+	indices []uint64,
+	usedIndices map[uint64]bool,
+	randGen *rand.Rand,
 ) ([]*ethpb.SignedVoluntaryExit, error) {
+	epoch := helpers.PrevEpoch(bState)
+	domain := helpers.Domain(bState.Fork(), epoch, params.BeaconConfig().DomainVoluntaryExit)
 	currentEpoch := helpers.CurrentEpoch(bState)
-
 	voluntaryExits := make([]*ethpb.SignedVoluntaryExit, numExits)
 	for i := 0; i < len(voluntaryExits); i++ {
-		valIndex, err := randValIndex(bState)
-		if err != nil {
-			return nil, err
-		}
-		exit := &ethpb.SignedVoluntaryExit{
-			Exit: &ethpb.VoluntaryExit{
-				Epoch:          helpers.PrevEpoch(bState),
-				ValidatorIndex: valIndex,
-			},
+		var valIndex uint64
+		if i < len(indices) {
+			valIndex = indices[i]
+			if valIndex >= uint64(len(privs)) {
+				return nil, fmt.Errorf("no private key for requested voluntary exit index %d", valIndex)
+			}
+			val, err := bState.ValidatorAtIndexReadOnly(valIndex)
+			if err != nil {
+				return nil, err
+			}
+			if !canExit(val, currentEpoch) {
+				return nil, fmt.Errorf("validator %d is not eligible to exit at epoch %d", valIndex, currentEpoch)
+			}
+		} else {
+			var err error
+			valIndex, err = randExitableValIndex(bState, usedIndices, randGen)
+			if err != nil {
+				return nil, err
+			}
 		}
-		root, err := ssz.HashTreeRoot(exit.Exit)
+		exit, err := voluntaryExitForValidator(epoch, privs[valIndex], valIndex, domain)
 		if err != nil {
 			return nil, err
 		}
-		domain := helpers.Domain(bState.Fork(), currentEpoch, params.BeaconConfig().DomainVoluntaryExit)
-		exit.Signature = privs[valIndex].Sign(root[:], domain).Marshal()
 		voluntaryExits[i] = exit
 	}
 	return voluntaryExits, nil
 }
 
-func randValIndex(bState *stateTrie.BeaconState) (uint64, error) {
+// randValIndex picks a random active validator that is not in usedIndices and marks it
+// as used.
+func randValIndex(bState *stateTrie.BeaconState, usedIndices map[uint64]bool, randGen *rand.Rand) (uint64, error) {
 	activeCount, err := helpers.ActiveValidatorCount(bState, helpers.CurrentEpoch(bState))
 	if err != nil {
 		return 0, err
 	}
-	return rand.Uint64() % activeCount, nil
+	if activeCount == 0 {
+		return 0, fmt.Errorf("no active validators at epoch %d", helpers.CurrentEpoch(bState))
+	}
+	numUsed := uint64(0)
+	for idx := range usedIndices {
+		if idx < activeCount {
+			numUsed++
+		}
+	}
+	if numUsed >= activeCount {
+		return 0, fmt.Errorf("all %d active validators are already used by other operations", activeCount)
+	}
+	for {
+		idx := randGen.Uint64() % activeCount
+		if !usedIndices[idx] {
+			usedIndices[idx] = true
+			return idx, nil
+		}
+	}
+}
+
+// randExitableValIndex picks a random validator that is not in usedIndices and is eligible
+// to exit at the current epoch of the state, and marks it as used.
+func randExitableValIndex(bState *stateTrie.BeaconState, usedIndices map[uint64]bool, randGen *rand.Rand) (uint64, error) {
+	currentEpoch := helpers.CurrentEpoch(bState)
+	var candidates []uint64
+	for idx := uint64(0); idx < uint64(bState.NumValidators()); idx++ {
+		if usedIndices[idx] {
+			continue
+		}
+		val, err := bState.ValidatorAtIndexReadOnly(idx)
+		if err != nil {
+			return 0, err
+		}
+		if canExit(val, currentEpoch) {
+			candidates = append(candidates, idx)
+		}
+	}
+	if len(candidates) == 0 {
+		return 0, fmt.Errorf("no unused validator is eligible to exit at epoch %d", currentEpoch)
+	}
+	idx := candidates[randGen.Intn(len(candidates))]
+	usedIndices[idx] = true
+	return idx, nil
+}
+
+// canExit returns whether the validator passes the checks of a voluntary exit processed at
+// the given epoch: it is active, has not exited yet and has been active for at least
+// PERSISTENT_COMMITTEE_PERIOD epochs.
+func canExit(val *stateTrie.ReadOnlyValidator, epoch uint64) bool {
+	return helpers.IsActiveValidatorUsingTrie(val, epoch) &&
+		val.ExitEpoch() == params.BeaconConfig().FarFutureEpoch &&
+		epoch >= val.ActivationEpoch()+params.BeaconConfig().PersistentCommitteePeriod
+}
+
+// unusedCommitteeMember picks the first committee member not in usedIndices, starting from
+// a random position in the committee, and marks it as used.
+func unusedCommitteeMember(committee []uint64, usedIndices map[uint64]bool, randGen *rand.Rand) (uint64, bool) {
+	if len(committee) == 0 {
+		return 0, false
+	}
+	start := randGen.Uint64() % uint64(len(committee))
+	for i := uint64(0); i < uint64(len(committee)); i++ {
+		idx := committee[(start+i)%uint64(len(committee))]
+		if !usedIndices[idx] {
+			usedIndices[idx] = true
+			return idx, true
+		}
+	}
+	return 0, false
+}
+
+// reserveIndices marks the first num of the requested operation indices as used, failing
+// when a validator is requested for more than one operation.
+func reserveIndices(usedIndices map[uint64]bool, indices []uint64, num uint64) error {
+	if uint64(len(indices)) > num {
+		indices = indices[:num]
+	}
+	for _, idx := range indices {
+		if usedIndices[idx] {
+			return fmt.Errorf("validator %d is requested for more than one slashing or exit", idx)
+		}
+		usedIndices[idx] = true
+	}
+	return nil
 }
@@ -1,11 +1,27 @@
 package testutil
 
 import (
+	"bytes"
 	"context"
+	"math/rand"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
 
+	"github.com/gogo/protobuf/proto"
+	ethpb "github.com/prysmaticlabs/ethereumapis/eth/v1alpha1"
+	"github.com/prysmaticlabs/go-bitfield"
+	"github.com/prysmaticlabs/go-ssz"
+	"github.com/prysmaticlabs/prysm/beacon-chain/core/blocks"
+	"github.com/prysmaticlabs/prysm/beacon-chain/core/epoch/precompute"
+	"github.com/prysmaticlabs/prysm/beacon-chain/core/helpers"
 	"github.com/prysmaticlabs/prysm/beacon-chain/core/state"
 	"github.com/prysmaticlabs/prysm/beacon-chain/core/state/stateutils"
+	stateTrie "github.com/prysmaticlabs/prysm/beacon-chain/state"
+	pb "github.com/prysmaticlabs/prysm/proto/beacon/p2p/v1"
+	"github.com/prysmaticlabs/prysm/shared/attestationutil"
+	"github.com/prysmaticlabs/prysm/shared/bls"
 	"github.com/prysmaticlabs/prysm/shared/bytesutil"
 	"github.com/prysmaticlabs/prysm/shared/params"
 )
@@ -25,6 +41,32 @@ func TestGenerateFullBlock_PassesStateTransition(t *testing.T) {
 	}
 }
 
+func TestGenerateFullBlock_VerifyTransition(t *testing.T) {
+	params.OverrideBeaconConfig(params.MinimalSpecConfig())
+	defer params.OverrideBeaconConfig(params.MainnetConfig())
+	beaconState, privs := DeterministicGenesisState(t, 64)
+	if err := beaconState.SetSlot(3 + params.BeaconConfig().PersistentCommitteePeriod*params.BeaconConfig().SlotsPerEpoch); err != nil {
+		t.Fatal(err)
+	}
+	conf := &BlockGenConfig{
+		NumProposerSlashings: 1,
+		NumAttesterSlashings: 1,
+		NumAttestations:      1,
+		NumDeposits:          1,
+		NumVoluntaryExits:    1,
+		VerifyTransition:     true,
+	}
+	if _, err := GenerateFullBlock(beaconState, privs, conf, beaconState.Slot()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Blocks generated to fail processing are not verified.
+	conf.Corruption = CorruptStateRoot
+	if _, err := GenerateFullBlock(beaconState, privs, conf, beaconState.Slot()); err != nil {
+		t.Fatal(err)
+	}
+}
+
 func TestGenerateFullBlock_ThousandValidators(t *testing.T) {
 	params.OverrideBeaconConfig(params.MinimalSpecConfig())
 	defer params.OverrideBeaconConfig(params.MainnetConfig())
@@ -206,3 +248,2597 @@ func TestGenerateFullBlock_ValidVoluntaryExits(t *testing.T) {
 		t.Fatal("expected exiting validator index to be marked as exiting")
 	}
 }
+
+func TestGenerateFullBlock_VoluntaryExitEpoch(t *testing.T) {
+	beaconState, privs := DeterministicGenesisState(t, 256)
+	// Moving the state 2048 epochs forward due to PERSISTENT_COMMITTEE_PERIOD.
+	beaconState.SetSlot(3 + params.BeaconConfig().PersistentCommitteePeriod*params.BeaconConfig().SlotsPerEpoch)
+	exitIndex := uint64(10)
+	conf := &BlockGenConfig{
+		NumVoluntaryExits:    1,
+		VoluntaryExitIndices: []uint64{exitIndex},
+	}
+	block, err := GenerateFullBlock(beaconState, privs, conf, beaconState.Slot())
+	if err != nil {
+		t.Fatal(err)
+	}
+	beaconState, err = state.ExecuteStateTransition(context.Background(), beaconState, block)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wanted := helpers.DelayedActivationExitEpoch(helpers.CurrentEpoch(beaconState))
+	val, err := beaconState.ValidatorAtIndexReadOnly(exitIndex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val.ExitEpoch() != wanted {
+		t.Errorf("Expected exit epoch %d, received %d", wanted, val.ExitEpoch())
+	}
+}
+
+func TestGenerateFullBlock_AttestationSlotOffset(t *testing.T) {
+	params.OverrideBeaconConfig(params.MinimalSpecConfig())
+	defer params.OverrideBeaconConfig(params.MainnetConfig())
+	beaconState, privs := DeterministicGenesisState(t, 64)
+	for i := 0; i < 5; i++ {
+		block, err := GenerateFullBlock(beaconState, privs, &BlockGenConfig{}, beaconState.Slot())
+		if err != nil {
+			t.Fatal(err)
+		}
+		beaconState, err = state.ExecuteStateTransition(context.Background(), beaconState, block)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name      string
+		blockSlot uint64
+		offset    uint64
+		attSlot   uint64
+	}{
+		{name: "default offset", blockSlot: 6, offset: 0, attSlot: 5},
+		{name: "processed slot", blockSlot: 6, offset: 3, attSlot: 3},
+		{name: "skipped slot", blockSlot: 9, offset: 2, attSlot: 7},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := &BlockGenConfig{
+				NumAttestations:       1,
+				AttestationSlotOffset: tt.offset,
+			}
+			block, err := GenerateFullBlock(beaconState, privs, conf, tt.blockSlot)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if block.Block.Slot != tt.blockSlot {
+				t.Errorf("Expected block slot %d, received %d", tt.blockSlot, block.Block.Slot)
+			}
+			for _, att := range block.Block.Body.Attestations {
+				if att.Data.Slot != tt.attSlot {
+					t.Errorf("Expected attestation slot %d, received %d", tt.attSlot, att.Data.Slot)
+				}
+			}
+			if _, err := state.ExecuteStateTransition(context.Background(), beaconState.Copy(), block); err != nil {
+				t.Errorf("Expected block to pass the state transition: %v", err)
+			}
+		})
+	}
+
+	conf := &BlockGenConfig{
+		NumAttestations:       1,
+		AttestationSlotOffset: params.BeaconConfig().SlotsPerEpoch + 1,
+	}
+	if _, err := GenerateFullBlock(beaconState, privs, conf, 20); err == nil {
+		t.Error("Expected error for an offset beyond the inclusion range")
+	}
+}
+
+func TestGenerateFullBlock_VoluntaryExitsOnlyEligibleValidators(t *testing.T) {
+	params.OverrideBeaconConfig(params.MinimalSpecConfig())
+	defer params.OverrideBeaconConfig(params.MainnetConfig())
+	beaconState, privs := DeterministicGenesisState(t, 64)
+	conf := &BlockGenConfig{
+		NumVoluntaryExits: 1,
+	}
+	if _, err := GenerateFullBlock(beaconState, privs, conf, beaconState.Slot()); err == nil {
+		t.Error("Expected error when no validator has been active long enough to exit")
+	}
+
+	if err := beaconState.SetSlot(3 + params.BeaconConfig().PersistentCommitteePeriod*params.BeaconConfig().SlotsPerEpoch); err != nil {
+		t.Fatal(err)
+	}
+	// The first half of the validators were activated too recently to exit.
+	recentEpoch := helpers.CurrentEpoch(beaconState) - 1
+	for i := uint64(0); i < 32; i++ {
+		val, err := beaconState.ValidatorAtIndex(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		val.ActivationEpoch = recentEpoch
+		if err := beaconState.UpdateValidatorAtIndex(i, val); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for seed := int64(0); seed < 5; seed++ {
+		conf := &BlockGenConfig{
+			NumVoluntaryExits: 4,
+			Seed:              seed,
+		}
+		block, err := GenerateFullBlock(beaconState, privs, conf, beaconState.Slot())
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, exit := range block.Block.Body.VoluntaryExits {
+			if exit.Exit.ValidatorIndex < 32 {
+				t.Errorf("Expected only eligible validators to exit, received validator %d", exit.Exit.ValidatorIndex)
+			}
+		}
+		if _, err := state.ExecuteStateTransition(context.Background(), beaconState.Copy(), block); err != nil {
+			t.Errorf("Block generated with seed %d failed the state transition: %v", seed, err)
+		}
+	}
+
+	conf = &BlockGenConfig{
+		NumVoluntaryExits:    1,
+		VoluntaryExitIndices: []uint64{0},
+	}
+	if _, err := GenerateFullBlock(beaconState, privs, conf, beaconState.Slot()); err == nil {
+		t.Error("Expected error when requesting an exit of a recently activated validator")
+	}
+}
+
+func TestGenerateFullBlock_VoluntaryExitEpoch_SaturatedQueue(t *testing.T) {
+	beaconState, privs := DeterministicGenesisState(t, 256)
+	// Moving the state 2048 epochs forward due to PERSISTENT_COMMITTEE_PERIOD.
+	beaconState.SetSlot(3 + params.BeaconConfig().PersistentCommitteePeriod*params.BeaconConfig().SlotsPerEpoch)
+
+	// Fill the exit queue for the earliest possible exit epoch up to the churn limit.
+	queueEpoch := helpers.DelayedActivationExitEpoch(helpers.CurrentEpoch(beaconState))
+	activeCount, err := helpers.ActiveValidatorCount(beaconState, helpers.CurrentEpoch(beaconState))
+	if err != nil {
+		t.Fatal(err)
+	}
+	churn, err := helpers.ValidatorChurnLimit(activeCount)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := uint64(0); i < churn; i++ {
+		val, err := beaconState.ValidatorAtIndex(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		val.ExitEpoch = queueEpoch
+		val.WithdrawableEpoch = queueEpoch + params.BeaconConfig().MinValidatorWithdrawabilityDelay
+		if err := beaconState.UpdateValidatorAtIndex(i, val); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	exitIndex := churn + 10
+	conf := &BlockGenConfig{
+		NumVoluntaryExits:    1,
+		VoluntaryExitIndices: []uint64{exitIndex},
+	}
+	block, err := GenerateFullBlock(beaconState, privs, conf, beaconState.Slot())
+	if err != nil {
+		t.Fatal(err)
+	}
+	beaconState, err = state.ExecuteStateTransition(context.Background(), beaconState, block)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	val, err := beaconState.ValidatorAtIndexReadOnly(exitIndex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val.ExitEpoch() != queueEpoch+1 {
+		t.Errorf("Expected exit epoch to be pushed back to %d, received %d", queueEpoch+1, val.ExitEpoch())
+	}
+}
+
+func TestGenerateAttestationsForSlot_CrossEpochSource(t *testing.T) {
+	params.OverrideBeaconConfig(params.MinimalSpecConfig())
+	defer params.OverrideBeaconConfig(params.MainnetConfig())
+	beaconState, privs := DeterministicGenesisState(t, 64)
+
+	conf := &BlockGenConfig{
+		NumAttestations: 2,
+	}
+	// Advance the chain into the second slot of epoch 4 so both epochs have justified checkpoints.
+	finalSlot := params.BeaconConfig().SlotsPerEpoch*4 + 2
+	for beaconState.Slot() < finalSlot {
+		block, err := GenerateFullBlock(beaconState, privs, conf, beaconState.Slot())
+		if err != nil {
+			t.Fatal(err)
+		}
+		beaconState, err = state.ExecuteStateTransition(context.Background(), beaconState, block)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	prevEpochSlot := params.BeaconConfig().SlotsPerEpoch*4 - 2
+	prevAtts, err := GenerateAttestationsForSlot(beaconState, privs, 1, prevEpochSlot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !proto.Equal(prevAtts[0].Data.Source, beaconState.PreviousJustifiedCheckpoint()) {
+		t.Errorf("Expected previous justified checkpoint as source, received %v", prevAtts[0].Data.Source)
+	}
+	currentEpochSlot := finalSlot - 1
+	currentAtts, err := GenerateAttestationsForSlot(beaconState, privs, 1, currentEpochSlot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !proto.Equal(currentAtts[0].Data.Source, beaconState.CurrentJustifiedCheckpoint()) {
+		t.Errorf("Expected current justified checkpoint as source, received %v", currentAtts[0].Data.Source)
+	}
+
+	body := &ethpb.BeaconBlockBody{
+		Attestations: append(prevAtts, currentAtts...),
+	}
+	if _, err := blocks.ProcessAttestations(context.Background(), beaconState.Copy(), body); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGenerateExpiredAttestations_RejectedAlongsideValid(t *testing.T) {
+	params.OverrideBeaconConfig(params.MinimalSpecConfig())
+	defer params.OverrideBeaconConfig(params.MainnetConfig())
+	genesisState, privs := DeterministicGenesisState(t, 64)
+	inclusionSlot := 2*params.BeaconConfig().SlotsPerEpoch + 3
+	headState, err := state.ProcessSlots(context.Background(), genesisState, inclusionSlot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid, err := GenerateAttestationsForSlot(headState, privs, 2, inclusionSlot-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, err := GenerateExpiredAttestations(headState, privs, 2, inclusionSlot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(expired) == 0 {
+		t.Fatal("Expected expired attestations")
+	}
+	if err := VerifyAttestations(headState, expired); err != nil {
+		t.Errorf("Expected expired attestations to be correctly signed: %v", err)
+	}
+
+	for i, att := range valid {
+		if _, err := blocks.ProcessAttestation(context.Background(), headState.Copy(), att); err != nil {
+			t.Errorf("Expected valid attestation %d to be accepted: %v", i, err)
+		}
+	}
+	want := "> attestation slot"
+	for i, att := range expired {
+		if _, err := blocks.ProcessAttestation(context.Background(), headState.Copy(), att); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Expected expired attestation %d to be rejected with error containing %q, received %v", i, want, err)
+		}
+	}
+
+	if _, err := GenerateExpiredAttestations(headState, privs, 2, 2*params.BeaconConfig().SlotsPerEpoch); err == nil {
+		t.Error("Expected error for an inclusion slot at the start of an epoch")
+	}
+}
+
+func TestGenerateAttestationsWithInclusionDistances(t *testing.T) {
+	params.OverrideBeaconConfig(params.MinimalSpecConfig())
+	defer params.OverrideBeaconConfig(params.MainnetConfig())
+	beaconState, privs := DeterministicGenesisState(t, 64)
+
+	inclusionSlot := params.BeaconConfig().SlotsPerEpoch + 2
+	maxDistance := params.BeaconConfig().SlotsPerEpoch
+	atts, distances, err := GenerateAttestationsWithInclusionDistances(beaconState, privs, 1, inclusionSlot, maxDistance)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(atts) != len(distances) {
+		t.Fatalf("Expected a distance for every attestation, received %d attestations and %d distances", len(atts), len(distances))
+	}
+
+	wanted := make(map[uint64]int)
+	for i, att := range atts {
+		if inclusionSlot-att.Data.Slot != distances[i] {
+			t.Errorf("Expected attestation %d to have inclusion distance %d, received %d", i, distances[i], inclusionSlot-att.Data.Slot)
+		}
+		wanted[distances[i]]++
+	}
+	if len(wanted) != int(maxDistance) {
+		t.Errorf("Expected %d distinct inclusion distances, received %d", maxDistance, len(wanted))
+	}
+
+	headState, err := state.ProcessSlots(context.Background(), beaconState.Copy(), inclusionSlot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	headState, err = blocks.ProcessAttestations(context.Background(), headState, &ethpb.BeaconBlockBody{Attestations: atts})
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := make(map[uint64]int)
+	pending := append(headState.PreviousEpochAttestations(), headState.CurrentEpochAttestations()...)
+	for _, a := range pending {
+		received[a.InclusionDelay]++
+	}
+	if !reflect.DeepEqual(wanted, received) {
+		t.Errorf("Expected inclusion delays %v, received %v", wanted, received)
+	}
+}
+
+func TestGenerateFullBlock_CorruptProposerSigningRoot(t *testing.T) {
+	beaconState, privs := DeterministicGenesisState(t, 64)
+	conf := &BlockGenConfig{
+		Corruption: CorruptProposerSigningRoot,
+	}
+	block, err := GenerateFullBlock(beaconState, privs, conf, beaconState.Slot())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = state.ExecuteStateTransition(context.Background(), beaconState, block)
+	if err == nil {
+		t.Fatal("Expected block signed over the wrong root to be rejected")
+	}
+	if !strings.Contains(err.Error(), "could not process block header: "+blocks.ErrSigFailedToVerify.Error()) {
+		t.Errorf("Expected proposer signature verification error, received %v", err)
+	}
+}
+
+func TestGenerateFullBlock_CorruptAttestationTargetRoot(t *testing.T) {
+	params.OverrideBeaconConfig(params.MinimalSpecConfig())
+	defer params.OverrideBeaconConfig(params.MainnetConfig())
+	beaconState, privs := DeterministicGenesisState(t, 64)
+	block, err := GenerateFullBlock(beaconState, privs, &BlockGenConfig{}, beaconState.Slot()+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	beaconState, err = state.ExecuteStateTransition(context.Background(), beaconState, block)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conf := &BlockGenConfig{
+		NumAttestations: 1,
+		Corruption:      CorruptAttestationTargetRoot,
+	}
+	block, err = GenerateFullBlock(beaconState, privs, conf, beaconState.Slot()+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	boundaryRoot, err := helpers.BlockRoot(beaconState, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	att := block.Block.Body.Attestations[0]
+	if bytes.Equal(att.Data.Target.Root, boundaryRoot) {
+		t.Fatal("Expected attestation target root to differ from the epoch boundary root")
+	}
+
+	// The target root is not checked for validity, it only determines whether the
+	// attesters are credited with a correct target vote.
+	beaconState, err = state.ExecuteStateTransition(context.Background(), beaconState, block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vp, bp := precompute.New(context.Background(), beaconState)
+	vp, _, err = precompute.ProcessAttestations(context.Background(), beaconState, vp, bp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	committee, err := helpers.BeaconCommitteeFromState(beaconState, att.Data.Slot, att.Data.CommitteeIndex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, idx := range committee {
+		if !vp[idx].IsCurrentEpochAttester {
+			t.Errorf("Expected validator %d to be credited as a current epoch attester", idx)
+		}
+		if vp[idx].IsCurrentEpochTargetAttester {
+			t.Errorf("Expected validator %d not to be credited as a current epoch target attester", idx)
+		}
+	}
+}
+
+func TestStreamAttestations_InvokesCallbackPerCommittee(t *testing.T) {
+	params.OverrideBeaconConfig(params.MinimalSpecConfig())
+	defer params.OverrideBeaconConfig(params.MainnetConfig())
+	beaconState, privs := DeterministicGenesisState(t, 128)
+	beaconState, err := state.ProcessSlots(context.Background(), beaconState, params.BeaconConfig().SlotsPerEpoch+2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slots := []uint64{}
+	for slot := uint64(1); slot < beaconState.Slot(); slot++ {
+		slots = append(slots, slot)
+	}
+
+	received := 0
+	err = StreamAttestations(beaconState, privs, slots, func(att *ethpb.Attestation) {
+		if att.AggregationBits.Count() != att.AggregationBits.Len() {
+			t.Errorf("Expected fully aggregated attestation, received %d of %d bits", att.AggregationBits.Count(), att.AggregationBits.Len())
+		}
+		received++
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	activeCount, err := helpers.ActiveValidatorCount(beaconState, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wanted := len(slots) * int(helpers.SlotCommitteeCount(activeCount))
+	if received != wanted {
+		t.Errorf("Expected %d callback invocations, received %d", wanted, received)
+	}
+}
+
+func TestGenerateValidBlock_PassesStateTransition(t *testing.T) {
+	genesisState := func(t *testing.T) (*stateTrie.BeaconState, []*bls.SecretKey) {
+		return DeterministicGenesisState(t, 64)
+	}
+	tests := []struct {
+		name          string
+		setup         func(t *testing.T) (*stateTrie.BeaconState, []*bls.SecretKey)
+		wantDeposits  int
+		wantExits     int
+		wantSlashings int
+	}{
+		{
+			name:          "genesis",
+			setup:         genesisState,
+			wantSlashings: 1,
+		},
+		{
+			name: "pending deposit",
+			setup: func(t *testing.T) (*stateTrie.BeaconState, []*bls.SecretKey) {
+				beaconState, privs := genesisState(t)
+				if _, _, err := DeterministicDepositsAndKeys(65); err != nil {
+					t.Fatal(err)
+				}
+				eth1Data, err := DeterministicEth1Data(65)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := beaconState.SetEth1Data(eth1Data); err != nil {
+					t.Fatal(err)
+				}
+				return beaconState, privs
+			},
+			wantDeposits:  1,
+			wantSlashings: 1,
+		},
+		{
+			name: "exitable validators",
+			setup: func(t *testing.T) (*stateTrie.BeaconState, []*bls.SecretKey) {
+				beaconState, privs := genesisState(t)
+				// Moving the state 2048 epochs forward due to PERSISTENT_COMMITTEE_PERIOD.
+				if err := beaconState.SetSlot(3 + params.BeaconConfig().PersistentCommitteePeriod*params.BeaconConfig().SlotsPerEpoch); err != nil {
+					t.Fatal(err)
+				}
+				return beaconState, privs
+			},
+			wantExits:     1,
+			wantSlashings: 1,
+		},
+		{
+			name: "slashed validator",
+			setup: func(t *testing.T) (*stateTrie.BeaconState, []*bls.SecretKey) {
+				beaconState, privs := genesisState(t)
+				block, err := GenerateValidBlock(beaconState, privs, beaconState.Slot()+1)
+				if err != nil {
+					t.Fatal(err)
+				}
+				beaconState, err = state.ExecuteStateTransition(context.Background(), beaconState, block)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return beaconState, privs
+			},
+			wantSlashings: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			beaconState, privs := tt.setup(t)
+			block, err := GenerateValidBlock(beaconState, privs, beaconState.Slot()+1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body := block.Block.Body
+			if len(body.Deposits) != tt.wantDeposits {
+				t.Errorf("Expected %d deposits, received %d", tt.wantDeposits, len(body.Deposits))
+			}
+			if len(body.VoluntaryExits) != tt.wantExits {
+				t.Errorf("Expected %d voluntary exits, received %d", tt.wantExits, len(body.VoluntaryExits))
+			}
+			if len(body.ProposerSlashings) != tt.wantSlashings {
+				t.Errorf("Expected %d proposer slashings, received %d", tt.wantSlashings, len(body.ProposerSlashings))
+			}
+			if len(body.Attestations) == 0 {
+				t.Error("Expected block to contain attestations")
+			}
+			if len(body.ProposerSlashings) > 0 {
+				val, err := beaconState.ValidatorAtIndexReadOnly(body.ProposerSlashings[0].ProposerIndex)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if val.Slashed() {
+					t.Errorf("Expected validator %d to not already be slashed", body.ProposerSlashings[0].ProposerIndex)
+				}
+			}
+			if _, err := state.ExecuteStateTransition(context.Background(), beaconState, block); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestGenerateValidBlock_CrossesEpochBoundary(t *testing.T) {
+	beaconState, privs := DeterministicGenesisState(t, 64)
+	// Validators become eligible to exit at the epoch of the block, but not at the epoch of
+	// the state the exit would be generated on.
+	eligibleSlot := params.BeaconConfig().PersistentCommitteePeriod * params.BeaconConfig().SlotsPerEpoch
+	if err := beaconState.SetSlot(eligibleSlot - 1); err != nil {
+		t.Fatal(err)
+	}
+	block, err := GenerateValidBlock(beaconState, privs, eligibleSlot+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(block.Block.Body.VoluntaryExits) != 0 {
+		t.Errorf("Expected no voluntary exits, received %d", len(block.Block.Body.VoluntaryExits))
+	}
+	if _, err := state.ExecuteStateTransition(context.Background(), beaconState, block); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGenerateFullBlock_CorruptAttesterSlashingIdenticalAttestations(t *testing.T) {
+	params.OverrideBeaconConfig(params.MinimalSpecConfig())
+	defer params.OverrideBeaconConfig(params.MainnetConfig())
+	beaconState, privs := DeterministicGenesisState(t, 32)
+	conf := &BlockGenConfig{
+		NumAttesterSlashings: 1,
+		Corruption:           CorruptAttesterSlashingIdenticalAttestations,
+	}
+	block, err := GenerateFullBlock(beaconState, privs, conf, beaconState.Slot())
+	if err != nil {
+		t.Fatal(err)
+	}
+	slashing := block.Block.Body.AttesterSlashings[0]
+	if !proto.Equal(slashing.Attestation_1, slashing.Attestation_2) {
+		t.Fatal("Expected both attestations of the slashing to be identical")
+	}
+
+	want := "attestations are not slashable"
+	if _, err := blocks.ProcessAttesterSlashings(context.Background(), beaconState.Copy(), block.Block.Body); err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("Expected error containing %q, received %v", want, err)
+	}
+	AssertTransitionError(t, beaconState, block, want)
+}
+
+func TestGenerateBlockWithMaxProposerSlashings(t *testing.T) {
+	beaconState, privs := DeterministicGenesisState(t, 128)
+	schedule, err := ProposerSchedule(beaconState)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := GenerateBlockWithMaxProposerSlashings(beaconState, privs, beaconState.Slot()+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	beaconState, err = state.ExecuteStateTransition(context.Background(), beaconState, block)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	slashings := block.Block.Body.ProposerSlashings
+	if uint64(len(slashings)) != params.BeaconConfig().MaxProposerSlashings {
+		t.Fatalf("Expected %d proposer slashings, received %d", params.BeaconConfig().MaxProposerSlashings, len(slashings))
+	}
+	scheduled := make(map[uint64]bool)
+	for _, idx := range schedule {
+		scheduled[idx] = true
+	}
+	slashed := make(map[uint64]bool)
+	for _, slashing := range slashings {
+		idx := slashing.ProposerIndex
+		if slashed[idx] {
+			t.Errorf("Expected distinct slashed validators, validator %d slashed twice", idx)
+		}
+		slashed[idx] = true
+		if !scheduled[idx] {
+			t.Errorf("Expected validator %d to be a scheduled proposer", idx)
+		}
+		val, err := beaconState.ValidatorAtIndexReadOnly(idx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !val.Slashed() {
+			t.Errorf("Expected validator %d to be slashed", idx)
+		}
+	}
+}
+
+func TestGenerateFullBlock_CorruptRandaoRevealEpoch(t *testing.T) {
+	beaconState, privs := DeterministicGenesisState(t, 64)
+	conf := &BlockGenConfig{
+		Corruption: CorruptRandaoRevealEpoch,
+	}
+	block, err := GenerateFullBlock(beaconState, privs, conf, beaconState.Slot())
+	if err != nil {
+		t.Fatal(err)
+	}
+	AssertTransitionError(t, beaconState, block, "could not verify block randao: "+blocks.ErrSigFailedToVerify.Error())
+}
+
+func TestGenerateDistinctAttestations_FillsBlock(t *testing.T) {
+	params.OverrideBeaconConfig(params.MinimalSpecConfig())
+	defer params.OverrideBeaconConfig(params.MainnetConfig())
+	beaconState, privs := DeterministicGenesisState(t, 64)
+	beaconState, err := state.ProcessSlots(context.Background(), beaconState, params.BeaconConfig().SlotsPerEpoch+2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slot := beaconState.Slot() + 1
+	atts, err := GenerateDistinctAttestations(beaconState, privs, slot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	maxAtts := params.BeaconConfig().MaxAttestations
+	if uint64(len(atts)) != maxAtts {
+		t.Fatalf("Expected %d attestations, received %d", maxAtts, len(atts))
+	}
+	dataRoots := make(map[[32]byte]bool)
+	for _, att := range atts {
+		root, err := ssz.HashTreeRoot(att.Data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dataRoots[root] {
+			t.Errorf("Expected distinct attestation data, received duplicate %v", att.Data)
+		}
+		dataRoots[root] = true
+	}
+
+	block, err := GenerateFullBlock(beaconState, privs, &BlockGenConfig{Attestations: atts}, slot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	beaconState, err = state.ExecuteStateTransition(context.Background(), beaconState, block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	included := len(beaconState.CurrentEpochAttestations()) + len(beaconState.PreviousEpochAttestations())
+	if uint64(included) != maxAtts {
+		t.Errorf("Expected %d attestations in the state, received %d", maxAtts, included)
+	}
+}
+
+func TestGenerateFullBlock_SeedIsReproducible(t *testing.T) {
+	params.OverrideBeaconConfig(params.MinimalSpecConfig())
+	defer params.OverrideBeaconConfig(params.MainnetConfig())
+	beaconState, privs := DeterministicGenesisState(t, 64)
+	conf := &BlockGenConfig{
+		NumProposerSlashings: 2,
+		NumAttesterSlashings: 1,
+		Seed:                 42,
+	}
+	block1, err := GenerateFullBlock(beaconState, privs, conf, beaconState.Slot())
+	if err != nil {
+		t.Fatal(err)
+	}
+	block2, err := GenerateFullBlock(beaconState, privs, conf, beaconState.Slot())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !proto.Equal(block1, block2) {
+		t.Error("Expected blocks generated with the same seed to be equal")
+	}
+
+	conf = &BlockGenConfig{
+		NumProposerSlashings: 2,
+		NumAttesterSlashings: 1,
+		Rand:                 rand.New(rand.NewSource(42)),
+	}
+	block3, err := GenerateFullBlock(beaconState, privs, conf, beaconState.Slot())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !proto.Equal(block1, block3) {
+		t.Error("Expected block generated with a source seeded alike to equal the seeded block")
+	}
+}
+
+func TestGenerateAttestations_SignedOverAttestationData(t *testing.T) {
+	params.OverrideBeaconConfig(params.MinimalSpecConfig())
+	defer params.OverrideBeaconConfig(params.MainnetConfig())
+	beaconState, privs := DeterministicGenesisState(t, 128)
+	beaconState, err := state.ProcessSlots(context.Background(), beaconState, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	atts, err := GenerateAttestations(beaconState, privs, 4, beaconState.Slot(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, att := range atts {
+		committee, err := helpers.BeaconCommitteeFromState(beaconState, att.Data.Slot, att.Data.CommitteeIndex)
+		if err != nil {
+			t.Fatal(err)
+		}
+		indexedAtt, err := attestationutil.ConvertToIndexed(context.Background(), att, committee)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := blocks.VerifyIndexedAttestation(context.Background(), beaconState, indexedAtt); err != nil {
+			t.Errorf("Expected attestation of committee %d to verify, received %v", att.Data.CommitteeIndex, err)
+		}
+	}
+}
+
+func TestGenerateAttestations_SplitsCommittees(t *testing.T) {
+	params.OverrideBeaconConfig(params.MinimalSpecConfig())
+	defer params.OverrideBeaconConfig(params.MainnetConfig())
+	// 4 committees of 4 validators per slot.
+	beaconState, privs := DeterministicGenesisState(t, 128)
+
+	atts, err := GenerateAttestations(beaconState, privs, 8, beaconState.Slot(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(atts) != 8 {
+		t.Fatalf("Expected 8 attestations, received %d", len(atts))
+	}
+	perCommittee := make(map[uint64]int)
+	for _, att := range atts {
+		perCommittee[att.Data.CommitteeIndex]++
+		if att.AggregationBits.Count() != 2 {
+			t.Errorf("Expected each attestation to aggregate 2 validators, received %d", att.AggregationBits.Count())
+		}
+	}
+	for c := uint64(0); c < 4; c++ {
+		if perCommittee[c] != 2 {
+			t.Errorf("Expected 2 attestations for committee %d, received %d", c, perCommittee[c])
+		}
+	}
+
+	if _, err := GenerateAttestations(beaconState, privs, 6, beaconState.Slot(), false); err == nil {
+		t.Error("Expected error when requested attestations are not divisible by committees per slot")
+	}
+}
+
+func TestGenerateAttestations_UnevenCommitteeSplit(t *testing.T) {
+	params.OverrideBeaconConfig(params.MinimalSpecConfig())
+	defer params.OverrideBeaconConfig(params.MainnetConfig())
+	// 2 committees of 5 validators per slot.
+	beaconState, privs := DeterministicGenesisState(t, 80)
+
+	atts, err := GenerateAttestations(beaconState, privs, 4, beaconState.Slot(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(atts) != 4 {
+		t.Fatalf("Expected 4 attestations, received %d", len(atts))
+	}
+	bitsPerCommittee := make(map[uint64]uint64)
+	for _, att := range atts {
+		bitsPerCommittee[att.Data.CommitteeIndex] += att.AggregationBits.Count()
+	}
+	for c, count := range bitsPerCommittee {
+		committee, err := helpers.BeaconCommitteeFromState(beaconState, beaconState.Slot(), c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != uint64(len(committee)) {
+			t.Errorf("Expected all %d validators of committee %d to attest once, received %d", len(committee), c, count)
+		}
+	}
+}
+
+func TestGenerateFullBlock_Graffiti(t *testing.T) {
+	beaconState, privs := DeterministicGenesisState(t, 64)
+	long := bytes.Repeat([]byte{'a'}, 40)
+	tests := []struct {
+		name     string
+		graffiti []byte
+		want     []byte
+	}{
+		{name: "unset", graffiti: nil, want: make([]byte, 32)},
+		{name: "short", graffiti: []byte("prysm"), want: append([]byte("prysm"), make([]byte, 27)...)},
+		{name: "long", graffiti: long, want: long[:32]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			block, err := GenerateFullBlock(beaconState, privs, &BlockGenConfig{Graffiti: tt.graffiti}, beaconState.Slot())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(block.Block.Body.Graffiti, tt.want) {
+				t.Errorf("Expected graffiti %#x, received %#x", tt.want, block.Block.Body.Graffiti)
+			}
+			if _, err := state.ExecuteStateTransition(context.Background(), beaconState.Copy(), block); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestGenerateFullBlock_AttesterSlashingTypes(t *testing.T) {
+	params.OverrideBeaconConfig(params.MinimalSpecConfig())
+	defer params.OverrideBeaconConfig(params.MainnetConfig())
+	beaconState, privs := DeterministicGenesisState(t, 32)
+	tests := []struct {
+		name         string
+		slashingType AttesterSlashingType
+	}{
+		{name: "double vote", slashingType: DoubleVote},
+		{name: "surround vote", slashingType: SurroundVote},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := &BlockGenConfig{
+				NumAttesterSlashings: 1,
+				AttesterSlashingType: tt.slashingType,
+			}
+			block, err := GenerateFullBlock(beaconState, privs, conf, beaconState.Slot())
+			if err != nil {
+				t.Fatal(err)
+			}
+			slashing := block.Block.Body.AttesterSlashings[0]
+			data1, data2 := slashing.Attestation_1.Data, slashing.Attestation_2.Data
+			isDoubleVote := !proto.Equal(data1, data2) && data1.Target.Epoch == data2.Target.Epoch
+			isSurroundVote := data1.Source.Epoch < data2.Source.Epoch && data2.Target.Epoch < data1.Target.Epoch
+			if isDoubleVote != (tt.slashingType == DoubleVote) || isSurroundVote != (tt.slashingType == SurroundVote) {
+				t.Errorf("Expected slashing to only be a %s, received double vote %t and surround vote %t", tt.name, isDoubleVote, isSurroundVote)
+			}
+
+			postState, err := state.ExecuteStateTransition(context.Background(), beaconState.Copy(), block)
+			if err != nil {
+				t.Fatal(err)
+			}
+			val, err := postState.ValidatorAtIndexReadOnly(slashing.Attestation_1.AttestingIndices[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !val.Slashed() {
+				t.Error("Expected validator to be slashed")
+			}
+		})
+	}
+}
+
+func TestGenerateTypedAttesterSlashingForValidator_SurroundedFirstNotSlashable(t *testing.T) {
+	beaconState, privs := DeterministicGenesisState(t, 32)
+	slashing, err := GenerateTypedAttesterSlashingForValidator(beaconState, privs[0], 0, SurroundVote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Surround votes are only slashable when the surrounding attestation comes first.
+	slashing.Attestation_1, slashing.Attestation_2 = slashing.Attestation_2, slashing.Attestation_1
+	body := &ethpb.BeaconBlockBody{AttesterSlashings: []*ethpb.AttesterSlashing{slashing}}
+	want := "attestations are not slashable"
+	if _, err := blocks.ProcessAttesterSlashings(context.Background(), beaconState, body); err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("Expected error containing %q, received %v", want, err)
+	}
+}
+
+func TestGenerateSurroundSlashing(t *testing.T) {
+	beaconState, privs := DeterministicGenesisState(t, 32)
+	slashing, err := GenerateSurroundSlashing(beaconState, privs, 5, 10, 2, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data1, data2 := slashing.Attestation_1.Data, slashing.Attestation_2.Data
+	if data1.Source.Epoch != 2 || data1.Target.Epoch != 20 || data2.Source.Epoch != 5 || data2.Target.Epoch != 10 {
+		t.Errorf("Expected votes 2->20 and 5->10, received %d->%d and %d->%d",
+			data1.Source.Epoch, data1.Target.Epoch, data2.Source.Epoch, data2.Target.Epoch)
+	}
+	if !blocks.IsSlashableAttestationData(data1, data2) {
+		t.Error("Expected surround vote to be slashable")
+	}
+	if !reflect.DeepEqual(slashing.Attestation_1.AttestingIndices, slashing.Attestation_2.AttestingIndices) {
+		t.Error("Expected both attestations to share their attester")
+	}
+	for i, att := range []*ethpb.IndexedAttestation{slashing.Attestation_1, slashing.Attestation_2} {
+		if err := blocks.VerifyIndexedAttestation(context.Background(), beaconState, att); err != nil {
+			t.Errorf("Expected attestation %d to be signed correctly: %v", i+1, err)
+		}
+	}
+
+	if _, err := GenerateSurroundSlashing(beaconState, privs, 5, 10, 5, 20); err == nil {
+		t.Error("Expected error for votes with the same source epoch")
+	}
+}
+
+func TestGenerateOverlappingAttesterSlashing_SlashesIntersection(t *testing.T) {
+	beaconState, privs := DeterministicGenesisState(t, 64)
+	slashing, err := GenerateOverlappingAttesterSlashing(beaconState, privs, []uint64{3, 1, 2}, []uint64{3, 4, 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(slashing.Attestation_1.AttestingIndices, []uint64{1, 2, 3}) {
+		t.Errorf("Expected sorted attesting indices [1 2 3], received %v", slashing.Attestation_1.AttestingIndices)
+	}
+	body := &ethpb.BeaconBlockBody{AttesterSlashings: []*ethpb.AttesterSlashing{slashing}}
+	postState, err := blocks.ProcessAttesterSlashings(context.Background(), beaconState.Copy(), body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := uint64(1); i <= 5; i++ {
+		val, err := postState.ValidatorAtIndexReadOnly(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if val.Slashed() != (i == 3) {
+			t.Errorf("Expected validator %d slashed to be %t, received %t", i, i == 3, val.Slashed())
+		}
+	}
+
+	if _, err := GenerateOverlappingAttesterSlashing(beaconState, privs, []uint64{1, 2}, []uint64{4, 5}); err == nil {
+		t.Error("Expected error for attester indices which do not overlap")
+	}
+}
+
+func TestGenerateValidatorExitWithWithdrawal(t *testing.T) {
+	params.OverrideBeaconConfig(params.MinimalSpecConfig())
+	defer params.OverrideBeaconConfig(params.MainnetConfig())
+	beaconState, privs := DeterministicGenesisState(t, 64)
+	if _, _, err := GenerateValidatorExitWithWithdrawal(beaconState, privs[0], 0); err == nil {
+		t.Error("Expected error for a validator active for less than the persistent committee period")
+	}
+	if err := beaconState.SetSlot(params.BeaconConfig().PersistentCommitteePeriod * params.BeaconConfig().SlotsPerEpoch); err != nil {
+		t.Fatal(err)
+	}
+
+	exit, postState, err := GenerateValidatorExitWithWithdrawal(beaconState, privs[5], 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exit.Exit.ValidatorIndex != 5 {
+		t.Errorf("Expected exit of validator 5, received %d", exit.Exit.ValidatorIndex)
+	}
+	val, err := postState.ValidatorAtIndexReadOnly(5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantExitEpoch := helpers.DelayedActivationExitEpoch(helpers.CurrentEpoch(beaconState))
+	if val.ExitEpoch() != wantExitEpoch {
+		t.Errorf("Expected exit epoch %d, received %d", wantExitEpoch, val.ExitEpoch())
+	}
+	if val.WithdrawableEpoch() != wantExitEpoch+params.BeaconConfig().MinValidatorWithdrawabilityDelay {
+		t.Errorf("Expected withdrawable epoch %d, received %d",
+			wantExitEpoch+params.BeaconConfig().MinValidatorWithdrawabilityDelay, val.WithdrawableEpoch())
+	}
+	preVal, err := beaconState.ValidatorAtIndexReadOnly(5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if preVal.ExitEpoch() != params.BeaconConfig().FarFutureEpoch {
+		t.Error("Expected the given state to not be mutated")
+	}
+}
+
+func TestGenerateFullBlock_NoActiveValidators(t *testing.T) {
+	beaconState, privs := DeterministicGenesisState(t, 64)
+	vals := beaconState.Validators()
+	for _, val := range vals {
+		val.ExitEpoch = 0
+	}
+	if err := beaconState.SetValidators(vals); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := randValIndex(beaconState, make(map[uint64]bool), rand.New(rand.NewSource(0))); err == nil {
+		t.Error("Expected error picking a validator without active validators")
+	}
+	conf := &BlockGenConfig{NumProposerSlashings: 1}
+	if _, err := GenerateFullBlock(beaconState, privs, conf, beaconState.Slot()); err == nil {
+		t.Error("Expected error generating a block without active validators")
+	}
+}
+
+func TestGenerateForkTransitionBlock(t *testing.T) {
+	params.OverrideBeaconConfig(params.MinimalSpecConfig())
+	defer params.OverrideBeaconConfig(params.MainnetConfig())
+	beaconState, privs := DeterministicGenesisState(t, 64)
+	conf := &BlockGenConfig{NumAttestations: 1}
+	version := []byte{1, 0, 0, 0}
+	block, forkState, err := GenerateForkTransitionBlock(beaconState, privs, conf, 1, version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if block.Block.Slot != params.BeaconConfig().SlotsPerEpoch {
+		t.Errorf("Expected block at slot %d, received %d", params.BeaconConfig().SlotsPerEpoch, block.Block.Slot)
+	}
+	fork := forkState.Fork()
+	if !bytes.Equal(fork.PreviousVersion, beaconState.Fork().CurrentVersion) || !bytes.Equal(fork.CurrentVersion, version) || fork.Epoch != 1 {
+		t.Errorf("Expected fork from %#x to %#x at epoch 1, received %v", beaconState.Fork().CurrentVersion, version, fork)
+	}
+	// The attestations of the last slot of the previous epoch are signed under the
+	// previous version, the block under the new one.
+	if _, err := state.ExecuteStateTransition(context.Background(), forkState.Copy(), block); err != nil {
+		t.Fatal(err)
+	}
+	AssertTransitionError(t, beaconState, block, blocks.ErrSigFailedToVerify.Error())
+
+	if _, _, err := GenerateForkTransitionBlock(beaconState, privs, conf, 0, version); err == nil {
+		t.Error("Expected error for a fork at the epoch of the state")
+	}
+}
+
+func TestBlockGenerator_MatchesGenerateFullBlock(t *testing.T) {
+	params.OverrideBeaconConfig(params.MinimalSpecConfig())
+	defer params.OverrideBeaconConfig(params.MainnetConfig())
+	beaconState, privs := DeterministicGenesisState(t, 64)
+	conf := &BlockGenConfig{NumAttestations: 1, NumDeposits: 1}
+	gen := NewBlockGenerator(beaconState, privs, conf)
+	for _, slot := range []uint64{0, 2, 2} {
+		want, err := GenerateFullBlock(beaconState, privs, conf, slot)
+		if err != nil {
+			t.Fatal(err)
+		}
+		block, err := gen.Generate(slot)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !proto.Equal(block, want) {
+			t.Errorf("Expected generated block at slot %d to equal the block of GenerateFullBlock", slot)
+		}
+		AssertBlockProcessable(t, beaconState, block)
+	}
+}
+
+func TestBlockGenerator_AllocatesLessThanGenerateFullBlock(t *testing.T) {
+	params.OverrideBeaconConfig(params.MinimalSpecConfig())
+	defer params.OverrideBeaconConfig(params.MainnetConfig())
+	beaconState, privs := DeterministicGenesisState(t, 64)
+	conf := &BlockGenConfig{NumAttestations: 1}
+	gen := NewBlockGenerator(beaconState, privs, conf)
+	// Fill the caches of the generator for the slot.
+	if _, err := gen.Generate(1); err != nil {
+		t.Fatal(err)
+	}
+	var genErr error
+	freeAllocs := testing.AllocsPerRun(5, func() {
+		if _, err := GenerateFullBlock(beaconState, privs, conf, 1); err != nil {
+			genErr = err
+		}
+	})
+	genAllocs := testing.AllocsPerRun(5, func() {
+		if _, err := gen.Generate(1); err != nil {
+			genErr = err
+		}
+	})
+	if genErr != nil {
+		t.Fatal(genErr)
+	}
+	if genAllocs >= freeAllocs {
+		t.Errorf("Expected BlockGenerator to allocate less than %.0f times per block, received %.0f", freeAllocs, genAllocs)
+	}
+}
+
+func TestRequiredSignerIndices_SparseKeys(t *testing.T) {
+	params.OverrideBeaconConfig(params.MinimalSpecConfig())
+	defer params.OverrideBeaconConfig(params.MainnetConfig())
+	beaconState, privs := DeterministicGenesisState(t, 64)
+	if err := beaconState.SetSlot(3 + params.BeaconConfig().PersistentCommitteePeriod*params.BeaconConfig().SlotsPerEpoch); err != nil {
+		t.Fatal(err)
+	}
+	conf := &BlockGenConfig{
+		NumProposerSlashings: 1,
+		NumAttesterSlashings: 1,
+		NumAttestations:      1,
+		NumVoluntaryExits:    1,
+		TopUpDeposits:        1,
+		Seed:                 7,
+	}
+	indices, err := RequiredSignerIndices(beaconState, conf, beaconState.Slot())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(indices) == 0 || len(indices) >= len(privs) {
+		t.Fatalf("Expected a strict subset of the validators to sign, received %d signers", len(indices))
+	}
+
+	// Generation panics on a missing key if a signer isn't reported.
+	sparsePrivs := make([]*bls.SecretKey, len(privs))
+	for _, idx := range indices {
+		sparsePrivs[idx] = privs[idx]
+	}
+	block, err := GenerateFullBlock(beaconState, sparsePrivs, conf, beaconState.Slot())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := GenerateFullBlock(beaconState, privs, conf, beaconState.Slot())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !proto.Equal(block, want) {
+		t.Error("Expected the block generated with the required keys only to equal the block generated with all keys")
+	}
+
+	conf.Rand = rand.New(rand.NewSource(7))
+	if _, err := RequiredSignerIndices(beaconState, conf, beaconState.Slot()); err == nil {
+		t.Error("Expected error for a config with a source of randomness")
+	}
+}
+
+func TestGenerateFullBlock_ConcurrentSharedState(t *testing.T) {
+	beaconState, privs := DeterministicGenesisState(t, 64)
+	conf := &BlockGenConfig{NumAttestations: 1}
+	want, err := GenerateFullBlock(beaconState, privs, conf, beaconState.Slot())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Run with the race detector to catch generators mutating the shared state.
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			block, err := GenerateFullBlock(beaconState, privs, conf, beaconState.Slot())
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if !proto.Equal(block, want) {
+				t.Error("Expected concurrently generated blocks to be identical")
+			}
+			if _, _, _, err := BlockSigningRoot(beaconState, block.Block); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if beaconState.Slot() != 0 {
+		t.Errorf("Expected the shared state to be left at slot 0, received %d", beaconState.Slot())
+	}
+}
+
+func TestGenerateFullBlockWithContext_Cancelled(t *testing.T) {
+	beaconState, privs := DeterministicGenesisState(t, 64)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := GenerateFullBlockWithContext(ctx, beaconState, privs, DefaultBlockGenConfig(), beaconState.Slot()); err != context.Canceled {
+		t.Errorf("Expected error %v, received %v", context.Canceled, err)
+	}
+}
+
+func TestSignInParallel_MatchesSerialAggregate(t *testing.T) {
+	_, privs, err := DeterministicDepositsAndKeys(64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	indices := make([]uint64, 0, len(privs))
+	for i := len(privs) - 1; i >= 0; i -= 3 {
+		indices = append(indices, uint64(i))
+	}
+	msgRoot := bytesutil.ToBytes32([]byte("signed message"))
+	msg := msgRoot[:]
+	domain := uint64(7)
+
+	sigs, err := signInParallel(privs, indices, msg, domain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serialSigs := make([]*bls.Signature, len(indices))
+	for i, idx := range indices {
+		serialSigs[i] = privs[idx].Sign(msg, domain)
+	}
+	for i := range sigs {
+		if !bytes.Equal(sigs[i].Marshal(), serialSigs[i].Marshal()) {
+			t.Errorf("Expected signature %d to match the serial signature", i)
+		}
+	}
+	if !bytes.Equal(bls.AggregateSignatures(sigs).Marshal(), bls.AggregateSignatures(serialSigs).Marshal()) {
+		t.Error("Expected parallel aggregate signature to match the serial aggregate")
+	}
+}
+
+func TestGenerateFullBlockAtSlotSkipping_PassesStateTransition(t *testing.T) {
+	params.OverrideBeaconConfig(params.MinimalSpecConfig())
+	defer params.OverrideBeaconConfig(params.MainnetConfig())
+	beaconState, privs := DeterministicGenesisState(t, 64)
+	// Skip past the first epoch boundary so the proposer and RANDAO reveal are computed
+	// after epoch processing.
+	skipSlots := params.BeaconConfig().SlotsPerEpoch + 1
+	conf := &BlockGenConfig{
+		NumAttestations: 1,
+	}
+	block, err := GenerateFullBlockAtSlotSkipping(beaconState, privs, conf, skipSlots)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if block.Block.Slot != beaconState.Slot()+skipSlots+1 {
+		t.Errorf("Expected block slot %d, received %d", beaconState.Slot()+skipSlots+1, block.Block.Slot)
+	}
+	parentRoot, err := ssz.HashTreeRoot(GenerateEmptySlots(t, beaconState, 1).LatestBlockHeader())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(block.Block.ParentRoot, parentRoot[:]) {
+		t.Errorf("Expected parent root %#x, received %#x", parentRoot, block.Block.ParentRoot)
+	}
+
+	beaconState, err = state.ExecuteStateTransition(context.Background(), beaconState, block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(beaconState.CurrentEpochAttestations()) == 0 {
+		t.Error("Expected attestations for the last skipped slot to be included")
+	}
+}
+
+func TestGenerateFullBlock_ProposerSlashingIndices(t *testing.T) {
+	params.OverrideBeaconConfig(params.MinimalSpecConfig())
+	defer params.OverrideBeaconConfig(params.MainnetConfig())
+	beaconState, privs := DeterministicGenesisState(t, 64)
+	slashedIdx := uint64(17)
+	conf := &BlockGenConfig{
+		NumProposerSlashings:    1,
+		ProposerSlashingIndices: []uint64{slashedIdx},
+	}
+	block, err := GenerateFullBlock(beaconState, privs, conf, beaconState.Slot())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if idx := block.Block.Body.ProposerSlashings[0].ProposerIndex; idx != slashedIdx {
+		t.Errorf("Expected proposer slashing of validator %d, received %d", slashedIdx, idx)
+	}
+	beaconState, err = state.ExecuteStateTransition(context.Background(), beaconState, block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	val, err := beaconState.ValidatorAtIndexReadOnly(slashedIdx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !val.Slashed() {
+		t.Errorf("Expected validator %d to be slashed", slashedIdx)
+	}
+}
+
+func TestGenerateProposerSlashings_FewerIndicesThanSlashings(t *testing.T) {
+	beaconState, privs := DeterministicGenesisState(t, 64)
+	slashings, err := generateProposerSlashings(beaconState, privs, 3, []uint64{5}, map[uint64]bool{5: true}, rand.New(rand.NewSource(0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(slashings) != 3 {
+		t.Fatalf("Expected 3 proposer slashings, received %d", len(slashings))
+	}
+	if slashings[0].ProposerIndex != 5 {
+		t.Errorf("Expected first proposer slashing of validator 5, received %d", slashings[0].ProposerIndex)
+	}
+
+	if _, err := generateProposerSlashings(beaconState, privs, 1, []uint64{64}, map[uint64]bool{64: true}, rand.New(rand.NewSource(0))); err == nil {
+		t.Error("Expected error for a proposer slashing index without a private key")
+	}
+}
+
+func TestGenerateFullBlock_TooFewValidatorsForOperations(t *testing.T) {
+	params.OverrideBeaconConfig(params.MinimalSpecConfig())
+	defer params.OverrideBeaconConfig(params.MainnetConfig())
+	beaconState, privs := DeterministicGenesisState(t, 8)
+	conf := &BlockGenConfig{
+		NumProposerSlashings: 4,
+		NumAttesterSlashings: 1,
+		NumVoluntaryExits:    4,
+	}
+	want := "requested 9 slashings and exits of distinct validators, but there are only 8 active validators"
+	if _, err := GenerateFullBlock(beaconState, privs, conf, beaconState.Slot()); err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("Expected error containing %q, received %v", want, err)
+	}
+}
+
+func TestGenerateFullBlock_SlashingsAndExitsUseDistinctValidators(t *testing.T) {
+	params.OverrideBeaconConfig(params.MinimalSpecConfig())
+	defer params.OverrideBeaconConfig(params.MainnetConfig())
+	genesisState, privs := DeterministicGenesisState(t, 64)
+	// Moving the state forward due to PERSISTENT_COMMITTEE_PERIOD so validators can exit.
+	if err := genesisState.SetSlot(3 + params.BeaconConfig().PersistentCommitteePeriod*params.BeaconConfig().SlotsPerEpoch); err != nil {
+		t.Fatal(err)
+	}
+	for seed := int64(0); seed < 10; seed++ {
+		conf := &BlockGenConfig{
+			NumProposerSlashings: 4,
+			NumAttesterSlashings: 1,
+			NumVoluntaryExits:    4,
+			VoluntaryExitIndices: []uint64{3},
+			Seed:                 seed,
+		}
+		block, err := GenerateFullBlock(genesisState, privs, conf, genesisState.Slot())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		affected := make(map[uint64]bool)
+		markAffected := func(idx uint64) {
+			if affected[idx] {
+				t.Errorf("Expected validator %d to be used once with seed %d", idx, seed)
+			}
+			affected[idx] = true
+		}
+		for _, slashing := range block.Block.Body.ProposerSlashings {
+			markAffected(slashing.ProposerIndex)
+		}
+		for _, slashing := range block.Block.Body.AttesterSlashings {
+			markAffected(slashing.Attestation_1.AttestingIndices[0])
+		}
+		for _, exit := range block.Block.Body.VoluntaryExits {
+			markAffected(exit.Exit.ValidatorIndex)
+		}
+
+		if _, err := state.ExecuteStateTransition(context.Background(), genesisState.Copy(), block); err != nil {
+			t.Errorf("Block generated with seed %d failed the state transition: %v", seed, err)
+		}
+	}
+}
+
+func TestGenerateFullBlock_NotEnoughDistinctValidators(t *testing.T) {
+	params.OverrideBeaconConfig(params.MinimalSpecConfig())
+	defer params.OverrideBeaconConfig(params.MainnetConfig())
+	beaconState, privs := DeterministicGenesisState(t, 8)
+	conf := &BlockGenConfig{
+		NumProposerSlashings: 9,
+	}
+	if _, err := GenerateFullBlock(beaconState, privs, conf, beaconState.Slot()); err == nil {
+		t.Error("Expected error when requesting more slashings than active validators")
+	}
+
+	conf = &BlockGenConfig{
+		NumProposerSlashings:    1,
+		ProposerSlashingIndices: []uint64{2},
+		NumVoluntaryExits:       1,
+		VoluntaryExitIndices:    []uint64{2},
+	}
+	if _, err := GenerateFullBlock(beaconState, privs, conf, beaconState.Slot()); err == nil {
+		t.Error("Expected error when requesting the same validator for a slashing and an exit")
+	}
+}
+
+func TestGenerateFullBlockWithState_MatchesStateTransition(t *testing.T) {
+	params.OverrideBeaconConfig(params.MinimalSpecConfig())
+	defer params.OverrideBeaconConfig(params.MainnetConfig())
+	beaconState, privs := DeterministicGenesisState(t, 64)
+	conf := &BlockGenConfig{
+		NumAttestations: 1,
+	}
+	block, postState, err := GenerateFullBlockWithState(beaconState, privs, conf, beaconState.Slot())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if beaconState.Slot() != 0 {
+		t.Errorf("Expected given state to be unchanged, received slot %d", beaconState.Slot())
+	}
+	wantedState, err := state.ExecuteStateTransition(context.Background(), beaconState.Copy(), block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantedRoot, err := wantedState.HashTreeRoot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := postState.HashTreeRoot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if root != wantedRoot {
+		t.Errorf("Expected post state root %#x, received %#x", wantedRoot, root)
+	}
+	if !bytes.Equal(block.Block.StateRoot, root[:]) {
+		t.Errorf("Expected block state root %#x, received %#x", root, block.Block.StateRoot)
+	}
+}
+
+func TestNewBlockGenConfig(t *testing.T) {
+	conf, err := NewBlockGenConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(conf, DefaultBlockGenConfig()) {
+		t.Errorf("Expected default config %v, received %v", DefaultBlockGenConfig(), conf)
+	}
+
+	graffiti := []byte("graffiti")
+	conf, err = NewBlockGenConfig(
+		WithNumAttestations(2),
+		WithNumDeposits(1),
+		WithNumProposerSlashings(1),
+		WithNumAttesterSlashings(1),
+		WithNumVoluntaryExits(1),
+		WithSeed(42),
+		WithGraffiti(graffiti),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wanted := &BlockGenConfig{
+		NumAttestations:      2,
+		NumDeposits:          1,
+		NumProposerSlashings: 1,
+		NumAttesterSlashings: 1,
+		NumVoluntaryExits:    1,
+		Seed:                 42,
+		Graffiti:             graffiti,
+	}
+	if !reflect.DeepEqual(conf, wanted) {
+		t.Errorf("Expected config %v, received %v", wanted, conf)
+	}
+}
+
+func TestBlockGenConfig_Validate(t *testing.T) {
+	tests := []struct {
+		field string
+		conf  *BlockGenConfig
+	}{
+		{field: "NumAttestations", conf: &BlockGenConfig{
+			NumAttestations: 1,
+			Attestations:    make([]*ethpb.Attestation, params.BeaconConfig().MaxAttestations),
+		}},
+		{field: "NumDeposits", conf: &BlockGenConfig{NumDeposits: 1, TopUpDeposits: params.BeaconConfig().MaxDeposits}},
+		{field: "NumVoluntaryExits", conf: &BlockGenConfig{NumVoluntaryExits: params.BeaconConfig().MaxVoluntaryExits + 1}},
+		{field: "ForkVersion", conf: &BlockGenConfig{ForkVersion: []byte{1}}},
+		{field: "AttestationSlotOffset", conf: &BlockGenConfig{AttestationSlotOffset: params.BeaconConfig().SlotsPerEpoch + 1}},
+	}
+	for _, tt := range tests {
+		if err := tt.conf.Validate(); err == nil || !strings.Contains(err.Error(), tt.field) {
+			t.Errorf("Expected error naming %s, received %v", tt.field, err)
+		}
+	}
+	if err := DefaultBlockGenConfig().Validate(); err != nil {
+		t.Errorf("Expected the default config to be valid: %v", err)
+	}
+
+	beaconState, privs := DeterministicGenesisState(t, 64)
+	conf := &BlockGenConfig{NumDeposits: params.BeaconConfig().MaxDeposits + 1}
+	if _, err := GenerateFullBlock(beaconState, privs, conf, beaconState.Slot()); err == nil || !strings.Contains(err.Error(), "NumDeposits") {
+		t.Errorf("Expected generation to fail on the invalid config, received %v", err)
+	}
+}
+
+func TestNewBlockGenConfig_ExceedsBlockLimits(t *testing.T) {
+	tests := []struct {
+		name string
+		opt  BlockGenOption
+	}{
+		{name: "attestations", opt: WithNumAttestations(params.BeaconConfig().MaxAttestations + 1)},
+		{name: "deposits", opt: WithNumDeposits(params.BeaconConfig().MaxDeposits + 1)},
+		{name: "proposer slashings", opt: WithNumProposerSlashings(params.BeaconConfig().MaxProposerSlashings + 1)},
+		{name: "attester slashings", opt: WithNumAttesterSlashings(params.BeaconConfig().MaxAttesterSlashings + 1)},
+		{name: "voluntary exits", opt: WithNumVoluntaryExits(params.BeaconConfig().MaxVoluntaryExits + 1)},
+		{name: "graffiti", opt: WithGraffiti(make([]byte, 33))},
+	}
+	for _, tt := range tests {
+		if _, err := NewBlockGenConfig(tt.opt); err == nil || !strings.Contains(err.Error(), tt.name) {
+			t.Errorf("Expected error about %s, received %v", tt.name, err)
+		}
+	}
+}
+
+func TestGenerateAttestation_PartialParticipation(t *testing.T) {
+	params.OverrideBeaconConfig(params.MinimalSpecConfig())
+	defer params.OverrideBeaconConfig(params.MainnetConfig())
+	beaconState, privs := DeterministicGenesisState(t, 64)
+	beaconState, err := state.ProcessSlots(context.Background(), beaconState, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slot, committeeIndex := uint64(2), uint64(1)
+	att, err := GenerateAttestation(beaconState, privs, slot, committeeIndex, []uint64{0, 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	committee, err := helpers.BeaconCommitteeFromState(beaconState, slot, committeeIndex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if att.AggregationBits.Len() != uint64(len(committee)) {
+		t.Errorf("Expected aggregation bits of length %d, received %d", len(committee), att.AggregationBits.Len())
+	}
+	for i := uint64(0); i < att.AggregationBits.Len(); i++ {
+		if wanted := i == 0 || i == 2; att.AggregationBits.BitAt(i) != wanted {
+			t.Errorf("Expected bit %d to be %t", i, wanted)
+		}
+	}
+	if err := blocks.VerifyAttestation(context.Background(), beaconState, att); err != nil {
+		t.Errorf("Expected attestation to verify: %v", err)
+	}
+}
+
+func TestGenerateAttestationWithBits_NonContiguous(t *testing.T) {
+	params.OverrideBeaconConfig(params.MinimalSpecConfig())
+	defer params.OverrideBeaconConfig(params.MainnetConfig())
+	beaconState, privs := DeterministicGenesisState(t, 64)
+	beaconState, err := state.ProcessSlots(context.Background(), beaconState, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bits := bitfield.NewBitlist(4)
+	bits.SetBitAt(0, true)
+	bits.SetBitAt(3, true)
+	att, err := GenerateAttestationWithBits(beaconState, privs, 2, 1, bits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(att.AggregationBits, bits) {
+		t.Errorf("Expected aggregation bits %#x, received %#x", bits, att.AggregationBits)
+	}
+	if err := blocks.VerifyAttestation(context.Background(), beaconState, att); err != nil {
+		t.Errorf("Expected attestation to verify: %v", err)
+	}
+
+	if _, err := GenerateAttestationWithBits(beaconState, privs, 2, 1, bitfield.NewBitlist(4)); err == nil {
+		t.Error("Expected error for aggregation bits without participants")
+	}
+	longBits := bitfield.NewBitlist(8)
+	longBits.SetBitAt(0, true)
+	if _, err := GenerateAttestationWithBits(beaconState, privs, 2, 1, longBits); err == nil {
+		t.Error("Expected error for aggregation bits longer than the committee")
+	}
+}
+
+func TestGenerateAggregateAndProof(t *testing.T) {
+	params.OverrideBeaconConfig(params.MinimalSpecConfig())
+	defer params.OverrideBeaconConfig(params.MainnetConfig())
+	beaconState, privs := DeterministicGenesisState(t, 64)
+	beaconState, err := state.ProcessSlots(context.Background(), beaconState, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slot, committeeIndex := uint64(2), uint64(1)
+	aggregateAndProof, err := GenerateAggregateAndProof(beaconState, privs, slot, committeeIndex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	committee, err := helpers.BeaconCommitteeFromState(beaconState, slot, committeeIndex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aggregate := aggregateAndProof.Aggregate
+	if aggregate.AggregationBits.Count() != uint64(len(committee)) {
+		t.Errorf("Expected all %d committee members to attest, received %d", len(committee), aggregate.AggregationBits.Count())
+	}
+	if err := blocks.VerifyAttestation(context.Background(), beaconState, aggregate); err != nil {
+		t.Errorf("Expected aggregate to verify: %v", err)
+	}
+
+	inCommittee := false
+	for _, idx := range committee {
+		inCommittee = inCommittee || idx == aggregateAndProof.AggregatorIndex
+	}
+	if !inCommittee {
+		t.Errorf("Expected aggregator %d to be in committee %v", aggregateAndProof.AggregatorIndex, committee)
+	}
+	isAggregator, err := helpers.IsAggregator(uint64(len(committee)), aggregateAndProof.SelectionProof)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isAggregator {
+		t.Error("Expected selection proof to select an aggregator")
+	}
+	slotRoot, err := ssz.HashTreeRoot(slot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err := bls.SignatureFromBytes(aggregateAndProof.SelectionProof)
+	if err != nil {
+		t.Fatal(err)
+	}
+	domain := helpers.Domain(beaconState.Fork(), helpers.SlotToEpoch(slot), params.BeaconConfig().DomainBeaconAttester)
+	if !sig.Verify(slotRoot[:], privs[aggregateAndProof.AggregatorIndex].PublicKey(), domain) {
+		t.Error("Expected selection proof signed by the aggregator")
+	}
+}
+
+func TestGenerateAttestation_InvalidParticipation(t *testing.T) {
+	params.OverrideBeaconConfig(params.MinimalSpecConfig())
+	defer params.OverrideBeaconConfig(params.MainnetConfig())
+	beaconState, privs := DeterministicGenesisState(t, 64)
+	beaconState, err := state.ProcessSlots(context.Background(), beaconState, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := GenerateAttestation(beaconState, privs, 2, 0, nil); err == nil {
+		t.Error("Expected error for an attestation without participants")
+	}
+	if _, err := GenerateAttestation(beaconState, privs, 2, 0, []uint64{4}); err == nil {
+		t.Error("Expected error for a participant out of the committee")
+	}
+	if _, err := GenerateAttestation(beaconState, privs, 2, 2, []uint64{0}); err == nil {
+		t.Error("Expected error for a committee index out of range")
+	}
+}
+
+func TestGenerateAttestationsForSlot_IncludedLate(t *testing.T) {
+	params.OverrideBeaconConfig(params.MinimalSpecConfig())
+	defer params.OverrideBeaconConfig(params.MainnetConfig())
+	beaconState, privs := DeterministicGenesisState(t, 64)
+	for beaconState.Slot() < 5 {
+		block, err := GenerateFullBlock(beaconState, privs, &BlockGenConfig{}, beaconState.Slot())
+		if err != nil {
+			t.Fatal(err)
+		}
+		beaconState, err = state.ExecuteStateTransition(context.Background(), beaconState, block)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	attSlot := uint64(1)
+	atts, err := GenerateAttestationsForSlot(beaconState, privs, 2, attSlot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := &BlockGenConfig{
+		Attestations: atts,
+	}
+	block, err := GenerateFullBlock(beaconState, privs, conf, beaconState.Slot())
+	if err != nil {
+		t.Fatal(err)
+	}
+	beaconState, err = state.ExecuteStateTransition(context.Background(), beaconState, block)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pendingAtts := beaconState.CurrentEpochAttestations()
+	if len(pendingAtts) != len(atts) {
+		t.Fatalf("Expected %d pending attestations, received %d", len(atts), len(pendingAtts))
+	}
+	for _, pendingAtt := range pendingAtts {
+		if pendingAtt.InclusionDelay != block.Block.Slot-attSlot {
+			t.Errorf("Expected inclusion delay %d, received %d", block.Block.Slot-attSlot, pendingAtt.InclusionDelay)
+		}
+	}
+}
+
+func TestGenerateIndexedAttestation_Verifies(t *testing.T) {
+	params.OverrideBeaconConfig(params.MinimalSpecConfig())
+	defer params.OverrideBeaconConfig(params.MainnetConfig())
+	beaconState, privs := DeterministicGenesisState(t, 64)
+	beaconState, err := state.ProcessSlots(context.Background(), beaconState, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	indexedAtt, err := GenerateIndexedAttestation(beaconState, privs, 2, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	committee, err := helpers.BeaconCommitteeFromState(beaconState, 2, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(indexedAtt.AttestingIndices) != len(committee) {
+		t.Errorf("Expected %d attesting indices, received %d", len(committee), len(indexedAtt.AttestingIndices))
+	}
+	if err := blocks.VerifyIndexedAttestation(context.Background(), beaconState, indexedAtt); err != nil {
+		t.Errorf("Expected indexed attestation to verify: %v", err)
+	}
+}
+
+func TestGenerateAttestationsWithCheckpoints(t *testing.T) {
+	params.OverrideBeaconConfig(params.MinimalSpecConfig())
+	defer params.OverrideBeaconConfig(params.MainnetConfig())
+	beaconState, privs := DeterministicGenesisState(t, 64)
+	checkpoints := &AttestationCheckpoints{
+		Source: &ethpb.Checkpoint{Epoch: 0, Root: bytesutil.Bytes32(1)},
+		Target: &ethpb.Checkpoint{Epoch: 0, Root: bytesutil.Bytes32(2)},
+	}
+	atts, err := GenerateAttestationsWithCheckpoints(beaconState, privs, 4, 0, checkpoints)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, att := range atts {
+		if !proto.Equal(att.Data.Source, checkpoints.Source) {
+			t.Errorf("Expected source %v, received %v", checkpoints.Source, att.Data.Source)
+		}
+		if !proto.Equal(att.Data.Target, checkpoints.Target) {
+			t.Errorf("Expected target %v, received %v", checkpoints.Target, att.Data.Target)
+		}
+	}
+	if err := VerifyAttestations(beaconState, atts); err != nil {
+		t.Errorf("Expected attestations to be signed over the overridden checkpoints: %v", err)
+	}
+
+	defaultAtts, err := GenerateAttestations(beaconState, privs, 4, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	atts, err = GenerateAttestationsWithCheckpoints(beaconState, privs, 4, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range atts {
+		if !proto.Equal(atts[i], defaultAtts[i]) {
+			t.Errorf("Expected attestation %d without overrides to equal the default attestation", i)
+		}
+	}
+}
+
+func TestGenerateAttestationsVerbose_Signers(t *testing.T) {
+	params.OverrideBeaconConfig(params.MinimalSpecConfig())
+	defer params.OverrideBeaconConfig(params.MainnetConfig())
+	beaconState, privs := DeterministicGenesisState(t, 64)
+	atts, signers, err := GenerateAttestationsVerbose(beaconState, privs, 4, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(signers) != len(atts) {
+		t.Fatalf("Expected signers for %d attestations, received %d", len(atts), len(signers))
+	}
+	for i, att := range atts {
+		committee, err := helpers.BeaconCommitteeFromState(beaconState, att.Data.Slot, att.Data.CommitteeIndex)
+		if err != nil {
+			t.Fatal(err)
+		}
+		indices, err := attestationutil.AttestingIndices(att.AggregationBits, committee)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(signers[i]) != len(indices) {
+			t.Fatalf("Expected %d signers of attestation %d, received %d", len(indices), i, len(signers[i]))
+		}
+		dataRoot, err := ssz.HashTreeRoot(att.Data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		domain := helpers.Domain(beaconState.Fork(), att.Data.Target.Epoch, params.BeaconConfig().DomainBeaconAttester)
+		sigs := make([]*bls.Signature, len(signers[i]))
+		for j, signer := range signers[i] {
+			if signer.ValidatorIndex != indices[j] {
+				t.Errorf("Expected signer %d of attestation %d to be validator %d, received %d", j, i, indices[j], signer.ValidatorIndex)
+			}
+			if !signer.Signature.Verify(dataRoot[:], signer.PublicKey, domain) {
+				t.Errorf("Expected signature of validator %d to verify", signer.ValidatorIndex)
+			}
+			sigs[j] = signer.Signature
+		}
+		if !bytes.Equal(bls.AggregateSignatures(sigs).Marshal(), att.Signature) {
+			t.Errorf("Expected signers of attestation %d to aggregate into its signature", i)
+		}
+	}
+}
+
+func TestAggregateAttestations(t *testing.T) {
+	params.OverrideBeaconConfig(params.MinimalSpecConfig())
+	defer params.OverrideBeaconConfig(params.MainnetConfig())
+	beaconState, privs := DeterministicGenesisState(t, 64)
+	beaconState, err := state.ProcessSlots(context.Background(), beaconState, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := GenerateAttestation(beaconState, privs, 2, 0, []uint64{0, 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := GenerateAttestation(beaconState, privs, 2, 0, []uint64{2, 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := GenerateAttestation(beaconState, privs, 2, 0, []uint64{0, 1, 2, 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	aggregate, err := AggregateAttestations([]*ethpb.Attestation{first, second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !proto.Equal(aggregate, want) {
+		t.Errorf("Expected aggregate %v, received %v", want, aggregate)
+	}
+	if err := VerifyAttestations(beaconState, []*ethpb.Attestation{aggregate}); err != nil {
+		t.Errorf("Expected aggregate to verify: %v", err)
+	}
+
+	if _, err := AggregateAttestations([]*ethpb.Attestation{first, want}); err == nil {
+		t.Error("Expected error for overlapping aggregation bits")
+	}
+	other, err := GenerateAttestation(beaconState, privs, 2, 1, []uint64{2, 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := AggregateAttestations([]*ethpb.Attestation{first, other}); err == nil {
+		t.Error("Expected error for different attestation data")
+	}
+}
+
+func TestGenerateBlockBody_MatchesFullBlock(t *testing.T) {
+	params.OverrideBeaconConfig(params.MinimalSpecConfig())
+	defer params.OverrideBeaconConfig(params.MainnetConfig())
+	beaconState, privs := DeterministicGenesisState(t, 64)
+	conf := &BlockGenConfig{
+		NumProposerSlashings: 1,
+		NumAttestations:      1,
+		Graffiti:             []byte("body"),
+	}
+	body, err := GenerateBlockBody(beaconState, privs, conf, beaconState.Slot())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if beaconState.Slot() != 0 {
+		t.Errorf("Expected given state to be unchanged, received slot %d", beaconState.Slot())
+	}
+	block, err := GenerateFullBlock(beaconState, privs, conf, beaconState.Slot())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !proto.Equal(body, block.Block.Body) {
+		t.Errorf("Expected body %v, received %v", block.Block.Body, body)
+	}
+
+	bodyState, err := state.ProcessSlots(context.Background(), beaconState.Copy(), block.Block.Slot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bodyState, err = blocks.ProcessRandao(bodyState, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := state.ProcessOperations(context.Background(), bodyState, body); err != nil {
+		t.Errorf("Expected operations of the body to be valid: %v", err)
+	}
+}
+
+func TestGenerateFullBlockWithHeadState_MatchesGenerateFullBlock(t *testing.T) {
+	params.OverrideBeaconConfig(params.MinimalSpecConfig())
+	defer params.OverrideBeaconConfig(params.MainnetConfig())
+	beaconState, privs := DeterministicGenesisState(t, 64)
+	conf := &BlockGenConfig{NumAttestations: 1}
+	want, err := GenerateFullBlock(beaconState, privs, conf, beaconState.Slot())
+	if err != nil {
+		t.Fatal(err)
+	}
+	headState, err := state.ProcessSlots(context.Background(), beaconState.Copy(), want.Block.Slot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := GenerateFullBlockWithHeadState(beaconState, headState, privs, conf, beaconState.Slot())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !proto.Equal(block, want) {
+		t.Errorf("Expected block %v, received %v", want, block)
+	}
+	if headState.Slot() != want.Block.Slot {
+		t.Error("Expected the head state to not be mutated")
+	}
+
+	if _, err := GenerateFullBlockWithHeadState(beaconState, beaconState, privs, conf, beaconState.Slot()); err == nil {
+		t.Error("Expected error for a head state which isn't at the block slot")
+	}
+}
+
+func TestGenerateFullBlockWithState_SkipStateRoot(t *testing.T) {
+	beaconState, privs := DeterministicGenesisState(t, 64)
+	conf := &BlockGenConfig{
+		NumAttestations: 1,
+		SkipStateRoot:   true,
+	}
+	block, postState, err := GenerateFullBlockWithState(beaconState, privs, conf, beaconState.Slot())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if postState != nil {
+		t.Error("Expected no post state for a block without a state root")
+	}
+	if !bytes.Equal(block.Block.StateRoot, params.BeaconConfig().ZeroHash[:]) {
+		t.Errorf("Expected zero state root, received %#x", block.Block.StateRoot)
+	}
+
+	conf.SkipStateRoot = false
+	fullBlock, err := GenerateFullBlock(beaconState, privs, conf, beaconState.Slot())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !proto.Equal(block.Block.Body, fullBlock.Block.Body) {
+		t.Errorf("Expected body %v, received %v", fullBlock.Block.Body, block.Block.Body)
+	}
+	// Everything but the state root is valid.
+	AssertTransitionError(t, beaconState, block, "validate state root failed")
+}
+
+func TestGenerateFullBlock_CorruptStateRoot(t *testing.T) {
+	beaconState, privs := DeterministicGenesisState(t, 64)
+	conf := &BlockGenConfig{
+		Corruption: CorruptStateRoot,
+	}
+	block, err := GenerateFullBlock(beaconState, privs, conf, beaconState.Slot())
+	if err != nil {
+		t.Fatal(err)
+	}
+	AssertTransitionError(t, beaconState, block, "validate state root failed")
+}
+
+func TestGenerateFullBlock_ForkVersion(t *testing.T) {
+	params.OverrideBeaconConfig(params.MinimalSpecConfig())
+	defer params.OverrideBeaconConfig(params.MainnetConfig())
+	beaconState, privs := DeterministicGenesisState(t, 64)
+	forkVersion := []byte{1, 2, 3, 4}
+	conf := &BlockGenConfig{
+		NumAttestations: 1,
+		ForkVersion:     forkVersion,
+	}
+	block, err := GenerateFullBlock(beaconState, privs, conf, beaconState.Slot())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := state.ExecuteStateTransition(context.Background(), beaconState.Copy(), block); err == nil {
+		t.Error("Expected a block signed under another fork to fail verification")
+	}
+
+	forkState := beaconState.Copy()
+	if err := forkState.SetFork(&pb.Fork{PreviousVersion: forkVersion, CurrentVersion: forkVersion}); err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyAttestations(forkState, block.Block.Body.Attestations); err != nil {
+		t.Errorf("Expected attestations signed under the given fork: %v", err)
+	}
+	if err := forkState.SetSlot(block.Block.Slot); err != nil {
+		t.Fatal(err)
+	}
+	proposerIdx, err := helpers.BeaconProposerIndex(forkState)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubKey := privs[proposerIdx].PublicKey()
+	epoch := helpers.CurrentEpoch(forkState)
+	sig, err := bls.SignatureFromBytes(block.Signature)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blockRoot, err := ssz.HashTreeRoot(block.Block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sig.Verify(blockRoot[:], pubKey, helpers.Domain(forkState.Fork(), epoch, params.BeaconConfig().DomainBeaconProposer)) {
+		t.Error("Expected block signed under the given fork")
+	}
+	reveal, err := bls.SignatureFromBytes(block.Block.Body.RandaoReveal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	epochRoot := bytesutil.Bytes32(epoch)
+	if !reveal.Verify(epochRoot, pubKey, helpers.Domain(forkState.Fork(), epoch, params.BeaconConfig().DomainRandao)) {
+		t.Error("Expected RANDAO reveal signed under the given fork")
+	}
+
+	conf.ForkVersion = []byte{1}
+	if _, err := GenerateFullBlock(beaconState, privs, conf, beaconState.Slot()); err == nil {
+		t.Error("Expected error for a fork version which isn't 4 bytes")
+	}
+}
+
+func TestGenerateFullBlock_Unsigned(t *testing.T) {
+	beaconState, privs := DeterministicGenesisState(t, 64)
+	conf := &BlockGenConfig{
+		NumAttestations: 1,
+		Unsigned:        true,
+	}
+	block, err := GenerateFullBlock(beaconState, privs, conf, beaconState.Slot())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(block.Block.Body.RandaoReveal, PlaceholderRandaoReveal()) {
+		t.Errorf("Expected placeholder RANDAO reveal, received %#x", block.Block.Body.RandaoReveal)
+	}
+	if len(PlaceholderRandaoReveal()) != params.BeaconConfig().BLSSignatureLength {
+		t.Errorf("Expected placeholder RANDAO reveal of %d bytes, received %d", params.BeaconConfig().BLSSignatureLength, len(PlaceholderRandaoReveal()))
+	}
+	zeroSig := make([]byte, params.BeaconConfig().BLSSignatureLength)
+	if !bytes.Equal(block.Signature, zeroSig) {
+		t.Errorf("Expected zero-filled block signature, received %#x", block.Signature)
+	}
+	AssertBlockSSZRoundTrip(t, block)
+
+	// The block is valid when its signatures are not verified.
+	root, err := state.CalculateStateRoot(context.Background(), beaconState.Copy(), block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(root[:], block.Block.StateRoot) {
+		t.Errorf("Expected state root %#x, received %#x", root, block.Block.StateRoot)
+	}
+	if _, err := state.ExecuteStateTransition(context.Background(), beaconState.Copy(), block); err == nil {
+		t.Error("Expected an unsigned block to fail signature verification")
+	}
+
+	block.Block.Body.RandaoReveal[0] = 1
+	if PlaceholderRandaoReveal()[0] != 0 {
+		t.Error("Expected modifying a generated reveal to leave the placeholder unchanged")
+	}
+}
+
+func TestGenerateFullBlock_CorruptAttestationSignature(t *testing.T) {
+	params.OverrideBeaconConfig(params.MinimalSpecConfig())
+	defer params.OverrideBeaconConfig(params.MainnetConfig())
+	beaconState, privs := DeterministicGenesisState(t, 64)
+	conf := &BlockGenConfig{
+		NumAttestations: 2,
+		Corruption:      CorruptAttestationSignature,
+	}
+	block, err := GenerateFullBlock(beaconState, privs, conf, beaconState.Slot())
+	if err != nil {
+		t.Fatal(err)
+	}
+	atts := block.Block.Body.Attestations
+	if err := blocks.VerifyAttestation(context.Background(), beaconState, atts[0]); err != blocks.ErrSigFailedToVerify {
+		t.Errorf("Expected first attestation signature to fail verification, received %v", err)
+	}
+	if err := blocks.VerifyAttestation(context.Background(), beaconState, atts[1]); err != nil {
+		t.Errorf("Expected second attestation to verify: %v", err)
+	}
+	AssertTransitionError(t, beaconState, block, blocks.ErrSigFailedToVerify.Error())
+
+	conf.NumAttestations = 0
+	if _, err := GenerateFullBlock(beaconState, privs, conf, beaconState.Slot()); err == nil {
+		t.Error("Expected error when corrupting the signature of a block without attestations")
+	}
+}
+
+func TestExpectedBalanceDeltas_MatchesStateTransition(t *testing.T) {
+	params.OverrideBeaconConfig(params.MinimalSpecConfig())
+	defer params.OverrideBeaconConfig(params.MainnetConfig())
+	beaconState, privs := DeterministicGenesisState(t, 64)
+	conf := &BlockGenConfig{
+		NumProposerSlashings: 2,
+		NumAttesterSlashings: 1,
+		NumAttestations:      1,
+		NumDeposits:          2,
+		TopUpDeposits:        1,
+	}
+	block, err := GenerateFullBlock(beaconState, privs, conf, beaconState.Slot())
+	if err != nil {
+		t.Fatal(err)
+	}
+	deltas, err := ExpectedBalanceDeltas(beaconState, block.Block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deltas) == 0 {
+		t.Fatal("Expected balance deltas for a block with slashings and deposits")
+	}
+
+	preState, err := state.ProcessSlots(context.Background(), beaconState.Copy(), block.Block.Slot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	postState, err := state.ExecuteStateTransition(context.Background(), beaconState.Copy(), block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	preBalances := preState.Balances()
+	for i, balance := range postState.Balances() {
+		var want int64
+		if i < len(preBalances) {
+			want = int64(preBalances[i])
+		}
+		want += deltas[uint64(i)]
+		if int64(balance) != want {
+			t.Errorf("Expected balance %d of validator %d, received %d", want, i, balance)
+		}
+	}
+}
+
+func TestGenerateAttesterSlashings_SmallValidatorSet(t *testing.T) {
+	params.OverrideBeaconConfig(params.MinimalSpecConfig())
+	defer params.OverrideBeaconConfig(params.MainnetConfig())
+	beaconState, privs := DeterministicGenesisState(t, 8)
+	for seed := int64(0); seed < 8; seed++ {
+		conf := &BlockGenConfig{
+			NumAttesterSlashings: 1,
+			Seed:                 seed,
+		}
+		block, err := GenerateFullBlock(beaconState, privs, conf, beaconState.Slot())
+		if err != nil {
+			t.Fatal(err)
+		}
+		sameSeedBlock, err := GenerateFullBlock(beaconState, privs, conf, beaconState.Slot())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !proto.Equal(block.Block.Body.AttesterSlashings[0], sameSeedBlock.Block.Body.AttesterSlashings[0]) {
+			t.Errorf("Expected the same attester slashing for seed %d", seed)
+		}
+		if _, err := state.ExecuteStateTransition(context.Background(), beaconState.Copy(), block); err != nil {
+			t.Errorf("Block generated with seed %d failed the state transition: %v", seed, err)
+		}
+	}
+}
+
+func TestGenerateFullBlock_CanonicalOperationOrder(t *testing.T) {
+	params.OverrideBeaconConfig(params.MinimalSpecConfig())
+	defer params.OverrideBeaconConfig(params.MainnetConfig())
+	beaconState, privs := DeterministicGenesisState(t, 64)
+	if err := beaconState.SetSlot(3 + params.BeaconConfig().PersistentCommitteePeriod*params.BeaconConfig().SlotsPerEpoch); err != nil {
+		t.Fatal(err)
+	}
+	conf := &BlockGenConfig{
+		NumProposerSlashings:    4,
+		NumVoluntaryExits:       4,
+		ProposerSlashingIndices: []uint64{40, 9},
+		VoluntaryExitIndices:    []uint64{30, 2},
+		Seed:                    7,
+	}
+	block, err := GenerateFullBlock(beaconState, privs, conf, beaconState.Slot())
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := block.Block.Body
+	for i := 1; i < len(body.ProposerSlashings); i++ {
+		if body.ProposerSlashings[i-1].ProposerIndex > body.ProposerSlashings[i].ProposerIndex {
+			t.Errorf("Expected proposer slashings sorted by proposer index, received %d before %d",
+				body.ProposerSlashings[i-1].ProposerIndex, body.ProposerSlashings[i].ProposerIndex)
+		}
+	}
+	for i := 1; i < len(body.VoluntaryExits); i++ {
+		if body.VoluntaryExits[i-1].Exit.ValidatorIndex > body.VoluntaryExits[i].Exit.ValidatorIndex {
+			t.Errorf("Expected voluntary exits sorted by validator index, received %d before %d",
+				body.VoluntaryExits[i-1].Exit.ValidatorIndex, body.VoluntaryExits[i].Exit.ValidatorIndex)
+		}
+	}
+
+	sameSeedBlock, err := GenerateFullBlock(beaconState, privs, conf, beaconState.Slot())
+	if err != nil {
+		t.Fatal(err)
+	}
+	bodyRoot, err := ssz.HashTreeRoot(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sameSeedRoot, err := ssz.HashTreeRoot(sameSeedBlock.Block.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bodyRoot != sameSeedRoot {
+		t.Errorf("Expected body root %#x, received %#x", bodyRoot, sameSeedRoot)
+	}
+	if _, err := state.ExecuteStateTransition(context.Background(), beaconState, block); err != nil {
+		t.Errorf("Expected block with sorted operations to be valid: %v", err)
+	}
+}
+
+func TestSortBlockOperations_AttesterSlashings(t *testing.T) {
+	slashing := func(firstIndex uint64) *ethpb.AttesterSlashing {
+		return &ethpb.AttesterSlashing{
+			Attestation_1: &ethpb.IndexedAttestation{AttestingIndices: []uint64{firstIndex, firstIndex + 1}},
+		}
+	}
+	aSlashings := []*ethpb.AttesterSlashing{slashing(12), slashing(3), slashing(7)}
+	sortBlockOperations(nil, aSlashings, nil)
+	for i, want := range []uint64{3, 7, 12} {
+		if idx := aSlashings[i].Attestation_1.AttestingIndices[0]; idx != want {
+			t.Errorf("Expected attester slashing %d to start with index %d, received %d", i, want, idx)
+		}
+	}
+}
+
+func TestGenerateAttesterSlashings_CommitteeOfSlot(t *testing.T) {
+	// With the mainnet config, MAX_COMMITTEES_PER_SLOT is far above the single committee
+	// per slot of a small validator set.
+	beaconState, privs := DeterministicGenesisState(t, 256)
+	activeCount, err := helpers.ActiveValidatorCount(beaconState, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	committeeCount := helpers.SlotCommitteeCount(activeCount)
+	if committeeCount >= params.BeaconConfig().MaxCommitteesPerSlot {
+		t.Fatalf("Expected fewer than %d committees, received %d", params.BeaconConfig().MaxCommitteesPerSlot, committeeCount)
+	}
+	members := make(map[uint64]bool)
+	for c := uint64(0); c < committeeCount; c++ {
+		committee, err := helpers.BeaconCommitteeFromState(beaconState, beaconState.Slot(), c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, idx := range committee {
+			members[idx] = true
+		}
+	}
+
+	for seed := int64(0); seed < 8; seed++ {
+		conf := &BlockGenConfig{
+			NumAttesterSlashings: 1,
+			Seed:                 seed,
+		}
+		block, err := GenerateFullBlock(beaconState, privs, conf, beaconState.Slot())
+		if err != nil {
+			t.Fatalf("Could not generate attester slashing with seed %d: %v", seed, err)
+		}
+		slashed := SlashedValidatorIndices(block.Block.Body)
+		if len(slashed) != 1 || !members[slashed[0]] {
+			t.Errorf("Expected a member of the committees of slot %d to be slashed, received %v", beaconState.Slot(), slashed)
+		}
+	}
+}
+
+func TestGenerateFullBlock_TopUpDeposits(t *testing.T) {
+	beaconState, privs := DeterministicGenesisState(t, 64)
+	conf := &BlockGenConfig{
+		NumDeposits:   1,
+		TopUpDeposits: 2,
+	}
+	// Deposits are only processed against the eth1 data of the state, so the state is
+	// given the eth1 data of the generated deposits before generating the block again.
+	block, err := GenerateFullBlock(beaconState, privs, conf, beaconState.Slot())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := beaconState.SetEth1Data(block.Block.Body.Eth1Data); err != nil {
+		t.Fatal(err)
+	}
+	block, err = GenerateFullBlock(beaconState, privs, conf, beaconState.Slot())
+	if err != nil {
+		t.Fatal(err)
+	}
+	deposits := block.Block.Body.Deposits
+	if len(deposits) != 3 {
+		t.Fatalf("Expected 3 deposits, received %d", len(deposits))
+	}
+
+	topUpBalances := make(map[uint64]uint64)
+	for _, deposit := range deposits[1:] {
+		idx, ok := beaconState.ValidatorIndexByPubkey(bytesutil.ToBytes48(deposit.Data.PublicKey))
+		if !ok {
+			t.Fatalf("Expected top up deposit of an existing validator, received pubkey %#x", deposit.Data.PublicKey)
+		}
+		balance, err := beaconState.BalanceAtIndex(idx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		topUpBalances[idx] = balance
+	}
+	for _, deposit := range deposits[1:] {
+		idx, _ := beaconState.ValidatorIndexByPubkey(bytesutil.ToBytes48(deposit.Data.PublicKey))
+		topUpBalances[idx] += deposit.Data.Amount
+	}
+
+	beaconState, err = state.ExecuteStateTransition(context.Background(), beaconState, block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if beaconState.NumValidators() != 65 {
+		t.Errorf("Expected only the new deposit to register a validator, received %d validators", beaconState.NumValidators())
+	}
+	for idx, wanted := range topUpBalances {
+		balance, err := beaconState.BalanceAtIndex(idx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if balance != wanted {
+			t.Errorf("Expected balance %d of validator %d, received %d", wanted, idx, balance)
+		}
+	}
+}
+
+func TestGenerateStateWithEffectiveBalance_SlashingBalanceDeltas(t *testing.T) {
+	genesisState, privs := DeterministicGenesisState(t, 64)
+	effectiveBalance := params.BeaconConfig().MaxEffectiveBalance / 2
+	// The effective balance takes part in proposer selection, so the proposer is looked up
+	// after pinning it, and a validator other than the proposer is slashed.
+	var beaconState *stateTrie.BeaconState
+	var slashedIdx, proposerIdx uint64
+	for idx := uint64(0); beaconState == nil; idx++ {
+		pinnedState, err := GenerateStateWithEffectiveBalance(genesisState, []uint64{idx}, effectiveBalance)
+		if err != nil {
+			t.Fatal(err)
+		}
+		schedule, err := ProposerSchedule(pinnedState)
+		if err != nil {
+			t.Fatal(err)
+		}
+		proposerIdx = schedule[(pinnedState.Slot()+1)%params.BeaconConfig().SlotsPerEpoch]
+		if proposerIdx != idx {
+			beaconState = pinnedState
+			slashedIdx = idx
+		}
+	}
+
+	conf := &BlockGenConfig{
+		NumProposerSlashings:    1,
+		ProposerSlashingIndices: []uint64{slashedIdx},
+	}
+	block, err := GenerateFullBlock(beaconState, privs, conf, beaconState.Slot())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if slashed := SlashedValidatorIndices(block.Block.Body); !reflect.DeepEqual(slashed, []uint64{slashedIdx}) {
+		t.Fatalf("Expected slashed validators %v, received %v", []uint64{slashedIdx}, slashed)
+	}
+	preSlashedBalance, err := beaconState.BalanceAtIndex(slashedIdx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	preProposerBalance, err := beaconState.BalanceAtIndex(proposerIdx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	beaconState, err = state.ExecuteStateTransition(context.Background(), beaconState, block)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	penalty := effectiveBalance / params.BeaconConfig().MinSlashingPenaltyQuotient
+	if balance, _ := beaconState.BalanceAtIndex(slashedIdx); balance != preSlashedBalance-penalty {
+		t.Errorf("Expected slashed validator balance %d, received %d", preSlashedBalance-penalty, balance)
+	}
+	// The proposer is also the whistleblower, so it receives the whole whistleblower reward.
+	reward := effectiveBalance / params.BeaconConfig().WhistleBlowerRewardQuotient
+	if balance, _ := beaconState.BalanceAtIndex(proposerIdx); balance != preProposerBalance+reward {
+		t.Errorf("Expected proposer balance %d, received %d", preProposerBalance+reward, balance)
+	}
+}
+
+func TestSlashedValidatorIndices_AttesterSlashing(t *testing.T) {
+	slashing := &ethpb.AttesterSlashing{
+		Attestation_1: &ethpb.IndexedAttestation{AttestingIndices: []uint64{1, 3, 5, 7}},
+		Attestation_2: &ethpb.IndexedAttestation{AttestingIndices: []uint64{2, 3, 7, 9}},
+	}
+	body := &ethpb.BeaconBlockBody{
+		ProposerSlashings: []*ethpb.ProposerSlashing{{ProposerIndex: 12}},
+		AttesterSlashings: []*ethpb.AttesterSlashing{slashing},
+	}
+	wanted := []uint64{12, 3, 7}
+	if indices := SlashedValidatorIndices(body); !reflect.DeepEqual(indices, wanted) {
+		t.Errorf("Expected slashed validators %v, received %v", wanted, indices)
+	}
+}
+
+func TestGenerateFullBlockWithAttestations(t *testing.T) {
+	beaconState, privs := DeterministicGenesisState(t, 64)
+	atts, err := GenerateAttestations(beaconState, privs, 2, beaconState.Slot(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := &BlockGenConfig{NumAttestations: 4}
+	block, err := GenerateFullBlockWithAttestations(beaconState, privs, conf, beaconState.Slot(), atts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(block.Block.Body.Attestations) != len(atts) {
+		t.Fatalf("Expected %d attestations, received %d", len(atts), len(block.Block.Body.Attestations))
+	}
+	for i, att := range atts {
+		if !proto.Equal(block.Block.Body.Attestations[i], att) {
+			t.Errorf("Expected attestation %d to be %v, received %v", i, att, block.Block.Body.Attestations[i])
+		}
+	}
+	if conf.NumAttestations != 4 {
+		t.Error("Expected the given config to be left unchanged")
+	}
+	if _, err := state.ExecuteStateTransition(context.Background(), beaconState, block); err != nil {
+		t.Errorf("Expected block with the given attestations to be valid: %v", err)
+	}
+
+	tooMany := make([]*ethpb.Attestation, params.BeaconConfig().MaxAttestations+1)
+	if _, err := GenerateFullBlockWithAttestations(beaconState, privs, nil, beaconState.Slot(), tooMany); err == nil {
+		t.Error("Expected error for more attestations than a block can contain")
+	}
+}
+
+func TestGenerateFullBlockFromParent(t *testing.T) {
+	params.OverrideBeaconConfig(params.MinimalSpecConfig())
+	defer params.OverrideBeaconConfig(params.MainnetConfig())
+	genesisState, privs := DeterministicGenesisState(t, 64)
+	first, postState, err := GenerateFullBlockWithState(genesisState, privs, nil, genesisState.Slot())
+	if err != nil {
+		t.Fatal(err)
+	}
+	firstRoot, err := ssz.HashTreeRoot(first.Block)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	child, err := GenerateFullBlockFromParent(postState, privs, nil, postState.Slot(), firstRoot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(child.Block.ParentRoot, firstRoot[:]) {
+		t.Errorf("Expected parent root %#x, received %#x", firstRoot, child.Block.ParentRoot)
+	}
+	if _, err := state.ExecuteStateTransition(context.Background(), postState.Copy(), child); err != nil {
+		t.Errorf("Expected child block to be valid: %v", err)
+	}
+
+	// A competing block at the slot of the child, branching off the genesis block.
+	genesisRoot := bytesutil.ToBytes32(first.Block.ParentRoot)
+	sibling, err := GenerateFullBlockFromParent(genesisState, privs, nil, child.Block.Slot, genesisRoot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sibling.Block.Slot != child.Block.Slot || !bytes.Equal(sibling.Block.ParentRoot, genesisRoot[:]) {
+		t.Errorf("Expected block at slot %d on top of %#x", child.Block.Slot, genesisRoot)
+	}
+	if _, err := state.ExecuteStateTransition(context.Background(), genesisState.Copy(), sibling); err != nil {
+		t.Errorf("Expected competing block to be valid: %v", err)
+	}
+
+	if _, err := GenerateFullBlockFromParent(genesisState, privs, nil, genesisState.Slot(), firstRoot); err == nil {
+		t.Error("Expected error for a parent root the state does not extend")
+	}
+}
+
+func TestGenerateDoubleProposal_IsSlashable(t *testing.T) {
+	params.OverrideBeaconConfig(params.MinimalSpecConfig())
+	defer params.OverrideBeaconConfig(params.MainnetConfig())
+	beaconState, privs := DeterministicGenesisState(t, 64)
+	block1, block2, err := GenerateDoubleProposal(beaconState, privs, beaconState.Slot())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if block1.Block.Slot != block2.Block.Slot {
+		t.Fatalf("Expected blocks at the same slot, received %d and %d", block1.Block.Slot, block2.Block.Slot)
+	}
+	header := func(block *ethpb.SignedBeaconBlock) *ethpb.SignedBeaconBlockHeader {
+		bodyRoot, err := ssz.HashTreeRoot(block.Block.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &ethpb.SignedBeaconBlockHeader{
+			Header: &ethpb.BeaconBlockHeader{
+				Slot:       block.Block.Slot,
+				ParentRoot: block.Block.ParentRoot,
+				StateRoot:  block.Block.StateRoot,
+				BodyRoot:   bodyRoot[:],
+			},
+			Signature: block.Signature,
+		}
+	}
+	header1, header2 := header(block1), header(block2)
+	if bytes.Equal(header1.Header.BodyRoot, header2.Header.BodyRoot) {
+		t.Error("Expected blocks with different body roots")
+	}
+
+	slotState, err := state.ProcessSlots(context.Background(), beaconState.Copy(), block1.Block.Slot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proposerIdx, err := helpers.BeaconProposerIndex(slotState)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slashing := &ethpb.ProposerSlashing{
+		ProposerIndex: proposerIdx,
+		Header_1:      header1,
+		Header_2:      header2,
+	}
+	if err := blocks.VerifyProposerSlashing(slotState, slashing); err != nil {
+		t.Errorf("Expected the double proposal to be a valid proposer slashing: %v", err)
+	}
+}
+
+func TestGenerateForkedBlocks(t *testing.T) {
+	params.OverrideBeaconConfig(params.MinimalSpecConfig())
+	defer params.OverrideBeaconConfig(params.MainnetConfig())
+	beaconState, privs := DeterministicGenesisState(t, 64)
+	conf := &BlockGenConfig{
+		NumAttestations: 2,
+	}
+	forks, err := GenerateForkedBlocks(beaconState, privs, conf, beaconState.Slot(), 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(forks) != 3 {
+		t.Fatalf("Expected 3 forked blocks, received %d", len(forks))
+	}
+
+	blockRoots := make(map[[32]byte]bool)
+	stateRoots := make(map[[32]byte]bool)
+	for i, block := range forks {
+		if block.Block.Slot != forks[0].Block.Slot {
+			t.Errorf("Expected forked block %d at slot %d, received %d", i, forks[0].Block.Slot, block.Block.Slot)
+		}
+		if !bytes.Equal(block.Block.ParentRoot, forks[0].Block.ParentRoot) {
+			t.Errorf("Expected forked block %d to share the parent root", i)
+		}
+		blockRoot, err := ssz.HashTreeRoot(block.Block)
+		if err != nil {
+			t.Fatal(err)
+		}
+		blockRoots[blockRoot] = true
+		stateRoots[bytesutil.ToBytes32(block.Block.StateRoot)] = true
+
+		if _, err := state.ExecuteStateTransition(context.Background(), beaconState.Copy(), block); err != nil {
+			t.Errorf("Forked block %d failed the state transition: %v", i, err)
+		}
+	}
+	if len(blockRoots) != len(forks) || len(stateRoots) != len(forks) {
+		t.Errorf("Expected distinct block and state roots, received %d block roots and %d state roots", len(blockRoots), len(stateRoots))
+	}
+	if conf.Graffiti != nil {
+		t.Error("Expected given config to be unchanged")
+	}
+}
+
+func TestGenerateFullBlock_DepositSignaturesVerify(t *testing.T) {
+	beaconState, privs := DeterministicGenesisState(t, 64)
+	eth1Credentials := make([]byte, 32)
+	eth1Credentials[0] = 0x01
+	conf := &BlockGenConfig{
+		NumDeposits:           2,
+		WithdrawalCredentials: [][]byte{eth1Credentials},
+		TopUpDeposits:         1,
+	}
+	block, err := GenerateFullBlock(beaconState, privs, conf, beaconState.Slot())
+	if err != nil {
+		t.Fatal(err)
+	}
+	domain := bls.ComputeDomain(params.BeaconConfig().DomainDeposit)
+	for i, deposit := range block.Block.Body.Deposits {
+		pubKey, err := bls.PublicKeyFromBytes(deposit.Data.PublicKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig, err := bls.SignatureFromBytes(deposit.Data.Signature)
+		if err != nil {
+			t.Fatal(err)
+		}
+		root, err := ssz.SigningRoot(deposit.Data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !sig.Verify(root[:], pubKey, domain) {
+			t.Errorf("Expected signature of deposit %d to verify", i)
+		}
+	}
+}
+
+func BenchmarkGenerateAttestations_100kValidators(b *testing.B) {
+	beaconState, privs := DeterministicGenesisState(b, 100000)
+	activeCount, err := helpers.ActiveValidatorCount(beaconState, 0)
+	if err != nil {
+		b.Fatal(err)
+	}
+	committeesPerSlot := helpers.SlotCommitteeCount(activeCount)
+	attestersPerSlot := activeCount / params.BeaconConfig().SlotsPerEpoch
+
+	// The cost of the domain computations saved by computing the domain once per
+	// generation pass rather than once per signing validator.
+	b.Run("domain per attester", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			for i := uint64(0); i < attestersPerSlot; i++ {
+				helpers.Domain(beaconState.Fork(), 0, params.BeaconConfig().DomainBeaconAttester)
+			}
+		}
+	})
+	b.Run("precomputed domain", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			helpers.Domain(beaconState.Fork(), 0, params.BeaconConfig().DomainBeaconAttester)
+		}
+	})
+	b.Run("generate attestations", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			if _, err := GenerateAttestations(beaconState, privs, committeesPerSlot, 0, false); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkBlockGenerator(b *testing.B) {
+	beaconState, privs := DeterministicGenesisState(b, 1024)
+	conf := &BlockGenConfig{NumAttestations: 1}
+	b.Run("GenerateFullBlock", func(b *testing.B) {
+		b.ReportAllocs()
+		for n := 0; n < b.N; n++ {
+			if _, err := GenerateFullBlock(beaconState, privs, conf, 1); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("BlockGenerator", func(b *testing.B) {
+		gen := NewBlockGenerator(beaconState, privs, conf)
+		b.ReportAllocs()
+		for n := 0; n < b.N; n++ {
+			if _, err := gen.Generate(1); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,290 @@
+package testutil
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/pkg/errors"
+	ethpb "github.com/prysmaticlabs/ethereumapis/eth/v1alpha1"
+	"github.com/prysmaticlabs/go-bitfield"
+	"github.com/prysmaticlabs/prysm/beacon-chain/core/epoch/precompute"
+	"github.com/prysmaticlabs/prysm/beacon-chain/core/helpers"
+	"github.com/prysmaticlabs/prysm/beacon-chain/core/state"
+	stateTrie "github.com/prysmaticlabs/prysm/beacon-chain/state"
+	"github.com/prysmaticlabs/prysm/shared/bls"
+	"github.com/prysmaticlabs/prysm/shared/params"
+)
+
+// finalizationEpochLimit is the amount of epochs past the requested epoch
+// the chain generator will produce blocks for before giving up on finality.
+const finalizationEpochLimit = 4
+
+// GenerateFullBlockChain generates numBlocks consecutive full blocks on top of the given
+// state, one per slot, running the state transition of each block before generating the
+// next so parent roots, state roots, proposers and committees all follow the chain across
+// epoch boundaries. The given state is not mutated, the blocks and the post state of the
+// last block are returned.
+func GenerateFullBlockChain(
+	bState *stateTrie.BeaconState,
+	privs []*bls.SecretKey,
+	conf *BlockGenConfig,
+	numBlocks uint64,
+) ([]*ethpb.SignedBeaconBlock, *stateTrie.BeaconState, error) {
+	bState = bState.Copy()
+	chain := make([]*ethpb.SignedBeaconBlock, numBlocks)
+	for i := range chain {
+		// Generating at the state slot yields a block at the next slot with attestations
+		// for the current slot, which stay in the same epoch as their target.
+		block, err := GenerateFullBlock(bState, privs, conf, bState.Slot())
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "could not generate block at slot %d", bState.Slot()+1)
+		}
+		bState, err = state.ExecuteStateTransition(context.Background(), bState, block)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "could not process block at slot %d", block.Block.Slot)
+		}
+		chain[i] = block
+	}
+	return chain, bState, nil
+}
+
+// StreamBlocks generates consecutive full blocks on top of the given state like
+// GenerateFullBlockChain, for as long as they are received from the returned channel. The
+// next block is only generated once the previous one is received, on an internal copy of
+// the state advanced by every block, so the given state is not mutated. The first block is
+// generated before returning, so an invalid config is reported by the returned error. The
+// channel is closed once the context is cancelled, or when generating a block fails, which
+// is logged.
+func StreamBlocks(
+	ctx context.Context,
+	bState *stateTrie.BeaconState,
+	privs []*bls.SecretKey,
+	conf *BlockGenConfig,
+) (<-chan *ethpb.SignedBeaconBlock, error) {
+	bState = bState.Copy()
+	next := func() (*ethpb.SignedBeaconBlock, error) {
+		block, postState, err := generateFullBlock(ctx, bState, nil, privs, conf, bState.Slot())
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not generate block at slot %d", bState.Slot()+1)
+		}
+		if postState == nil {
+			return nil, errors.New("blocks generated with the config have no post state to build on")
+		}
+		bState = postState
+		return block, nil
+	}
+	block, err := next()
+	if err != nil {
+		return nil, err
+	}
+
+	blocks := make(chan *ethpb.SignedBeaconBlock)
+	go func() {
+		defer close(blocks)
+		for {
+			select {
+			case blocks <- block:
+			case <-ctx.Done():
+				return
+			}
+			block, err = next()
+			if err != nil {
+				if ctx.Err() == nil {
+					log.Printf("Stopped streaming blocks: %v", err)
+				}
+				return
+			}
+		}
+	}()
+	return blocks, nil
+}
+
+// GenerateChainWithEth1DataVote generates consecutive full blocks on top of the given state,
+// all voting for the given eth1 data, until the votes reach a majority of the eth1 voting
+// period and the eth1 data becomes the eth1 data of the state. It fails when the voting
+// period ends before, as the votes are reset with each period. The given state is not
+// mutated, the blocks and the post state of the last block are returned.
+func GenerateChainWithEth1DataVote(
+	bState *stateTrie.BeaconState,
+	privs []*bls.SecretKey,
+	conf *BlockGenConfig,
+	eth1Data *ethpb.Eth1Data,
+) ([]*ethpb.SignedBeaconBlock, *stateTrie.BeaconState, error) {
+	voteConf := &BlockGenConfig{}
+	if conf != nil {
+		*voteConf = *conf
+	}
+	voteConf.Eth1Data = eth1Data
+
+	bState = bState.Copy()
+	periodLength := params.BeaconConfig().SlotsPerEth1VotingPeriod
+	periodEnd := bState.Slot() - bState.Slot()%periodLength + periodLength
+	chain := []*ethpb.SignedBeaconBlock{}
+	for !proto.Equal(bState.Eth1Data(), eth1Data) {
+		if bState.Slot()+1 >= periodEnd {
+			return nil, nil, fmt.Errorf("eth1 data did not reach a majority of votes by the end of the voting period at slot %d", periodEnd)
+		}
+		block, err := GenerateFullBlock(bState, privs, voteConf, bState.Slot())
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "could not generate block at slot %d", bState.Slot()+1)
+		}
+		bState, err = state.ExecuteStateTransition(context.Background(), bState, block)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "could not process block at slot %d", block.Block.Slot)
+		}
+		chain = append(chain, block)
+	}
+	return chain, bState, nil
+}
+
+// GenerateChainUntilFinalized generates consecutive full blocks on top of the given state
+// until the requested epoch is finalized and a later epoch has been justified on top of it.
+// This is the smallest chain for which the finalized checkpoint was established by the
+// justification and finalization rules, so for epoch 0 the returned chain is the canonical
+// minimal finalization fixture. The given state is not mutated, the blocks and the post
+// state of the last block are returned.
+func GenerateChainUntilFinalized(
+	bState *stateTrie.BeaconState,
+	privs []*bls.SecretKey,
+	conf *BlockGenConfig,
+	epoch uint64,
+) ([]*ethpb.SignedBeaconBlock, *stateTrie.BeaconState, error) {
+	bState = bState.Copy()
+	maxSlot := helpers.StartSlot(epoch + finalizationEpochLimit)
+	chain := []*ethpb.SignedBeaconBlock{}
+	for bState.FinalizedCheckpointEpoch() < epoch || bState.CurrentJustifiedCheckpoint().Epoch <= epoch {
+		if bState.Slot() >= maxSlot {
+			return nil, nil, fmt.Errorf("epoch %d was not finalized by slot %d", epoch, maxSlot)
+		}
+		block, err := GenerateFullBlock(bState, privs, conf, bState.Slot())
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "could not generate block at slot %d", bState.Slot()+1)
+		}
+		bState, err = state.ExecuteStateTransition(context.Background(), bState, block)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "could not process block at slot %d", block.Block.Slot)
+		}
+		chain = append(chain, block)
+	}
+	return chain, bState, nil
+}
+
+// GenerateChainThroughSlashingsRotation generates a block on top of the given state with
+// the requested amount of proposer slashings, then advances the post state through empty
+// slots until EPOCHS_PER_SLASHINGS_VECTOR epochs past the epoch of the slashings. At that
+// point epoch processing has rotated the slashings vector all the way around and reset
+// the entry in which the slashings were recorded. The given state is not mutated, the
+// generated block and the advanced state are returned.
+func GenerateChainThroughSlashingsRotation(
+	bState *stateTrie.BeaconState,
+	privs []*bls.SecretKey,
+	numSlashings uint64,
+) (*ethpb.SignedBeaconBlock, *stateTrie.BeaconState, error) {
+	conf := &BlockGenConfig{NumProposerSlashings: numSlashings}
+	block, err := GenerateFullBlock(bState, privs, conf, bState.Slot())
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "could not generate block with %d proposer slashings", numSlashings)
+	}
+	bState, err = state.ExecuteStateTransition(context.Background(), bState.Copy(), block)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "could not process block at slot %d", block.Block.Slot)
+	}
+	rotationEpoch := helpers.SlotToEpoch(block.Block.Slot) + params.BeaconConfig().EpochsPerSlashingsVector
+	bState, err = state.ProcessSlots(context.Background(), bState, helpers.StartSlot(rotationEpoch))
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "could not advance state to epoch %d", rotationEpoch)
+	}
+	return block, bState, nil
+}
+
+// GenerateChainWithParticipation generates a block for every slot of the epochs following
+// the state's current epoch, one epoch per requested participation rate. Every block
+// includes attestations for the previous slot from the given fraction of each committee,
+// rounded down. Alongside the post state, the measured participation of each epoch is
+// returned, as the attesting balance over the total active balance once all of the epoch's
+// attestations have been included. The given state must be at the start of an epoch and
+// is not mutated.
+func GenerateChainWithParticipation(
+	bState *stateTrie.BeaconState,
+	privs []*bls.SecretKey,
+	rates []float64,
+) (*stateTrie.BeaconState, []float64, error) {
+	if bState.Slot()%params.BeaconConfig().SlotsPerEpoch != 0 {
+		return nil, nil, fmt.Errorf("state slot %d is not at the start of an epoch", bState.Slot())
+	}
+	bState = bState.Copy()
+	startEpoch := helpers.CurrentEpoch(bState)
+	participation := make([]float64, len(rates))
+	for i, rate := range rates {
+		if rate < 0 || rate > 1 {
+			return nil, nil, fmt.Errorf("participation rate %f is not between 0 and 1", rate)
+		}
+		epoch := startEpoch + uint64(i)
+		// The block at the start of the next epoch includes the attestations for the
+		// last slot of this epoch.
+		for slot := helpers.StartSlot(epoch) + 1; slot <= helpers.StartSlot(epoch+1); slot++ {
+			headState, err := state.ProcessSlots(context.Background(), bState.Copy(), slot)
+			if err != nil {
+				return nil, nil, err
+			}
+			atts, err := generatePartialAttestations(headState, privs, slot-1, rate)
+			if err != nil {
+				return nil, nil, errors.Wrapf(err, "could not generate attestations for slot %d", slot-1)
+			}
+			block, err := GenerateFullBlock(bState, privs, &BlockGenConfig{Attestations: atts}, slot)
+			if err != nil {
+				return nil, nil, errors.Wrapf(err, "could not generate block at slot %d", slot)
+			}
+			bState, err = state.ExecuteStateTransition(context.Background(), bState, block)
+			if err != nil {
+				return nil, nil, errors.Wrapf(err, "could not process block at slot %d", slot)
+			}
+		}
+
+		vp, bp := precompute.New(context.Background(), bState)
+		_, bp, err := precompute.ProcessAttestations(context.Background(), bState, vp, bp)
+		if err != nil {
+			return nil, nil, err
+		}
+		participation[i] = float64(bp.PrevEpochAttesters) / float64(bp.PrevEpoch)
+	}
+	return bState, participation, nil
+}
+
+// generatePartialAttestations generates one attestation per committee of the given slot,
+// attested by the given fraction of the committee's members, rounded down.
+func generatePartialAttestations(
+	bState *stateTrie.BeaconState,
+	privs []*bls.SecretKey,
+	slot uint64,
+	rate float64,
+) ([]*ethpb.Attestation, error) {
+	activeCount, err := helpers.ActiveValidatorCount(bState, helpers.SlotToEpoch(slot))
+	if err != nil {
+		return nil, err
+	}
+	atts, err := GenerateAttestationsForSlot(bState, privs, helpers.SlotCommitteeCount(activeCount), slot)
+	if err != nil {
+		return nil, err
+	}
+	partialAtts := make([]*ethpb.Attestation, 0, len(atts))
+	for _, att := range atts {
+		committeeSize := att.AggregationBits.Len()
+		numAttesters := uint64(rate * float64(committeeSize))
+		if numAttesters == 0 {
+			continue
+		}
+		aggregationBits := bitfield.NewBitlist(committeeSize)
+		for b := uint64(0); b < numAttesters; b++ {
+			aggregationBits.SetBitAt(b, true)
+		}
+		att.AggregationBits = aggregationBits
+		if err := signAttestation(bState, privs, att); err != nil {
+			return nil, err
+		}
+		partialAtts = append(partialAtts, att)
+	}
+	return partialAtts, nil
+}
@@ -0,0 +1,250 @@
+package testutil
+
+import (
+	"bytes"
+	"context"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	ethpb "github.com/prysmaticlabs/ethereumapis/eth/v1alpha1"
+	"github.com/prysmaticlabs/go-ssz"
+	"github.com/prysmaticlabs/prysm/beacon-chain/core/helpers"
+	"github.com/prysmaticlabs/prysm/beacon-chain/core/state"
+	"github.com/prysmaticlabs/prysm/shared/bytesutil"
+	"github.com/prysmaticlabs/prysm/shared/params"
+)
+
+func TestGenerateChainUntilFinalized_GenesisEpoch(t *testing.T) {
+	params.OverrideBeaconConfig(params.MinimalSpecConfig())
+	defer params.OverrideBeaconConfig(params.MainnetConfig())
+	beaconState, privs := DeterministicGenesisState(t, 64)
+
+	conf := &BlockGenConfig{
+		NumAttestations: 2,
+	}
+	chain, finalState, err := GenerateChainUntilFinalized(beaconState, privs, conf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if finalState.FinalizedCheckpointEpoch() != 0 {
+		t.Errorf("Expected finalized epoch 0, received %d", finalState.FinalizedCheckpointEpoch())
+	}
+	if !bytes.Equal(finalState.FinalizedCheckpoint().Root, params.BeaconConfig().ZeroHash[:]) {
+		t.Errorf("Expected finalized root to be the genesis zero hash, received %#x", finalState.FinalizedCheckpoint().Root)
+	}
+	if finalState.CurrentJustifiedCheckpoint().Epoch == 0 {
+		t.Error("Expected a later epoch to be justified on top of the finalized epoch")
+	}
+	if uint64(len(chain)) != finalState.Slot() {
+		t.Errorf("Expected a block for every slot, received %d blocks for slot %d", len(chain), finalState.Slot())
+	}
+	if beaconState.Slot() != 0 {
+		t.Errorf("Expected the given state to not be mutated, received slot %d", beaconState.Slot())
+	}
+}
+
+func TestGenerateChainThroughSlashingsRotation_ResetsEntry(t *testing.T) {
+	params.OverrideBeaconConfig(params.MinimalSpecConfig())
+	defer params.OverrideBeaconConfig(params.MainnetConfig())
+	beaconState, privs := DeterministicGenesisState(t, 64)
+
+	block, finalState, err := GenerateChainThroughSlashingsRotation(beaconState, privs, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slashedEpoch := helpers.SlotToEpoch(block.Block.Slot)
+	vectorIndex := slashedEpoch % params.BeaconConfig().EpochsPerSlashingsVector
+
+	postBlockState, err := state.ExecuteStateTransition(context.Background(), beaconState.Copy(), block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if postBlockState.Slashings()[vectorIndex] != params.BeaconConfig().MaxEffectiveBalance {
+		t.Errorf(
+			"Expected slashings entry %d to be %d after the block, received %d",
+			vectorIndex,
+			params.BeaconConfig().MaxEffectiveBalance,
+			postBlockState.Slashings()[vectorIndex],
+		)
+	}
+
+	wantedEpoch := slashedEpoch + params.BeaconConfig().EpochsPerSlashingsVector
+	if helpers.CurrentEpoch(finalState) != wantedEpoch {
+		t.Errorf("Expected state to be at epoch %d, received %d", wantedEpoch, helpers.CurrentEpoch(finalState))
+	}
+	if finalState.Slashings()[vectorIndex] != 0 {
+		t.Errorf("Expected slashings entry %d to be reset, received %d", vectorIndex, finalState.Slashings()[vectorIndex])
+	}
+}
+
+func TestGenerateChainWithParticipation_MeasuresRequestedRates(t *testing.T) {
+	params.OverrideBeaconConfig(params.MinimalSpecConfig())
+	defer params.OverrideBeaconConfig(params.MainnetConfig())
+	beaconState, privs := DeterministicGenesisState(t, 64)
+
+	// Decreasing rates keep every balance above the maximum effective balance, so all
+	// validators weigh the same and the measured participation is exact.
+	rates := []float64{1, 0.75, 0.5}
+	finalState, participation, err := GenerateChainWithParticipation(beaconState, privs, rates)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(participation) != len(rates) {
+		t.Fatalf("Expected %d participation rates, received %d", len(rates), len(participation))
+	}
+	for i, rate := range rates {
+		if math.Abs(participation[i]-rate) > 0.01 {
+			t.Errorf("Expected participation %f in epoch %d, received %f", rate, i, participation[i])
+		}
+	}
+	wantedSlot := uint64(len(rates)) * params.BeaconConfig().SlotsPerEpoch
+	if finalState.Slot() != wantedSlot {
+		t.Errorf("Expected final state at slot %d, received %d", wantedSlot, finalState.Slot())
+	}
+}
+
+func TestGenerateFullBlockChain_ChainsAcrossEpochs(t *testing.T) {
+	params.OverrideBeaconConfig(params.MinimalSpecConfig())
+	defer params.OverrideBeaconConfig(params.MainnetConfig())
+	beaconState, privs := DeterministicGenesisState(t, 64)
+
+	numBlocks := 2*params.BeaconConfig().SlotsPerEpoch + 1
+	conf := &BlockGenConfig{
+		NumAttestations: 2,
+	}
+	chain, finalState, err := GenerateFullBlockChain(beaconState, privs, conf, numBlocks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uint64(len(chain)) != numBlocks {
+		t.Fatalf("Expected %d blocks, received %d", numBlocks, len(chain))
+	}
+	for i, block := range chain {
+		if block.Block.Slot != uint64(i+1) {
+			t.Errorf("Expected block %d at slot %d, received slot %d", i, i+1, block.Block.Slot)
+		}
+		if i == 0 {
+			continue
+		}
+		parentRoot, err := ssz.HashTreeRoot(chain[i-1].Block)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(block.Block.ParentRoot, parentRoot[:]) {
+			t.Errorf("Expected block at slot %d to have parent root %#x, received %#x", block.Block.Slot, parentRoot, block.Block.ParentRoot)
+		}
+	}
+	if finalState.Slot() != numBlocks {
+		t.Errorf("Expected final state at slot %d, received %d", numBlocks, finalState.Slot())
+	}
+	if beaconState.Slot() != 0 {
+		t.Errorf("Expected the given state to not be mutated, received slot %d", beaconState.Slot())
+	}
+}
+
+func TestGenerateChainWithEth1DataVote_Canonicalized(t *testing.T) {
+	params.OverrideBeaconConfig(params.MinimalSpecConfig())
+	defer params.OverrideBeaconConfig(params.MainnetConfig())
+	beaconState, privs := DeterministicGenesisState(t, 64)
+
+	// Vote for the eth1 data of one more deterministic deposit, then include it.
+	deposits, eth1Data, err := DeterministicDepositsFrom(beaconState.Eth1DepositIndex(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain, beaconState, err := GenerateChainWithEth1DataVote(beaconState, privs, &BlockGenConfig{}, eth1Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantedVotes := params.BeaconConfig().SlotsPerEth1VotingPeriod/2 + 1
+	if uint64(len(chain)) != wantedVotes {
+		t.Errorf("Expected %d blocks to reach a majority of votes, received %d", wantedVotes, len(chain))
+	}
+	if !proto.Equal(beaconState.Eth1Data(), eth1Data) {
+		t.Errorf("Expected eth1 data %v, received %v", eth1Data, beaconState.Eth1Data())
+	}
+
+	block, err := GenerateFullBlock(beaconState, privs, &BlockGenConfig{NumDeposits: 1}, beaconState.Slot())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !proto.Equal(block.Block.Body.Deposits[0], deposits[0]) {
+		t.Error("Expected block to include the voted deposit")
+	}
+	beaconState, err = state.ExecuteStateTransition(context.Background(), beaconState, block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if beaconState.NumValidators() != 65 {
+		t.Errorf("Expected 65 validators, received %d", beaconState.NumValidators())
+	}
+}
+
+func TestGenerateChainWithEth1DataVote_PeriodEnds(t *testing.T) {
+	params.OverrideBeaconConfig(params.MinimalSpecConfig())
+	defer params.OverrideBeaconConfig(params.MainnetConfig())
+	beaconState, privs := DeterministicGenesisState(t, 64)
+	// Too few slots are left in the voting period for a majority of votes.
+	periodLength := params.BeaconConfig().SlotsPerEth1VotingPeriod
+	beaconState, err := state.ProcessSlots(context.Background(), beaconState, periodLength/2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	depositRoot := bytesutil.ToBytes32([]byte("deposit root"))
+	blockHash := bytesutil.ToBytes32([]byte("block hash"))
+	eth1Data := &ethpb.Eth1Data{
+		DepositRoot:  depositRoot[:],
+		DepositCount: beaconState.Eth1Data().DepositCount,
+		BlockHash:    blockHash[:],
+	}
+	if _, _, err := GenerateChainWithEth1DataVote(beaconState, privs, nil, eth1Data); err == nil {
+		t.Error("Expected error when the voting period ends before a majority of votes")
+	}
+}
+
+func TestStreamBlocks(t *testing.T) {
+	params.OverrideBeaconConfig(params.MinimalSpecConfig())
+	defer params.OverrideBeaconConfig(params.MainnetConfig())
+	beaconState, privs := DeterministicGenesisState(t, 64)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	blocks, err := StreamBlocks(ctx, beaconState, privs, &BlockGenConfig{NumAttestations: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	headState := beaconState.Copy()
+	for i := uint64(1); i <= 3; i++ {
+		block := <-blocks
+		if block.Block.Slot != i {
+			t.Errorf("Expected block at slot %d, received %d", i, block.Block.Slot)
+		}
+		headState, err = state.ExecuteStateTransition(context.Background(), headState, block)
+		if err != nil {
+			t.Fatalf("Streamed block %d failed the state transition: %v", i, err)
+		}
+	}
+	if beaconState.Slot() != 0 {
+		t.Errorf("Expected the given state to not be mutated, received slot %d", beaconState.Slot())
+	}
+
+	cancel()
+	closed := make(chan struct{})
+	go func() {
+		for range blocks {
+		}
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Expected the stream to be closed after cancelling the context")
+	}
+
+	if _, err := StreamBlocks(context.Background(), beaconState, privs, &BlockGenConfig{SkipStateRoot: true}); err == nil {
+		t.Error("Expected error for a config generating blocks without a post state")
+	}
+}
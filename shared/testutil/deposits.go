@@ -4,6 +4,7 @@ import (
 	"sync"
 	"testing"
 
+	"github.com/gogo/protobuf/proto"
 	"github.com/pkg/errors"
 	ethpb "github.com/prysmaticlabs/ethereumapis/eth/v1alpha1"
 	"github.com/prysmaticlabs/go-ssz"
@@ -32,13 +33,70 @@ var trie *trieutil.SparseMerkleTrie
 func DeterministicDepositsAndKeys(numDeposits uint64) ([]*ethpb.Deposit, []*bls.SecretKey, error) {
 	lock.Lock()
 	defer lock.Unlock()
+	if err := generateCachedDeposits(numDeposits); err != nil {
+		return nil, nil, err
+	}
+
+	requestedDeposits, err := depositsWithProofs(numDeposits)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return requestedDeposits, privKeys[0:numDeposits], nil
+}
+
+// DeterministicDepositsFrom returns the numDeposits deterministic deposits following the
+// first startIndex ones, along with the eth1 data of the trie of all the deposits up to the
+// returned ones. Only the new deposits are given merkle proofs, and the cached trie is used
+// as is when it holds exactly those deposits, so growing a chain by a few deposits per block
+// doesn't regenerate the proofs of every prior deposit.
+func DeterministicDepositsFrom(startIndex uint64, numDeposits uint64) ([]*ethpb.Deposit, *ethpb.Eth1Data, error) {
+	lock.Lock()
+	defer lock.Unlock()
+	size := startIndex + numDeposits
+	if err := generateCachedDeposits(size); err != nil {
+		return nil, nil, err
+	}
+
+	depositTrie := trie
+	if uint64(len(trie.Items())) != size {
+		var err error
+		depositTrie, _, err = deterministicDepositTrie(int(size))
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "failed to create deposit trie")
+		}
+	}
+	deposits := make([]*ethpb.Deposit, numDeposits)
+	for i := range deposits {
+		index := startIndex + uint64(i)
+		proof, err := depositTrie.MerkleProof(int(index))
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "could not create merkle proof")
+		}
+		deposits[i] = &ethpb.Deposit{
+			Data:  cachedDeposits[index].Data,
+			Proof: proof,
+		}
+	}
+	root := depositTrie.Root()
+	eth1Data := &ethpb.Eth1Data{
+		BlockHash:    root[:],
+		DepositRoot:  root[:],
+		DepositCount: size,
+	}
+	return deposits, eth1Data, nil
+}
+
+// generateCachedDeposits extends the deposit cache and its trie up to numDeposits
+// deposits. The cache lock must be held.
+func generateCachedDeposits(numDeposits uint64) error {
 	var err error
 
 	// Populate trie cache, if not initialized yet.
 	if trie == nil {
 		trie, err = trieutil.NewTrie(int(params.BeaconConfig().DepositContractTreeDepth))
 		if err != nil {
-			return nil, nil, errors.Wrap(err, "failed to create new trie")
+			return errors.Wrap(err, "failed to create new trie")
 		}
 	}
 
@@ -49,7 +107,7 @@ func DeterministicDepositsAndKeys(numDeposits uint64) ([]*ethpb.Deposit, []*bls.
 		// Fetch the required number of keys.
 		secretKeys, publicKeys, err := interop.DeterministicallyGenerateKeys(numExisting, numRequired+1)
 		if err != nil {
-			return nil, nil, errors.Wrap(err, "could not create deterministic keys: ")
+			return errors.Wrap(err, "could not create deterministic keys: ")
 		}
 		privKeys = append(privKeys, secretKeys[:len(secretKeys)-1]...)
 
@@ -67,7 +125,7 @@ func DeterministicDepositsAndKeys(numDeposits uint64) ([]*ethpb.Deposit, []*bls.
 			domain := bls.ComputeDomain(params.BeaconConfig().DomainDeposit)
 			root, err := ssz.SigningRoot(depositData)
 			if err != nil {
-				return nil, nil, errors.Wrap(err, "could not get signing root of deposit data")
+				return errors.Wrap(err, "could not get signing root of deposit data")
 			}
 			depositData.Signature = secretKeys[i].Sign(root[:], domain).Marshal()
 
@@ -78,41 +136,56 @@ func DeterministicDepositsAndKeys(numDeposits uint64) ([]*ethpb.Deposit, []*bls.
 
 			hashedDeposit, err := ssz.HashTreeRoot(deposit.Data)
 			if err != nil {
-				return nil, nil, errors.Wrap(err, "could not tree hash deposit data")
+				return errors.Wrap(err, "could not tree hash deposit data")
 			}
 
 			trie.Insert(hashedDeposit[:], int(numExisting+i))
 		}
 	}
+	return nil
+}
 
-	depositTrie, _, err := DeterministicDepositTrie(int(numDeposits))
+// depositsWithProofs returns the first numDeposits cached deposits with their merkle proofs
+// against the trie of that size. The cached deposits are copied rather than given proofs,
+// so deposits returned to earlier callers keep proofs matching their own trie. The cache
+// lock must be held.
+func depositsWithProofs(numDeposits uint64) ([]*ethpb.Deposit, error) {
+	depositTrie, _, err := deterministicDepositTrie(int(numDeposits))
 	if err != nil {
-		return nil, nil, errors.Wrap(err, "failed to create deposit trie")
+		return nil, errors.Wrap(err, "failed to create deposit trie")
 	}
-	requestedDeposits := cachedDeposits[:numDeposits]
+	requestedDeposits := make([]*ethpb.Deposit, numDeposits)
 	for i := range requestedDeposits {
 		proof, err := depositTrie.MerkleProof(i)
 		if err != nil {
-			return nil, nil, errors.Wrap(err, "could not create merkle proof")
+			return nil, errors.Wrap(err, "could not create merkle proof")
+		}
+		requestedDeposits[i] = &ethpb.Deposit{
+			Data:  cachedDeposits[i].Data,
+			Proof: proof,
 		}
-		requestedDeposits[i].Proof = proof
 	}
-
-	return requestedDeposits, privKeys[0:numDeposits], nil
+	return requestedDeposits, nil
 }
 
 // DeterministicDepositTrie returns a merkle trie of the requested size from the
 // deterministic deposits.
 func DeterministicDepositTrie(size int) (*trieutil.SparseMerkleTrie, [][32]byte, error) {
-	items := trie.Items()
-	if size > len(items) {
-		return nil, [][32]byte{}, errors.New("requested a larger tree than amount of deposits")
-	}
+	lock.Lock()
+	defer lock.Unlock()
+	return deterministicDepositTrie(size)
+}
 
+func deterministicDepositTrie(size int) (*trieutil.SparseMerkleTrie, [][32]byte, error) {
 	if trie == nil {
 		return nil, [][32]byte{}, errors.New("trie cache is empty, generate deposits at an earlier point")
 	}
 
+	items := trie.Items()
+	if size > len(items) {
+		return nil, [][32]byte{}, errors.New("requested a larger tree than amount of deposits")
+	}
+
 	items = items[:size]
 	depositTrie, err := trieutil.GenerateTrieFromItems(items, int(params.BeaconConfig().DepositContractTreeDepth))
 	if err != nil {
@@ -127,6 +200,26 @@ func DeterministicDepositTrie(size int) (*trieutil.SparseMerkleTrie, [][32]byte,
 	return depositTrie, roots, nil
 }
 
+// GenerateDepositTrieAndProofs returns the first count deterministic deposits along with
+// the merkle proof of each deposit and the root of the deposit trie made of them, as the
+// deposit contract computes it in get_deposit_root. The proofs are those of the deposits,
+// with the deposit count as their last item, so they verify against that root.
+func GenerateDepositTrieAndProofs(t testing.TB, count uint64) ([]*ethpb.Deposit, [][][]byte, [32]byte) {
+	deposits, _, err := DeterministicDepositsAndKeys(count)
+	if err != nil {
+		t.Fatal(errors.Wrapf(err, "failed to get %d deposits", count))
+	}
+	depositTrie, _, err := DeterministicDepositTrie(int(count))
+	if err != nil {
+		t.Fatal(errors.Wrapf(err, "failed to get deposit trie of %d deposits", count))
+	}
+	proofs := make([][][]byte, len(deposits))
+	for i, deposit := range deposits {
+		proofs[i] = deposit.Proof
+	}
+	return deposits, proofs, depositTrie.HashTreeRoot()
+}
+
 // DeterministicEth1Data takes an array of deposits and returns the eth1Data made from the deposit trie.
 func DeterministicEth1Data(size int) (*ethpb.Eth1Data, error) {
 	depositTrie, _, err := DeterministicDepositTrie(size)
@@ -142,6 +235,169 @@ func DeterministicEth1Data(size int) (*ethpb.Eth1Data, error) {
 	return eth1Data, nil
 }
 
+// GenerateEth1DataAt returns the eth1 data of the eth1 block with the given hash, at which
+// the deposit contract has received the first depositCount of the given deposits, so tests
+// can vote for a specific position of the eth1 chain. The deposit root is the root of the
+// deposit trie made of those deposits.
+func GenerateEth1DataAt(t testing.TB, deposits []*ethpb.Deposit, blockHash []byte, depositCount uint64) *ethpb.Eth1Data {
+	if depositCount > uint64(len(deposits)) {
+		t.Fatalf("deposit count %d is larger than the %d given deposits", depositCount, len(deposits))
+	}
+	if len(blockHash) != 32 {
+		t.Fatalf("block hash must be 32 bytes, received %d", len(blockHash))
+	}
+	depositTrie, _, err := DepositTrieFromDeposits(deposits[:depositCount])
+	if err != nil {
+		t.Fatal(errors.Wrapf(err, "failed to get deposit trie of %d deposits", depositCount))
+	}
+	root := depositTrie.Root()
+	return &ethpb.Eth1Data{
+		BlockHash:    blockHash,
+		DepositRoot:  root[:],
+		DepositCount: depositCount,
+	}
+}
+
+// DeterministicDepositsWithCredentials returns numDeposits deterministic deposits following
+// the first startIndex deterministic deposits, where the withdrawal credentials of the i-th
+// deposit are replaced by credentials[i] when set. The modified deposits are re-signed by
+// their validator, and the eth1 data of the deposit trie made of the first startIndex
+// deterministic deposits followed by the returned deposits is returned along with them.
+// Every returned deposit has a merkle proof against that trie.
+func DeterministicDepositsWithCredentials(
+	startIndex uint64,
+	numDeposits uint64,
+	credentials [][]byte,
+) ([]*ethpb.Deposit, *ethpb.Eth1Data, error) {
+	depositDatas, err := deterministicDepositData(startIndex, numDeposits, credentials)
+	if err != nil {
+		return nil, nil, err
+	}
+	return depositsFollowingDeterministic(startIndex, depositDatas)
+}
+
+// DeterministicDepositWithInvalidSignature returns the deterministic deposit following the
+// first startIndex deterministic deposits, with a well-formed signature of its validator
+// over the wrong message, along with the eth1 data of the deposit trie made of the first
+// startIndex deterministic deposits followed by the returned deposit. The merkle proof of
+// the deposit is valid, so processing it succeeds and consumes the deposit, but no
+// validator is registered since the signature of a deposit of a new validator does not
+// verify.
+func DeterministicDepositWithInvalidSignature(startIndex uint64) (*ethpb.Deposit, *ethpb.Eth1Data, error) {
+	depositDatas, err := deterministicDepositData(startIndex, 1, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	_, keys, err := DeterministicDepositsAndKeys(startIndex + 1)
+	if err != nil {
+		return nil, nil, err
+	}
+	domain := bls.ComputeDomain(params.BeaconConfig().DomainDeposit)
+	depositDatas[0].Signature = keys[startIndex].Sign(params.BeaconConfig().ZeroHash[:], domain).Marshal()
+	deposits, eth1Data, err := depositsFollowingDeterministic(startIndex, depositDatas)
+	if err != nil {
+		return nil, nil, err
+	}
+	return deposits[0], eth1Data, nil
+}
+
+// deterministicDepositData returns copies of the data of numDeposits deterministic deposits
+// following the first startIndex ones, where the withdrawal credentials of the i-th deposit
+// are replaced by credentials[i] when set, and the deposit re-signed by its validator.
+func deterministicDepositData(startIndex uint64, numDeposits uint64, credentials [][]byte) ([]*ethpb.Deposit_Data, error) {
+	deposits, keys, err := DeterministicDepositsAndKeys(startIndex + numDeposits)
+	if err != nil {
+		return nil, err
+	}
+	depositDatas := make([]*ethpb.Deposit_Data, numDeposits)
+	for i := range depositDatas {
+		depositData := proto.Clone(deposits[startIndex+uint64(i)].Data).(*ethpb.Deposit_Data)
+		if i < len(credentials) && credentials[i] != nil {
+			if len(credentials[i]) != 32 {
+				return nil, errors.Errorf("withdrawal credentials of deposit %d must be 32 bytes, received %d", i, len(credentials[i]))
+			}
+			depositData.WithdrawalCredentials = credentials[i]
+			if err := signDepositData(depositData, keys[startIndex+uint64(i)]); err != nil {
+				return nil, err
+			}
+		}
+		depositDatas[i] = depositData
+	}
+	return depositDatas, nil
+}
+
+// signDepositData sets the signature of the deposit data to its signature by the given key.
+func signDepositData(depositData *ethpb.Deposit_Data, key *bls.SecretKey) error {
+	domain := bls.ComputeDomain(params.BeaconConfig().DomainDeposit)
+	root, err := ssz.SigningRoot(depositData)
+	if err != nil {
+		return errors.Wrap(err, "could not get signing root of deposit data")
+	}
+	depositData.Signature = key.Sign(root[:], domain).Marshal()
+	return nil
+}
+
+// validDepositSignature reports whether the deposit data is signed by the key of its
+// public key, as verified when the deposit of a new validator is processed.
+func validDepositSignature(depositData *ethpb.Deposit_Data) bool {
+	pubKey, err := bls.PublicKeyFromBytes(depositData.PublicKey)
+	if err != nil {
+		return false
+	}
+	sig, err := bls.SignatureFromBytes(depositData.Signature)
+	if err != nil {
+		return false
+	}
+	root, err := ssz.SigningRoot(depositData)
+	if err != nil {
+		return false
+	}
+	return sig.Verify(root[:], pubKey, bls.ComputeDomain(params.BeaconConfig().DomainDeposit))
+}
+
+// depositsFollowingDeterministic returns deposits of the given data with merkle proofs
+// against the deposit trie made of the first startIndex deterministic deposits followed
+// by the given deposits, along with the eth1 data of that trie.
+func depositsFollowingDeterministic(startIndex uint64, depositDatas []*ethpb.Deposit_Data) ([]*ethpb.Deposit, *ethpb.Eth1Data, error) {
+	lock.Lock()
+	if err := generateCachedDeposits(startIndex); err != nil {
+		lock.Unlock()
+		return nil, nil, err
+	}
+	items := make([][]byte, 0, startIndex+uint64(len(depositDatas)))
+	items = append(items, trie.Items()[:startIndex]...)
+	lock.Unlock()
+
+	newDeposits := make([]*ethpb.Deposit, len(depositDatas))
+	for i, depositData := range depositDatas {
+		hashedDeposit, err := ssz.HashTreeRoot(depositData)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "could not tree hash deposit data")
+		}
+		items = append(items, hashedDeposit[:])
+		newDeposits[i] = &ethpb.Deposit{Data: depositData}
+	}
+
+	depositTrie, err := trieutil.GenerateTrieFromItems(items, int(params.BeaconConfig().DepositContractTreeDepth))
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "could not generate trie of %d length", len(items))
+	}
+	for i, deposit := range newDeposits {
+		proof, err := depositTrie.MerkleProof(int(startIndex) + i)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "could not create merkle proof")
+		}
+		deposit.Proof = proof
+	}
+	root := depositTrie.Root()
+	eth1Data := &ethpb.Eth1Data{
+		BlockHash:    root[:],
+		DepositRoot:  root[:],
+		DepositCount: uint64(len(items)),
+	}
+	return newDeposits, eth1Data, nil
+}
+
 // DeterministicGenesisState returns a genesis state made using the deterministic deposits.
 func DeterministicGenesisState(t testing.TB, numValidators uint64) (*stateTrie.BeaconState, []*bls.SecretKey) {
 	deposits, privKeys, err := DeterministicDepositsAndKeys(numValidators)
@@ -159,6 +415,85 @@ func DeterministicGenesisState(t testing.TB, numValidators uint64) (*stateTrie.B
 	return beaconState, privKeys
 }
 
+// DeterministicDepositsWithAmounts returns a deterministic deposit of each of the given
+// amounts, where deposit i is made by deterministic key i, along with the keys and the
+// eth1 data of the deposit trie made of those deposits. Every returned deposit has a
+// merkle proof against that trie.
+func DeterministicDepositsWithAmounts(amounts []uint64) ([]*ethpb.Deposit, []*bls.SecretKey, *ethpb.Eth1Data, error) {
+	numDeposits := uint64(len(amounts))
+	depositDatas, err := deterministicDepositData(0, numDeposits, nil)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	_, keys, err := DeterministicDepositsAndKeys(numDeposits)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	for i, depositData := range depositDatas {
+		depositData.Amount = amounts[i]
+		if err := signDepositData(depositData, keys[i]); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	deposits, eth1Data, err := depositsFollowingDeterministic(0, depositDatas)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return deposits, keys, eth1Data, nil
+}
+
+// DeterministicGenesisStateWithBalances returns a genesis state like DeterministicGenesisState
+// where validator i has made a deposit of balances[i]. As at genesis, only the validators
+// with a deposit of at least MAX_EFFECTIVE_BALANCE are active.
+func DeterministicGenesisStateWithBalances(t testing.TB, balances []uint64) (*stateTrie.BeaconState, []*bls.SecretKey) {
+	deposits, privKeys, eth1Data, err := DeterministicDepositsWithAmounts(balances)
+	if err != nil {
+		t.Fatal(errors.Wrapf(err, "failed to get %d deposits", len(balances)))
+	}
+	beaconState, err := state.GenesisBeaconState(deposits, uint64(0), eth1Data)
+	if err != nil {
+		t.Fatal(errors.Wrapf(err, "failed to get genesis beacon state of %d validators", len(balances)))
+	}
+	return beaconState, privKeys
+}
+
+// DepositsFromKeys returns a deposit of MAX_EFFECTIVE_BALANCE signed by each of the given
+// keys, in order, with BLS withdrawal credentials of the key's own public key, along with
+// the eth1 data of the deposit trie made of those deposits. Every returned deposit has a
+// merkle proof against that trie.
+func DepositsFromKeys(privs []*bls.SecretKey) ([]*ethpb.Deposit, *ethpb.Eth1Data, error) {
+	depositDatas := make([]*ethpb.Deposit_Data, len(privs))
+	for i, priv := range privs {
+		pubKey := priv.PublicKey().Marshal()
+		withdrawalCreds := hashutil.Hash(pubKey)
+		withdrawalCreds[0] = params.BeaconConfig().BLSWithdrawalPrefixByte
+		depositDatas[i] = &ethpb.Deposit_Data{
+			PublicKey:             pubKey,
+			Amount:                params.BeaconConfig().MaxEffectiveBalance,
+			WithdrawalCredentials: withdrawalCreds[:],
+		}
+		if err := signDepositData(depositDatas[i], priv); err != nil {
+			return nil, nil, err
+		}
+	}
+	return depositsFollowingDeterministic(0, depositDatas)
+}
+
+// GenesisStateFromKeys returns a genesis state made of a deposit of each of the given keys,
+// so the validator at index i of the state has the public key of privs[i]. Tests can reuse
+// one set of keys across many states without generating the keys again.
+func GenesisStateFromKeys(t testing.TB, privs []*bls.SecretKey) *stateTrie.BeaconState {
+	deposits, eth1Data, err := DepositsFromKeys(privs)
+	if err != nil {
+		t.Fatal(errors.Wrapf(err, "failed to get deposits of %d keys", len(privs)))
+	}
+	beaconState, err := state.GenesisBeaconState(deposits, uint64(0), eth1Data)
+	if err != nil {
+		t.Fatal(errors.Wrapf(err, "failed to get genesis beacon state of %d validators", len(privs)))
+	}
+	return beaconState
+}
+
 // DepositTrieFromDeposits takes an array of deposits and returns the deposit trie.
 func DepositTrieFromDeposits(deposits []*ethpb.Deposit) (*trieutil.SparseMerkleTrie, [][32]byte, error) {
 	encodedDeposits := make([][]byte, len(deposits))
@@ -185,6 +520,8 @@ func DepositTrieFromDeposits(deposits []*ethpb.Deposit) (*trieutil.SparseMerkleT
 
 // ResetCache clears out the old trie, private keys and deposits.
 func ResetCache() {
+	lock.Lock()
+	defer lock.Unlock()
 	trie = nil
 	privKeys = []*bls.SecretKey{}
 	cachedDeposits = []*ethpb.Deposit{}
@@ -250,17 +587,9 @@ func DeterministicDepositsAndKeysSameValidator(numDeposits uint64) ([]*ethpb.Dep
 		}
 	}
 
-	depositTrie, _, err := DeterministicDepositTrie(int(numDeposits))
+	requestedDeposits, err := depositsWithProofs(numDeposits)
 	if err != nil {
-		return nil, nil, errors.Wrap(err, "failed to create deposit trie")
-	}
-	requestedDeposits := cachedDeposits[:numDeposits]
-	for i := range requestedDeposits {
-		proof, err := depositTrie.MerkleProof(i)
-		if err != nil {
-			return nil, nil, errors.Wrap(err, "could not create merkle proof")
-		}
-		requestedDeposits[i].Proof = proof
+		return nil, nil, err
 	}
 
 	return requestedDeposits, privKeys[0:numDeposits], nil
@@ -2,9 +2,21 @@ package testutil
 
 import (
 	"bytes"
+	"context"
+	"reflect"
+	"sync"
 	"testing"
 
+	"github.com/gogo/protobuf/proto"
+	ethpb "github.com/prysmaticlabs/ethereumapis/eth/v1alpha1"
+	"github.com/prysmaticlabs/go-ssz"
+	"github.com/prysmaticlabs/prysm/beacon-chain/core/blocks"
 	"github.com/prysmaticlabs/prysm/beacon-chain/core/helpers"
+	"github.com/prysmaticlabs/prysm/beacon-chain/core/state"
+	"github.com/prysmaticlabs/prysm/shared/bls"
+	"github.com/prysmaticlabs/prysm/shared/bytesutil"
+	"github.com/prysmaticlabs/prysm/shared/params"
+	"github.com/prysmaticlabs/prysm/shared/trieutil"
 )
 
 func TestSetupInitialDeposits_1024Entries(t *testing.T) {
@@ -103,6 +115,42 @@ func TestDeterministicGenesisState_100Validators(t *testing.T) {
 	}
 }
 
+func TestDeterministicGenesisState_ValidGenesis(t *testing.T) {
+	params.OverrideBeaconConfig(params.MinimalSpecConfig())
+	defer params.OverrideBeaconConfig(params.MainnetConfig())
+	validatorCount := params.BeaconConfig().MinGenesisActiveValidatorCount
+	beaconState, privKeys := DeterministicGenesisState(t, validatorCount)
+	if !state.IsValidGenesisState(uint64(beaconState.NumValidators()), beaconState.GenesisTime()) {
+		t.Error("Expected a valid genesis state")
+	}
+
+	deposits, _, err := DeterministicDepositsAndKeys(validatorCount)
+	if err != nil {
+		t.Fatal(err)
+	}
+	depositTrie, _, err := DepositTrieFromDeposits(deposits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := depositTrie.Root()
+	if !bytes.Equal(beaconState.Eth1Data().DepositRoot, root[:]) {
+		t.Errorf("Expected deposit root %#x, received %#x", root, beaconState.Eth1Data().DepositRoot)
+	}
+	if beaconState.Eth1Data().DepositCount != validatorCount {
+		t.Errorf("Expected deposit count %d, received %d", validatorCount, beaconState.Eth1Data().DepositCount)
+	}
+	for i, key := range privKeys {
+		val, err := beaconState.ValidatorAtIndexReadOnly(uint64(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		pubKey := val.PublicKey()
+		if !bytes.Equal(key.PublicKey().Marshal(), pubKey[:]) {
+			t.Errorf("Expected private key %d to match the validator public key", i)
+		}
+	}
+}
+
 func TestDepositTrieFromDeposits(t *testing.T) {
 	deposits, _, err := DeterministicDepositsAndKeys(100)
 	if err != nil {
@@ -123,3 +171,286 @@ func TestDepositTrieFromDeposits(t *testing.T) {
 		t.Fatal("expected deposit trie root to equal eth1data deposit root")
 	}
 }
+
+func TestDeterministicDepositsWithCredentials_ProcessedWithCredentials(t *testing.T) {
+	beaconState, privs := DeterministicGenesisState(t, 64)
+	eth1Credentials := make([]byte, 32)
+	eth1Credentials[0] = 0x01
+	copy(eth1Credentials[12:], bytes.Repeat([]byte{0xab}, 20))
+	credentials := [][]byte{eth1Credentials, nil}
+
+	deposits, eth1Data, err := DeterministicDepositsWithCredentials(beaconState.Eth1DepositIndex(), 2, credentials)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(deposits[0].Data.WithdrawalCredentials, eth1Credentials) {
+		t.Errorf("Expected withdrawal credentials %#x, received %#x", eth1Credentials, deposits[0].Data.WithdrawalCredentials)
+	}
+	if deposits[1].Data.WithdrawalCredentials[0] != params.BeaconConfig().BLSWithdrawalPrefixByte {
+		t.Errorf("Expected default BLS withdrawal credentials, received %#x", deposits[1].Data.WithdrawalCredentials)
+	}
+	if err := beaconState.SetEth1Data(eth1Data); err != nil {
+		t.Fatal(err)
+	}
+
+	conf := &BlockGenConfig{
+		NumDeposits:           2,
+		WithdrawalCredentials: credentials,
+	}
+	block, err := GenerateFullBlock(beaconState, privs, conf, beaconState.Slot())
+	if err != nil {
+		t.Fatal(err)
+	}
+	beaconState, err = state.ExecuteStateTransition(context.Background(), beaconState, block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	val, err := beaconState.ValidatorAtIndexReadOnly(64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(val.WithdrawalCredentials(), eth1Credentials) {
+		t.Errorf("Expected validator withdrawal credentials %#x, received %#x", eth1Credentials, val.WithdrawalCredentials())
+	}
+}
+
+func TestDeterministicDepositsAndKeys_ConcurrentProofs(t *testing.T) {
+	ResetCache()
+	counts := []uint64{8, 16, 32, 64}
+	deposits := make([][]*ethpb.Deposit, len(counts))
+	errs := make([]error, len(counts))
+	var wg sync.WaitGroup
+	for i, count := range counts {
+		wg.Add(1)
+		go func(i int, count uint64) {
+			defer wg.Done()
+			deposits[i], _, errs[i] = DeterministicDepositsAndKeys(count)
+		}(i, count)
+	}
+	wg.Wait()
+
+	for i, count := range counts {
+		if errs[i] != nil {
+			t.Fatal(errs[i])
+		}
+		eth1Data, err := DeterministicEth1Data(int(count))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for j, deposit := range deposits[i] {
+			root, err := ssz.HashTreeRoot(deposit.Data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !trieutil.VerifyMerkleProof(eth1Data.DepositRoot, root[:], j, deposit.Proof) {
+				t.Errorf("Expected deposit %d of %d to have a valid proof", j, count)
+			}
+		}
+	}
+}
+
+func TestDeterministicDepositsFrom_MatchesFullDeposits(t *testing.T) {
+	ResetCache()
+	tests := []struct {
+		startIndex  uint64
+		numDeposits uint64
+	}{
+		// The cache holds exactly the requested deposits.
+		{startIndex: 4, numDeposits: 3},
+		// The cache holds more deposits than requested.
+		{startIndex: 2, numDeposits: 2},
+		// The cache is extended.
+		{startIndex: 7, numDeposits: 5},
+	}
+	for _, tt := range tests {
+		deposits, eth1Data, err := DeterministicDepositsFrom(tt.startIndex, tt.numDeposits)
+		if err != nil {
+			t.Fatal(err)
+		}
+		size := tt.startIndex + tt.numDeposits
+		allDeposits, _, err := DeterministicDepositsAndKeys(size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wantedEth1Data, err := DeterministicEth1Data(int(size))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !proto.Equal(eth1Data, wantedEth1Data) {
+			t.Errorf("Expected eth1 data %v, received %v", wantedEth1Data, eth1Data)
+		}
+		if uint64(len(deposits)) != tt.numDeposits {
+			t.Fatalf("Expected %d deposits, received %d", tt.numDeposits, len(deposits))
+		}
+		for i, deposit := range deposits {
+			if !proto.Equal(deposit, allDeposits[tt.startIndex+uint64(i)]) {
+				t.Errorf("Expected deposit %d to match the full deposits", tt.startIndex+uint64(i))
+			}
+		}
+	}
+}
+
+func TestDeterministicDepositTrie_ExtendedWithLaterDeposits(t *testing.T) {
+	// The deposit trie is built for the caller, so inserting later deposits in it doesn't
+	// affect the deposit cache.
+	if _, _, err := DeterministicDepositsAndKeys(16); err != nil {
+		t.Fatal(err)
+	}
+	depositTrie, _, err := DeterministicDepositTrie(16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deposits, eth1Data, err := DeterministicDepositsFrom(16, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, deposit := range deposits {
+		root, err := ssz.HashTreeRoot(deposit.Data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		depositTrie.Insert(root[:], 16+i)
+	}
+	root := depositTrie.Root()
+	if !bytes.Equal(root[:], eth1Data.DepositRoot) {
+		t.Errorf("Expected extended trie root %#x to match the deposit root %#x", root, eth1Data.DepositRoot)
+	}
+	for i, deposit := range deposits {
+		proof, err := depositTrie.MerkleProof(16 + i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(proof, deposit.Proof) {
+			t.Errorf("Expected proof of deposit %d to match the proof from the extended trie", 16+i)
+		}
+	}
+}
+
+func TestDeterministicDepositWithInvalidSignature_NoValidatorRegistered(t *testing.T) {
+	beaconState, _ := DeterministicGenesisState(t, 64)
+	depositIndex := beaconState.Eth1DepositIndex()
+	deposit, eth1Data, err := DeterministicDepositWithInvalidSignature(depositIndex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := beaconState.SetEth1Data(eth1Data); err != nil {
+		t.Fatal(err)
+	}
+
+	beaconState, err = blocks.ProcessDeposit(beaconState, deposit)
+	if err != nil {
+		t.Fatalf("Expected deposit with a valid proof to be processed: %v", err)
+	}
+	if beaconState.Eth1DepositIndex() != depositIndex+1 {
+		t.Errorf("Expected deposit index %d, received %d", depositIndex+1, beaconState.Eth1DepositIndex())
+	}
+	if beaconState.NumValidators() != 64 {
+		t.Errorf("Expected no validator to be registered, received %d validators", beaconState.NumValidators())
+	}
+	if _, ok := beaconState.ValidatorIndexByPubkey(bytesutil.ToBytes48(deposit.Data.PublicKey)); ok {
+		t.Error("Expected the deposit public key not to be registered")
+	}
+}
+
+func TestGenesisStateFromKeys(t *testing.T) {
+	params.OverrideBeaconConfig(params.MinimalSpecConfig())
+	defer params.OverrideBeaconConfig(params.MainnetConfig())
+	privs := make([]*bls.SecretKey, 64)
+	for i := range privs {
+		privs[i] = bls.RandKey()
+	}
+	beaconState := GenesisStateFromKeys(t, privs)
+	if beaconState.NumValidators() != len(privs) {
+		t.Fatalf("Expected %d validators, received %d", len(privs), beaconState.NumValidators())
+	}
+	for i, priv := range privs {
+		pubKey := beaconState.PubkeyAtIndex(uint64(i))
+		if !bytes.Equal(pubKey[:], priv.PublicKey().Marshal()) {
+			t.Errorf("Expected validator %d to have the public key of key %d", i, i)
+		}
+	}
+
+	block, err := GenerateFullBlock(beaconState, privs, &BlockGenConfig{NumAttestations: 1}, beaconState.Slot())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := state.ExecuteStateTransition(context.Background(), beaconState, block); err != nil {
+		t.Errorf("Expected block signed with the given keys to be valid: %v", err)
+	}
+}
+
+func TestDeterministicGenesisStateWithBalances(t *testing.T) {
+	cfg := params.BeaconConfig()
+	balances := []uint64{
+		cfg.MaxEffectiveBalance,
+		cfg.MaxEffectiveBalance / 2,
+		cfg.EjectionBalance,
+		cfg.MaxEffectiveBalance + cfg.EffectiveBalanceIncrement,
+	}
+	beaconState, privKeys := DeterministicGenesisStateWithBalances(t, balances)
+	if len(privKeys) != len(balances) {
+		t.Fatalf("Expected %d keys, received %d", len(balances), len(privKeys))
+	}
+	if !reflect.DeepEqual(beaconState.Balances(), balances) {
+		t.Errorf("Expected balances %v, received %v", balances, beaconState.Balances())
+	}
+	for i, balance := range balances {
+		val, err := beaconState.ValidatorAtIndexReadOnly(uint64(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		pubKey := val.PublicKey()
+		if !bytes.Equal(pubKey[:], privKeys[i].PublicKey().Marshal()) {
+			t.Errorf("Expected validator %d to have the public key of key %d", i, i)
+		}
+		active := val.ActivationEpoch() == 0
+		if wantActive := balance >= cfg.MaxEffectiveBalance; active != wantActive {
+			t.Errorf("Expected validator %d with balance %d to be active: %v", i, balance, wantActive)
+		}
+	}
+}
+
+func TestGenerateDepositTrieAndProofs_Verify(t *testing.T) {
+	deposits, proofs, root := GenerateDepositTrieAndProofs(t, 10)
+	if len(deposits) != 10 || len(proofs) != 10 {
+		t.Fatalf("Expected 10 deposits and proofs, received %d and %d", len(deposits), len(proofs))
+	}
+	eth1Data, err := DeterministicEth1Data(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(root[:], eth1Data.DepositRoot) {
+		t.Errorf("Expected root %#x, received %#x", eth1Data.DepositRoot, root)
+	}
+	for i, deposit := range deposits {
+		leaf, err := ssz.HashTreeRoot(deposit.Data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !trieutil.VerifyMerkleProof(root[:], leaf[:], i, proofs[i]) {
+			t.Errorf("Expected proof of deposit %d to verify against the root", i)
+		}
+	}
+}
+
+func TestGenerateEth1DataAt(t *testing.T) {
+	deposits, _, err := DeterministicDepositsAndKeys(8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blockHash := bytesutil.Bytes32(42)
+	eth1Data := GenerateEth1DataAt(t, deposits, blockHash, 5)
+	if !bytes.Equal(eth1Data.BlockHash, blockHash) {
+		t.Errorf("Expected block hash %#x, received %#x", blockHash, eth1Data.BlockHash)
+	}
+	if eth1Data.DepositCount != 5 {
+		t.Errorf("Expected deposit count 5, received %d", eth1Data.DepositCount)
+	}
+	want, err := DeterministicEth1Data(5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(eth1Data.DepositRoot, want.DepositRoot) {
+		t.Errorf("Expected deposit root %#x of the first 5 deposits, received %#x", want.DepositRoot, eth1Data.DepositRoot)
+	}
+}
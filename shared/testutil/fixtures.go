@@ -0,0 +1,59 @@
+package testutil
+
+import (
+	"io/ioutil"
+	"path"
+
+	"github.com/pkg/errors"
+	ethpb "github.com/prysmaticlabs/ethereumapis/eth/v1alpha1"
+	"github.com/prysmaticlabs/go-ssz"
+	stateTrie "github.com/prysmaticlabs/prysm/beacon-chain/state"
+	pb "github.com/prysmaticlabs/prysm/proto/beacon/p2p/v1"
+)
+
+// DumpBlockFixture writes the SSZ encoding of the block to <name>_block.ssz and of the state
+// after the block to <name>_state.ssz in the given directory, so generated blocks can be
+// replayed by other tools. LoadBlockFixture reads them back.
+func DumpBlockFixture(dir string, name string, block *ethpb.SignedBeaconBlock, postState *stateTrie.BeaconState) error {
+	enc, err := ssz.Marshal(block)
+	if err != nil {
+		return errors.Wrap(err, "could not ssz encode block")
+	}
+	if err := ioutil.WriteFile(path.Join(dir, name+"_block.ssz"), enc, 0664); err != nil {
+		return errors.Wrap(err, "could not write block")
+	}
+	enc, err = ssz.Marshal(postState.InnerStateUnsafe())
+	if err != nil {
+		return errors.Wrap(err, "could not ssz encode state")
+	}
+	if err := ioutil.WriteFile(path.Join(dir, name+"_state.ssz"), enc, 0664); err != nil {
+		return errors.Wrap(err, "could not write state")
+	}
+	return nil
+}
+
+// LoadBlockFixture reads the block and the state after the block written by DumpBlockFixture
+// with the given name in the given directory.
+func LoadBlockFixture(dir string, name string) (*ethpb.SignedBeaconBlock, *stateTrie.BeaconState, error) {
+	enc, err := ioutil.ReadFile(path.Join(dir, name+"_block.ssz"))
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "could not read block")
+	}
+	block := &ethpb.SignedBeaconBlock{}
+	if err := ssz.Unmarshal(enc, block); err != nil {
+		return nil, nil, errors.Wrap(err, "could not ssz decode block")
+	}
+	enc, err = ioutil.ReadFile(path.Join(dir, name+"_state.ssz"))
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "could not read state")
+	}
+	protoState := &pb.BeaconState{}
+	if err := ssz.Unmarshal(enc, protoState); err != nil {
+		return nil, nil, errors.Wrap(err, "could not ssz decode state")
+	}
+	postState, err := stateTrie.InitializeFromProtoUnsafe(protoState)
+	if err != nil {
+		return nil, nil, err
+	}
+	return block, postState, nil
+}
@@ -0,0 +1,59 @@
+package testutil
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/prysmaticlabs/prysm/shared/params"
+)
+
+func TestDumpBlockFixture_LoadsChain(t *testing.T) {
+	params.OverrideBeaconConfig(params.MinimalSpecConfig())
+	defer params.OverrideBeaconConfig(params.MainnetConfig())
+	beaconState, privs := DeterministicGenesisState(t, 64)
+	conf := &BlockGenConfig{
+		NumAttestations: 2,
+	}
+	chain, postState, err := GenerateFullBlockChain(beaconState, privs, conf, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir(TempDir(), "fixtures")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	block := chain[len(chain)-1]
+	if err := DumpBlockFixture(dir, "chain", block, postState); err != nil {
+		t.Fatal(err)
+	}
+	loadedBlock, loadedState, err := LoadBlockFixture(dir, "chain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !proto.Equal(loadedBlock, block) {
+		t.Error("Expected loaded block to equal the dumped block")
+	}
+	root, err := postState.HashTreeRoot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	loadedRoot, err := loadedState.HashTreeRoot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loadedRoot != root {
+		t.Errorf("Expected loaded state root %#x, received %#x", root, loadedRoot)
+	}
+
+	if _, _, err := LoadBlockFixture(dir, "missing"); err == nil {
+		t.Error("Expected error loading a missing fixture")
+	}
+}
@@ -0,0 +1,84 @@
+package testutil
+
+import (
+	"context"
+	"sync"
+
+	"github.com/pkg/errors"
+	ethpb "github.com/prysmaticlabs/ethereumapis/eth/v1alpha1"
+	"github.com/prysmaticlabs/go-ssz"
+	"github.com/prysmaticlabs/prysm/beacon-chain/core/state"
+	stateTrie "github.com/prysmaticlabs/prysm/beacon-chain/state"
+	"github.com/prysmaticlabs/prysm/shared/bls"
+)
+
+// fuzzValidatorCount is the number of validators of the genesis state blocks are processed
+// against by FuzzBlockProcessing.
+const fuzzValidatorCount = 64
+
+var (
+	fuzzStateOnce sync.Once
+	fuzzState     *stateTrie.BeaconState
+	fuzzPrivs     []*bls.SecretKey
+	fuzzStateErr  error
+)
+
+// fuzzGenesisState returns the deterministic genesis state blocks are processed against by
+// FuzzBlockProcessing, which is generated once as fuzzing runs the entry point in a loop.
+func fuzzGenesisState() (*stateTrie.BeaconState, []*bls.SecretKey, error) {
+	fuzzStateOnce.Do(func() {
+		deposits, privs, err := DeterministicDepositsAndKeys(fuzzValidatorCount)
+		if err != nil {
+			fuzzStateErr = errors.Wrapf(err, "failed to get %d deposits", fuzzValidatorCount)
+			return
+		}
+		eth1Data, err := DeterministicEth1Data(len(deposits))
+		if err != nil {
+			fuzzStateErr = errors.Wrapf(err, "failed to get eth1data for %d deposits", fuzzValidatorCount)
+			return
+		}
+		fuzzState, fuzzStateErr = state.GenesisBeaconState(deposits, uint64(0), eth1Data)
+		fuzzPrivs = privs
+	})
+	return fuzzState, fuzzPrivs, fuzzStateErr
+}
+
+// FuzzBlockProcessing is a go-fuzz entry point decoding the data as an SSZ encoded signed
+// block and running the state transition of the block on a deterministic genesis state.
+// Invalid blocks must fail with an error, so any panic is reported as a crash. It returns
+// 1 for blocks passing the state transition, so the fuzzer favors them, and 0 otherwise.
+func FuzzBlockProcessing(data []byte) int {
+	block := &ethpb.SignedBeaconBlock{}
+	if err := ssz.Unmarshal(data, block); err != nil {
+		return 0
+	}
+	genesisState, _, err := fuzzGenesisState()
+	if err != nil {
+		panic(err)
+	}
+	if _, err := state.ExecuteStateTransition(context.Background(), genesisState.Copy(), block); err != nil {
+		return 0
+	}
+	return 1
+}
+
+// BlockProcessingFuzzCorpus returns the SSZ encodings of blocks generated with the given
+// configs on top of the genesis state of FuzzBlockProcessing, as its seed corpus.
+func BlockProcessingFuzzCorpus(confs []*BlockGenConfig) ([][]byte, error) {
+	genesisState, privs, err := fuzzGenesisState()
+	if err != nil {
+		return nil, err
+	}
+	corpus := make([][]byte, len(confs))
+	for i, conf := range confs {
+		block, err := GenerateFullBlock(genesisState, privs, conf, genesisState.Slot())
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not generate block %d", i)
+		}
+		corpus[i], err = ssz.Marshal(block)
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not ssz encode block %d", i)
+		}
+	}
+	return corpus, nil
+}
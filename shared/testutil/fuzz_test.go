@@ -0,0 +1,32 @@
+package testutil
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestFuzzBlockProcessing_100(t *testing.T) {
+	corpus, err := BlockProcessingFuzzCorpus([]*BlockGenConfig{
+		{},
+		{NumAttestations: 1},
+		{NumProposerSlashings: 1, NumAttesterSlashings: 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, enc := range corpus {
+		if FuzzBlockProcessing(enc) != 1 {
+			t.Errorf("Expected generated block %d to pass the state transition", i)
+		}
+	}
+
+	randGen := rand.New(rand.NewSource(0))
+	for i := 0; i < 100; i++ {
+		enc := append([]byte{}, corpus[i%len(corpus)]...)
+		for j := 0; j < 1+randGen.Intn(8); j++ {
+			enc[randGen.Intn(len(enc))] ^= byte(1 + randGen.Intn(255))
+		}
+		// Any mutated block must be rejected with an error rather than a panic.
+		FuzzBlockProcessing(enc)
+	}
+}
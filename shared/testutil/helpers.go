@@ -1,19 +1,27 @@
 package testutil
 
 import (
+	"bytes"
 	"context"
 	"encoding/binary"
+	"fmt"
 	"math/rand"
+	"sort"
+	"strings"
 	"testing"
 
+	"github.com/gogo/protobuf/proto"
 	"github.com/pkg/errors"
 	ethpb "github.com/prysmaticlabs/ethereumapis/eth/v1alpha1"
 	"github.com/prysmaticlabs/go-ssz"
 
+	"github.com/prysmaticlabs/prysm/beacon-chain/core/blocks"
 	"github.com/prysmaticlabs/prysm/beacon-chain/core/helpers"
 	"github.com/prysmaticlabs/prysm/beacon-chain/core/state"
 	stateTrie "github.com/prysmaticlabs/prysm/beacon-chain/state"
+	"github.com/prysmaticlabs/prysm/shared/attestationutil"
 	"github.com/prysmaticlabs/prysm/shared/bls"
+	"github.com/prysmaticlabs/prysm/shared/hashutil"
 	"github.com/prysmaticlabs/prysm/shared/params"
 )
 
@@ -24,10 +32,25 @@ func RandaoReveal(beaconState *stateTrie.BeaconState, epoch uint64, privKeys []*
 	if err != nil {
 		return []byte{}, errors.Wrap(err, "could not get beacon proposer index")
 	}
+	return RandaoRevealForProposer(beaconState, epoch, proposerIdx, privKeys)
+}
+
+// RandaoRevealForProposer returns a signature of the requested epoch using the private key
+// of the given proposer, with the domain of the epoch for the fork of the state. Unlike
+// RandaoReveal, the proposer doesn't have to be the proposer of the state slot, e.g. for a
+// block in the first slot of an epoch the state has not processed yet.
+func RandaoRevealForProposer(
+	beaconState *stateTrie.BeaconState,
+	epoch uint64,
+	proposerIdx uint64,
+	privKeys []*bls.SecretKey,
+) ([]byte, error) {
+	if proposerIdx >= uint64(len(privKeys)) {
+		return []byte{}, fmt.Errorf("no private key for proposer %d", proposerIdx)
+	}
 	buf := make([]byte, 32)
 	binary.LittleEndian.PutUint64(buf, epoch)
 	domain := helpers.Domain(beaconState.Fork(), epoch, params.BeaconConfig().DomainRandao)
-	// We make the previous validator's index sign the message instead of the proposer.
 	epochSignature := privKeys[proposerIdx].Sign(buf, domain)
 	return epochSignature.Marshal(), nil
 }
@@ -38,32 +61,449 @@ func BlockSignature(
 	block *ethpb.BeaconBlock,
 	privKeys []*bls.SecretKey,
 ) (*bls.Signature, error) {
-	var err error
-	s, err := state.CalculateStateRoot(context.Background(), bState, &ethpb.SignedBeaconBlock{Block: block})
+	return blockSignature(context.Background(), bState, block, privKeys)
+}
+
+func blockSignature(
+	ctx context.Context,
+	bState *stateTrie.BeaconState,
+	block *ethpb.BeaconBlock,
+	privKeys []*bls.SecretKey,
+) (*bls.Signature, error) {
+	signature, _, err := signBlock(ctx, bState, block, privKeys)
+	return signature, err
+}
+
+// signBlock sets the state root of the block to the root of the state after the block
+// and returns the proposer signature along with that state. Like state.CalculateStateRoot,
+// it does not verify the block signatures.
+func signBlock(
+	ctx context.Context,
+	bState *stateTrie.BeaconState,
+	block *ethpb.BeaconBlock,
+	privKeys []*bls.SecretKey,
+) (*bls.Signature, *stateTrie.BeaconState, error) {
+	postState, err := processBlockForStateRoot(ctx, bState, block)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	block.StateRoot = s[:]
 
 	blockRoot, err := ssz.HashTreeRoot(block)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	signature, err := proposerSignature(bState, block.Slot, blockRoot[:], privKeys)
+	if err != nil {
+		return nil, nil, err
 	}
-	// Temporarily increasing the beacon state slot here since BeaconProposerIndex is a
-	// function deterministic on beacon state slot.
-	currentSlot := bState.Slot()
-	if err := bState.SetSlot(block.Slot); err != nil {
+	return signature, postState, nil
+}
+
+// processBlockForStateRoot sets the state root of the block to the root of the state after
+// the block, without verifying the block signatures, and returns that state.
+func processBlockForStateRoot(
+	ctx context.Context,
+	bState *stateTrie.BeaconState,
+	block *ethpb.BeaconBlock,
+) (*stateTrie.BeaconState, error) {
+	headState, err := state.ProcessSlots(ctx, bState.Copy(), block.Slot)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not process slot")
+	}
+	return processBlockOnHeadState(ctx, headState, block)
+}
+
+// processBlockOnHeadState is processBlockForStateRoot given the state at the slot of the
+// block, which is used as the post state.
+func processBlockOnHeadState(
+	ctx context.Context,
+	headState *stateTrie.BeaconState,
+	block *ethpb.BeaconBlock,
+) (*stateTrie.BeaconState, error) {
+	blocks.ClearEth1DataVoteCache()
+	postState, err := state.ProcessBlockForStateRoot(ctx, headState, &ethpb.SignedBeaconBlock{Block: block})
+	if err != nil {
+		return nil, errors.Wrap(err, "could not process block")
+	}
+	s, err := postState.HashTreeRoot()
+	if err != nil {
 		return nil, err
 	}
-	proposerIdx, err := helpers.BeaconProposerIndex(bState)
+	block.StateRoot = s[:]
+	return postState, nil
+}
+
+// BlockSigningRoot returns the root the proposer of the block signs, along with the index
+// of that proposer and the signing domain, as computed by GenerateFullBlock for the block on
+// top of the given state. Tools signing blocks out of process can sign generated blocks
+// with these.
+func BlockSigningRoot(bState *stateTrie.BeaconState, block *ethpb.BeaconBlock) ([32]byte, uint64, uint64, error) {
+	root, err := ssz.HashTreeRoot(block)
+	if err != nil {
+		return [32]byte{}, 0, 0, errors.Wrap(err, "could not get block root")
+	}
+	proposerIdx, domain, err := proposerAndDomain(bState, block.Slot)
+	if err != nil {
+		return [32]byte{}, 0, 0, err
+	}
+	return root, proposerIdx, domain, nil
+}
+
+// proposerSignature signs the given root with the private key of the proposer of the
+// given slot, under the beacon proposer domain.
+func proposerSignature(
+	bState *stateTrie.BeaconState,
+	slot uint64,
+	root []byte,
+	privKeys []*bls.SecretKey,
+) (*bls.Signature, error) {
+	proposerIdx, domain, err := proposerAndDomain(bState, slot)
 	if err != nil {
 		return nil, err
 	}
-	domain := helpers.Domain(bState.Fork(), helpers.CurrentEpoch(bState), params.BeaconConfig().DomainBeaconProposer)
-	if err := bState.SetSlot(currentSlot); err != nil {
+	return privKeys[proposerIdx].Sign(root, domain), nil
+}
+
+// proposerAndDomain returns the index of the proposer of the given slot and the beacon
+// proposer domain of that slot. The given state is not mutated, so it can be shared by
+// concurrent callers.
+func proposerAndDomain(bState *stateTrie.BeaconState, slot uint64) (uint64, uint64, error) {
+	// BeaconProposerIndex is a function deterministic on beacon state slot, so it is
+	// computed on a copy of the state at the given slot.
+	slotState := bState.Copy()
+	if err := slotState.SetSlot(slot); err != nil {
+		return 0, 0, err
+	}
+	proposerIdx, err := helpers.BeaconProposerIndex(slotState)
+	if err != nil {
+		return 0, 0, err
+	}
+	domain := helpers.Domain(slotState.Fork(), helpers.CurrentEpoch(slotState), params.BeaconConfig().DomainBeaconProposer)
+	return proposerIdx, domain, nil
+}
+
+// proposerCache memoizes proposerAndDomain by slot for a state which is not mutated
+// between lookups. A nil cache computes every lookup.
+type proposerCache map[uint64]proposerDuty
+
+type proposerDuty struct {
+	index  uint64
+	domain uint64
+}
+
+// proposerAndDomain is proposerAndDomain, looked up in the cache when it is set.
+func (c proposerCache) proposerAndDomain(bState *stateTrie.BeaconState, slot uint64) (uint64, uint64, error) {
+	if c == nil {
+		return proposerAndDomain(bState, slot)
+	}
+	if duty, ok := c[slot]; ok {
+		return duty.index, duty.domain, nil
+	}
+	proposerIdx, domain, err := proposerAndDomain(bState, slot)
+	if err != nil {
+		return 0, 0, err
+	}
+	c[slot] = proposerDuty{index: proposerIdx, domain: domain}
+	return proposerIdx, domain, nil
+}
+
+// ProposerSchedule returns the index of the beacon proposer for every slot of the current
+// epoch of the given state, in slot order. The schedule is fully determined by the state's
+// randao mixes and active validators, so blocks generated on top of the state for any of
+// these slots are signed by the proposer at the corresponding position.
+func ProposerSchedule(bState *stateTrie.BeaconState) ([]uint64, error) {
+	bState = bState.Copy()
+	startSlot := helpers.StartSlot(helpers.CurrentEpoch(bState))
+	proposers := make([]uint64, params.BeaconConfig().SlotsPerEpoch)
+	for i := range proposers {
+		if err := bState.SetSlot(startSlot + uint64(i)); err != nil {
+			return nil, err
+		}
+		proposerIdx, err := helpers.BeaconProposerIndex(bState)
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not get proposer index of slot %d", bState.Slot())
+		}
+		proposers[i] = proposerIdx
+	}
+	return proposers, nil
+}
+
+// FindSlotForProposer returns the first slot after the slot of the given state, and at most
+// searchRange slots after it, at which the given validator is the beacon proposer. The
+// state is advanced through the slots on a copy, so the proposer is the one the block is
+// verified against, and the slot can be passed to GenerateFullBlock to generate a block
+// proposed by the validator.
+func FindSlotForProposer(bState *stateTrie.BeaconState, proposerIndex uint64, searchRange uint64) (uint64, error) {
+	if proposerIndex >= uint64(bState.NumValidators()) {
+		return 0, fmt.Errorf("validator %d does not exist", proposerIndex)
+	}
+	bState = bState.Copy()
+	startSlot := bState.Slot()
+	for slot := startSlot + 1; slot <= startSlot+searchRange; slot++ {
+		var err error
+		bState, err = state.ProcessSlots(context.Background(), bState, slot)
+		if err != nil {
+			return 0, errors.Wrapf(err, "could not process slots up to %d", slot)
+		}
+		idx, err := helpers.BeaconProposerIndex(bState)
+		if err != nil {
+			return 0, errors.Wrapf(err, "could not get proposer index of slot %d", slot)
+		}
+		if idx == proposerIndex {
+			return slot, nil
+		}
+	}
+	return 0, fmt.Errorf("validator %d is not a proposer within %d slots of slot %d", proposerIndex, searchRange, startSlot)
+}
+
+// CommitteesAtSlot returns the beacon committees of the given slot in the order of their
+// committee index. The committee count is that of the epoch of the slot, as used by
+// attestation processing.
+func CommitteesAtSlot(bState *stateTrie.BeaconState, slot uint64) ([][]uint64, error) {
+	activeCount, err := helpers.ActiveValidatorCount(bState, helpers.SlotToEpoch(slot))
+	if err != nil {
 		return nil, err
 	}
-	return privKeys[proposerIdx].Sign(blockRoot[:], domain), nil
+	committeeCount := helpers.SlotCommitteeCount(activeCount)
+	committees := make([][]uint64, committeeCount)
+	for c := uint64(0); c < committeeCount; c++ {
+		committee, err := helpers.BeaconCommitteeFromState(bState, slot, c)
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not get committee %d of slot %d", c, slot)
+		}
+		committees[c] = committee
+	}
+	return committees, nil
+}
+
+// AssertTransitionError runs the state transition of the given block on a copy of the given
+// state, so the caller's state is never mutated, and fails the test unless the transition
+// returns an error containing wantErr.
+func AssertTransitionError(t testing.TB, bState *stateTrie.BeaconState, block *ethpb.SignedBeaconBlock, wantErr string) {
+	_, err := state.ExecuteStateTransition(context.Background(), bState.Copy(), block)
+	if err == nil {
+		t.Fatalf("Expected state transition of block at slot %d to fail with %q, but it succeeded", block.Block.Slot, wantErr)
+	}
+	if !strings.Contains(err.Error(), wantErr) {
+		t.Fatalf("Expected state transition error containing %q, received %v", wantErr, err)
+	}
+}
+
+// AssertBlockProcessable runs the state transition of the given block on a copy of the
+// given state, so the caller's state is never mutated, and fails the test unless the
+// transition succeeds with a post state matching the state root of the block.
+func AssertBlockProcessable(t testing.TB, bState *stateTrie.BeaconState, block *ethpb.SignedBeaconBlock) {
+	if err := blockProcessable(context.Background(), bState, block); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// blockProcessable returns an error unless the state transition of the given block on a
+// copy of the given state succeeds with a post state matching the state root of the block.
+func blockProcessable(ctx context.Context, bState *stateTrie.BeaconState, block *ethpb.SignedBeaconBlock) error {
+	postState, err := state.ExecuteStateTransition(ctx, bState.Copy(), block)
+	if err != nil {
+		return errors.Wrapf(err, "could not process block at slot %d", block.Block.Slot)
+	}
+	root, err := postState.HashTreeRoot()
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(root[:], block.Block.StateRoot) {
+		return fmt.Errorf("state root of block at slot %d is %#x, but the post state root is %#x", block.Block.Slot, block.Block.StateRoot, root)
+	}
+	return nil
+}
+
+// AssertBlockSSZRoundTrip fails the test unless the given block is decoded from its SSZ
+// encoding into an equal block with the same hash tree root.
+func AssertBlockSSZRoundTrip(t testing.TB, block *ethpb.SignedBeaconBlock) {
+	enc, err := ssz.Marshal(block)
+	if err != nil {
+		t.Fatalf("Could not SSZ encode block: %v", err)
+	}
+	decoded := &ethpb.SignedBeaconBlock{}
+	if err := ssz.Unmarshal(enc, decoded); err != nil {
+		t.Fatalf("Could not SSZ decode block: %v", err)
+	}
+	if !proto.Equal(block, decoded) {
+		t.Fatalf("Expected decoded block %v to equal the encoded block %v", decoded, block)
+	}
+	root, err := ssz.HashTreeRoot(block.Block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decodedRoot, err := ssz.HashTreeRoot(decoded.Block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if root != decodedRoot {
+		t.Fatalf("Expected decoded block root %#x to equal the encoded block root %#x", decodedRoot, root)
+	}
+}
+
+// VerifyAttestations verifies the signatures of all the given attestations against the
+// committees of the state with a single aggregate verification per signing domain. If the
+// batch fails, each attestation is verified on its own and the error names the index of
+// the first attestation with an invalid signature.
+func VerifyAttestations(bState *stateTrie.BeaconState, atts []*ethpb.Attestation) error {
+	type signedAttestation struct {
+		pubkey *bls.PublicKey
+		msg    [32]byte
+		sig    *bls.Signature
+		domain uint64
+	}
+	type batch struct {
+		pubkeys map[[32]byte]*bls.PublicKey
+		sigs    []*bls.Signature
+	}
+
+	signed := make([]*signedAttestation, len(atts))
+	batches := make(map[uint64]*batch)
+	for i, att := range atts {
+		committee, err := helpers.BeaconCommitteeFromState(bState, att.Data.Slot, att.Data.CommitteeIndex)
+		if err != nil {
+			return errors.Wrapf(err, "could not get committee of attestation %d", i)
+		}
+		indexedAtt, err := attestationutil.ConvertToIndexed(context.Background(), att, committee)
+		if err != nil {
+			return errors.Wrapf(err, "could not convert attestation %d to indexed form", i)
+		}
+		if len(indexedAtt.AttestingIndices) == 0 {
+			return fmt.Errorf("attestation %d has no attesting indices", i)
+		}
+		var pubkey *bls.PublicKey
+		for _, idx := range indexedAtt.AttestingIndices {
+			pubkeyAtIdx := bState.PubkeyAtIndex(idx)
+			pk, err := bls.PublicKeyFromBytes(pubkeyAtIdx[:])
+			if err != nil {
+				return errors.Wrapf(err, "could not deserialize public key of validator %d", idx)
+			}
+			if pubkey == nil {
+				pubkey = pk
+				continue
+			}
+			pubkey.Aggregate(pk)
+		}
+		msg, err := ssz.HashTreeRoot(att.Data)
+		if err != nil {
+			return errors.Wrapf(err, "could not hash data of attestation %d", i)
+		}
+		sig, err := bls.SignatureFromBytes(att.Signature)
+		if err != nil {
+			return errors.Wrapf(err, "could not deserialize signature of attestation %d", i)
+		}
+		domain := helpers.Domain(bState.Fork(), att.Data.Target.Epoch, params.BeaconConfig().DomainBeaconAttester)
+		signed[i] = &signedAttestation{pubkey: pubkey, msg: msg, sig: sig, domain: domain}
+
+		b, ok := batches[domain]
+		if !ok {
+			b = &batch{pubkeys: make(map[[32]byte]*bls.PublicKey)}
+			batches[domain] = b
+		}
+		b.sigs = append(b.sigs, sig)
+		// Attestations over the same data are verified against their combined public key,
+		// so every message of the aggregate verification is distinct.
+		if batchPubkey, ok := b.pubkeys[msg]; ok {
+			batchPubkey.Aggregate(pubkey)
+		} else {
+			batchPubkey, err := pubkey.Copy()
+			if err != nil {
+				return err
+			}
+			b.pubkeys[msg] = batchPubkey
+		}
+	}
+
+	valid := true
+	for domain, b := range batches {
+		pubkeys := make([]*bls.PublicKey, 0, len(b.pubkeys))
+		msgs := make([][32]byte, 0, len(b.pubkeys))
+		for msg, pubkey := range b.pubkeys {
+			pubkeys = append(pubkeys, pubkey)
+			msgs = append(msgs, msg)
+		}
+		if !bls.AggregateSignatures(b.sigs).VerifyAggregate(pubkeys, msgs, domain) {
+			valid = false
+			break
+		}
+	}
+	if valid {
+		return nil
+	}
+	for i, s := range signed {
+		if !s.sig.Verify(s.msg[:], s.pubkey, s.domain) {
+			return fmt.Errorf("attestation %d has an invalid signature", i)
+		}
+	}
+	return errors.New("attestation signatures failed batch verification")
+}
+
+// AttestationsHashTreeRoot returns the hash tree root of the given attestations as the
+// attestations list of a block body, so tests can pin the root of generated attestations
+// and detect changes to the generation logic. The list limit is MAX_ATTESTATIONS of the
+// current beacon config.
+func AttestationsHashTreeRoot(atts []*ethpb.Attestation) ([32]byte, error) {
+	maxAtts := params.BeaconConfig().MaxAttestations
+	if uint64(len(atts)) > maxAtts {
+		return [32]byte{}, fmt.Errorf("%d attestations exceed the maximum of %d", len(atts), maxAtts)
+	}
+	layer := make([][32]byte, len(atts))
+	for i, att := range atts {
+		root, err := ssz.HashTreeRoot(att)
+		if err != nil {
+			return [32]byte{}, errors.Wrapf(err, "could not get root of attestation %d", i)
+		}
+		layer[i] = root
+	}
+	// Merkleize the roots padded with zero subtrees up to the list limit.
+	var zeroRoot [32]byte
+	for width := uint64(1); width < maxAtts; width *= 2 {
+		if len(layer)%2 == 1 {
+			layer = append(layer, zeroRoot)
+		}
+		next := make([][32]byte, len(layer)/2)
+		for i := range next {
+			next[i] = hashutil.Hash(append(layer[2*i][:], layer[2*i+1][:]...))
+		}
+		layer = next
+		zeroRoot = hashutil.Hash(append(zeroRoot[:], zeroRoot[:]...))
+	}
+	root := zeroRoot
+	if len(layer) > 0 {
+		root = layer[0]
+	}
+	length := make([]byte, 32)
+	binary.LittleEndian.PutUint64(length, uint64(len(atts)))
+	return hashutil.Hash(append(root[:], length...)), nil
+}
+
+// ParticipatingIndices returns the sorted set of validator indices attesting in the given
+// attestations, resolved through the committees of the state, so tests can assert which
+// validators generated attestations cover.
+func ParticipatingIndices(bState *stateTrie.BeaconState, atts []*ethpb.Attestation) ([]uint64, error) {
+	participants := make(map[uint64]bool)
+	for i, att := range atts {
+		committee, err := helpers.BeaconCommitteeFromState(bState, att.Data.Slot, att.Data.CommitteeIndex)
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not get committee of attestation %d", i)
+		}
+		indices, err := attestationutil.AttestingIndices(att.AggregationBits, committee)
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not get attesting indices of attestation %d", i)
+		}
+		for _, idx := range indices {
+			participants[idx] = true
+		}
+	}
+	indices := make([]uint64, 0, len(participants))
+	for idx := range participants {
+		indices = append(indices, idx)
+	}
+	sort.Slice(indices, func(i, j int) bool {
+		return indices[i] < indices[j]
+	})
+	return indices, nil
 }
 
 // Random32Bytes generates a random 32 byte slice.
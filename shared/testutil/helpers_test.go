@@ -2,11 +2,19 @@ package testutil
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
+	"fmt"
+	"reflect"
+	"sort"
 	"testing"
 
+	ethpb "github.com/prysmaticlabs/ethereumapis/eth/v1alpha1"
 	"github.com/prysmaticlabs/go-ssz"
+	"github.com/prysmaticlabs/prysm/beacon-chain/core/blocks"
 	"github.com/prysmaticlabs/prysm/beacon-chain/core/helpers"
+	"github.com/prysmaticlabs/prysm/beacon-chain/core/state"
+	"github.com/prysmaticlabs/prysm/shared/bls"
 	"github.com/prysmaticlabs/prysm/shared/params"
 )
 
@@ -64,3 +72,378 @@ func TestRandaoReveal(t *testing.T) {
 		t.Errorf("Expected randao reveals to be equal, received %#x != %#x", randaoReveal[:], epochSignature[:])
 	}
 }
+
+func TestProposerSchedule_MatchesGeneratedBlocks(t *testing.T) {
+	params.OverrideBeaconConfig(params.MinimalSpecConfig())
+	defer params.OverrideBeaconConfig(params.MainnetConfig())
+	beaconState, privKeys := DeterministicGenesisState(t, 64)
+
+	schedule, err := ProposerSchedule(beaconState)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := ProposerSchedule(beaconState)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(schedule, again) {
+		t.Fatalf("Expected the same proposer schedule, received %v and %v", schedule, again)
+	}
+
+	for slot := uint64(1); slot < params.BeaconConfig().SlotsPerEpoch; slot++ {
+		block, err := GenerateFullBlock(beaconState, privKeys, &BlockGenConfig{}, slot)
+		if err != nil {
+			t.Fatal(err)
+		}
+		beaconState, err = state.ExecuteStateTransition(context.Background(), beaconState, block)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		signingRoot, err := ssz.HashTreeRoot(block.Block)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig, err := bls.SignatureFromBytes(block.Signature)
+		if err != nil {
+			t.Fatal(err)
+		}
+		domain := helpers.Domain(beaconState.Fork(), 0, params.BeaconConfig().DomainBeaconProposer)
+		if !sig.Verify(signingRoot[:], privKeys[schedule[slot]].PublicKey(), domain) {
+			t.Errorf("Expected block at slot %d to be signed by scheduled proposer %d", slot, schedule[slot])
+		}
+	}
+}
+
+func TestFindSlotForProposer(t *testing.T) {
+	params.OverrideBeaconConfig(params.MinimalSpecConfig())
+	defer params.OverrideBeaconConfig(params.MainnetConfig())
+	beaconState, privKeys := DeterministicGenesisState(t, 64)
+	schedule, err := ProposerSchedule(beaconState)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proposerIdx := schedule[5]
+
+	slot, err := FindSlotForProposer(beaconState, proposerIdx, params.BeaconConfig().SlotsPerEpoch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if slot == 0 || slot > 5 {
+		t.Fatalf("Expected slot between 1 and 5, received %d", slot)
+	}
+	if schedule[slot] != proposerIdx {
+		t.Errorf("Expected proposer %d at slot %d, received %d", proposerIdx, slot, schedule[slot])
+	}
+	block, err := GenerateFullBlock(beaconState, privKeys, nil, slot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := state.ExecuteStateTransition(context.Background(), beaconState.Copy(), block); err != nil {
+		t.Errorf("Expected block proposed by validator %d to be valid: %v", proposerIdx, err)
+	}
+
+	if _, err := FindSlotForProposer(beaconState, proposerIdx, 0); err == nil {
+		t.Error("Expected error for an empty search range")
+	}
+	if _, err := FindSlotForProposer(beaconState, uint64(len(privKeys)), 1); err == nil {
+		t.Error("Expected error for a validator that does not exist")
+	}
+}
+
+func TestCommitteesAtSlot(t *testing.T) {
+	params.OverrideBeaconConfig(params.MinimalSpecConfig())
+	defer params.OverrideBeaconConfig(params.MainnetConfig())
+	beaconState, _ := DeterministicGenesisState(t, 64)
+	seen := make(map[uint64]bool)
+	for slot := uint64(0); slot < params.BeaconConfig().SlotsPerEpoch; slot++ {
+		committees, err := CommitteesAtSlot(beaconState, slot)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(committees) != 2 {
+			t.Fatalf("Expected 2 committees at slot %d, received %d", slot, len(committees))
+		}
+		for c, committee := range committees {
+			want, err := helpers.BeaconCommitteeFromState(beaconState, slot, uint64(c))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(committee, want) {
+				t.Errorf("Expected committee %d of slot %d to be %v, received %v", c, slot, want, committee)
+			}
+			for _, idx := range committee {
+				seen[idx] = true
+			}
+		}
+	}
+	if len(seen) != 64 {
+		t.Errorf("Expected every validator in a committee of the epoch, received %d", len(seen))
+	}
+}
+
+func TestAssertTransitionError_DoesNotMutateState(t *testing.T) {
+	beaconState, privKeys := DeterministicGenesisState(t, 64)
+	conf := &BlockGenConfig{
+		Corruption: CorruptProposerSigningRoot,
+	}
+	block, err := GenerateFullBlock(beaconState, privKeys, conf, beaconState.Slot())
+	if err != nil {
+		t.Fatal(err)
+	}
+	preRoot, err := beaconState.HashTreeRoot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	AssertTransitionError(t, beaconState, block, blocks.ErrSigFailedToVerify.Error())
+
+	postRoot, err := beaconState.HashTreeRoot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if preRoot != postRoot {
+		t.Errorf("Expected state to not be mutated, root changed from %#x to %#x", preRoot, postRoot)
+	}
+}
+
+func TestAssertBlockProcessable_DoesNotMutateState(t *testing.T) {
+	beaconState, privKeys := DeterministicGenesisState(t, 64)
+	block, err := GenerateFullBlock(beaconState, privKeys, DefaultBlockGenConfig(), beaconState.Slot())
+	if err != nil {
+		t.Fatal(err)
+	}
+	preRoot, err := beaconState.HashTreeRoot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	AssertBlockProcessable(t, beaconState, block)
+
+	postRoot, err := beaconState.HashTreeRoot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if preRoot != postRoot {
+		t.Errorf("Expected state to not be mutated, root changed from %#x to %#x", preRoot, postRoot)
+	}
+}
+
+func TestBlockProcessable_CorruptStateRoot(t *testing.T) {
+	beaconState, privKeys := DeterministicGenesisState(t, 64)
+	conf := &BlockGenConfig{
+		Corruption: CorruptStateRoot,
+	}
+	block, err := GenerateFullBlock(beaconState, privKeys, conf, beaconState.Slot())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := blockProcessable(context.Background(), beaconState, block); err == nil {
+		t.Error("Expected error for a block with a corrupted state root")
+	}
+}
+
+func TestAssertBlockSSZRoundTrip_FullBlock(t *testing.T) {
+	params.OverrideBeaconConfig(params.MinimalSpecConfig())
+	defer params.OverrideBeaconConfig(params.MainnetConfig())
+	beaconState, privKeys := DeterministicGenesisState(t, 64)
+	if err := beaconState.SetSlot(3 + params.BeaconConfig().PersistentCommitteePeriod*params.BeaconConfig().SlotsPerEpoch); err != nil {
+		t.Fatal(err)
+	}
+	conf := &BlockGenConfig{
+		NumProposerSlashings: 1,
+		NumAttesterSlashings: 1,
+		NumAttestations:      2,
+		NumDeposits:          1,
+		NumVoluntaryExits:    1,
+		Graffiti:             []byte("round trip"),
+	}
+	block, err := GenerateFullBlock(beaconState, privKeys, conf, beaconState.Slot())
+	if err != nil {
+		t.Fatal(err)
+	}
+	AssertBlockSSZRoundTrip(t, block)
+}
+
+func TestRandaoRevealForProposer_FirstSlotOfEpoch(t *testing.T) {
+	params.OverrideBeaconConfig(params.MinimalSpecConfig())
+	defer params.OverrideBeaconConfig(params.MainnetConfig())
+	beaconState, privKeys := DeterministicGenesisState(t, 64)
+	beaconState, err := state.ProcessSlots(context.Background(), beaconState, params.BeaconConfig().SlotsPerEpoch-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The proposer of the first slot of the next epoch is only known after epoch processing.
+	nextEpochState, err := state.ProcessSlots(context.Background(), beaconState.Copy(), params.BeaconConfig().SlotsPerEpoch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proposerIdx, err := helpers.BeaconProposerIndex(nextEpochState)
+	if err != nil {
+		t.Fatal(err)
+	}
+	epoch := helpers.CurrentEpoch(nextEpochState)
+	randaoReveal, err := RandaoRevealForProposer(beaconState, epoch, proposerIdx, privKeys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := &ethpb.BeaconBlockBody{RandaoReveal: randaoReveal}
+	if _, err := blocks.ProcessRandao(nextEpochState, body); err != nil {
+		t.Errorf("Expected randao reveal to verify: %v", err)
+	}
+
+	if _, err := RandaoRevealForProposer(beaconState, epoch, uint64(len(privKeys)), privKeys); err == nil {
+		t.Error("Expected error for a proposer without a private key")
+	}
+}
+
+func TestVerifyAttestations(t *testing.T) {
+	params.OverrideBeaconConfig(params.MinimalSpecConfig())
+	defer params.OverrideBeaconConfig(params.MainnetConfig())
+	beaconState, privKeys := DeterministicGenesisState(t, 64)
+	atts, err := GenerateAttestations(beaconState, privKeys, 4, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(atts) < 2 {
+		t.Fatalf("Expected at least 2 attestations, received %d", len(atts))
+	}
+	if err := VerifyAttestations(beaconState, atts); err != nil {
+		t.Errorf("Expected generated attestations to verify: %v", err)
+	}
+
+	last := len(atts) - 1
+	atts[last].Signature = atts[0].Signature
+	wantErr := fmt.Sprintf("attestation %d has an invalid signature", last)
+	if err := VerifyAttestations(beaconState, atts); err == nil || err.Error() != wantErr {
+		t.Errorf("Expected error %q, received %v", wantErr, err)
+	}
+}
+
+func TestAttestationsHashTreeRoot_Stable(t *testing.T) {
+	params.OverrideBeaconConfig(params.MinimalSpecConfig())
+	defer params.OverrideBeaconConfig(params.MainnetConfig())
+	beaconState, privKeys := DeterministicGenesisState(t, 64)
+	atts, err := GenerateAttestations(beaconState, privKeys, 4, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := AttestationsHashTreeRoot(atts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := GenerateAttestations(beaconState, privKeys, 4, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	againRoot, err := AttestationsHashTreeRoot(again)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if root != againRoot {
+		t.Errorf("Expected the same attestations root %#x, received %#x", root, againRoot)
+	}
+
+	again[0].Data.BeaconBlockRoot = params.BeaconConfig().ZeroHash[:]
+	changedRoot, err := AttestationsHashTreeRoot(again)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if root == changedRoot {
+		t.Error("Expected a different attestations root after changing an attestation")
+	}
+}
+
+func TestAttestationsHashTreeRoot_ListLimitOfConfig(t *testing.T) {
+	beaconState, privKeys := DeterministicGenesisState(t, 64)
+	atts, err := GenerateAttestations(beaconState, privKeys, 1, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The attestations of a block body under the mainnet MAX_ATTESTATIONS.
+	type mainnetAttestations struct {
+		Attestations []*ethpb.Attestation `ssz-max:"128"`
+	}
+	want, err := ssz.HashTreeRoot(&mainnetAttestations{Attestations: atts})
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := AttestationsHashTreeRoot(atts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if root != want {
+		t.Errorf("Expected attestations root %#x, received %#x", want, root)
+	}
+
+	cfg := params.MainnetConfig()
+	cfg.MaxAttestations = 256
+	params.OverrideBeaconConfig(cfg)
+	defer params.OverrideBeaconConfig(params.MainnetConfig())
+	largerRoot, err := AttestationsHashTreeRoot(atts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if largerRoot == root {
+		t.Error("Expected a different attestations root under a different list limit")
+	}
+}
+
+func TestParticipatingIndices_CoversCommitteesOfSlot(t *testing.T) {
+	params.OverrideBeaconConfig(params.MinimalSpecConfig())
+	defer params.OverrideBeaconConfig(params.MainnetConfig())
+	beaconState, privKeys := DeterministicGenesisState(t, 64)
+	atts, err := GenerateAttestations(beaconState, privKeys, 4, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	participants, err := ParticipatingIndices(beaconState, atts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	committeeCount := helpers.SlotCommitteeCount(uint64(beaconState.NumValidators()))
+	var want []uint64
+	for i := uint64(0); i < committeeCount; i++ {
+		committee, err := helpers.BeaconCommitteeFromState(beaconState, 0, i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, committee...)
+	}
+	sort.Slice(want, func(i, j int) bool {
+		return want[i] < want[j]
+	})
+	if !reflect.DeepEqual(participants, want) {
+		t.Errorf("Expected participants %v, received %v", want, participants)
+	}
+
+	subset, err := ParticipatingIndices(beaconState, atts[:1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(subset) == 0 || len(subset) >= len(participants) {
+		t.Errorf("Expected a strict subset of %d participants, received %d", len(participants), len(subset))
+	}
+}
+
+func TestBlockSigningRoot_MatchesGeneratedSignature(t *testing.T) {
+	beaconState, privKeys := DeterministicGenesisState(t, 64)
+	block, err := GenerateFullBlock(beaconState, privKeys, nil, beaconState.Slot())
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, proposerIdx, domain, err := BlockSigningRoot(beaconState, block.Block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if beaconState.Slot() != 0 {
+		t.Errorf("Expected the state to be left at slot 0, received %d", beaconState.Slot())
+	}
+	sig := privKeys[proposerIdx].Sign(root[:], domain)
+	if !bytes.Equal(sig.Marshal(), block.Signature) {
+		t.Errorf("Expected signature %#x, received %#x", block.Signature, sig.Marshal())
+	}
+}
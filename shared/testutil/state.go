@@ -0,0 +1,249 @@
+package testutil
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	ethpb "github.com/prysmaticlabs/ethereumapis/eth/v1alpha1"
+	"github.com/prysmaticlabs/go-bitfield"
+	"github.com/prysmaticlabs/prysm/beacon-chain/core/helpers"
+	"github.com/prysmaticlabs/prysm/beacon-chain/core/state"
+	"github.com/prysmaticlabs/prysm/beacon-chain/core/validators"
+	stateTrie "github.com/prysmaticlabs/prysm/beacon-chain/state"
+	pb "github.com/prysmaticlabs/prysm/proto/beacon/p2p/v1"
+	"github.com/prysmaticlabs/prysm/shared/bls"
+	"github.com/prysmaticlabs/prysm/shared/params"
+)
+
+// GeneratePendingAttestations returns pending attestations with full participation for
+// every committee of every processed slot in the given epoch, as if each had been included
+// in a block with the given inclusion delay by the given proposer. The epoch must be the
+// current or previous epoch of the state, and the attestation data votes for the block
+// roots recorded in the state so source, target and head are all correct.
+func GeneratePendingAttestations(
+	bState *stateTrie.BeaconState,
+	epoch uint64,
+	inclusionDelay uint64,
+	proposerIndex uint64,
+) ([]*pb.PendingAttestation, error) {
+	currentEpoch := helpers.CurrentEpoch(bState)
+	if epoch != currentEpoch && epoch != helpers.PrevEpoch(bState) {
+		return nil, fmt.Errorf("epoch %d must be the current epoch %d or the previous epoch %d", epoch, currentEpoch, helpers.PrevEpoch(bState))
+	}
+	source := bState.CurrentJustifiedCheckpoint()
+	if epoch < currentEpoch {
+		source = bState.PreviousJustifiedCheckpoint()
+	}
+	targetRoot, err := helpers.BlockRoot(bState, epoch)
+	if err != nil {
+		return nil, err
+	}
+	activeCount, err := helpers.ActiveValidatorCount(bState, epoch)
+	if err != nil {
+		return nil, err
+	}
+	committeesPerSlot := helpers.SlotCommitteeCount(activeCount)
+
+	pendingAtts := []*pb.PendingAttestation{}
+	for slot := helpers.StartSlot(epoch); slot < helpers.StartSlot(epoch+1) && slot < bState.Slot(); slot++ {
+		headRoot, err := helpers.BlockRootAtSlot(bState, slot)
+		if err != nil {
+			return nil, err
+		}
+		for c := uint64(0); c < committeesPerSlot; c++ {
+			committee, err := helpers.BeaconCommitteeFromState(bState, slot, c)
+			if err != nil {
+				return nil, err
+			}
+			aggregationBits := bitfield.NewBitlist(uint64(len(committee)))
+			for i := range committee {
+				aggregationBits.SetBitAt(uint64(i), true)
+			}
+			pendingAtts = append(pendingAtts, &pb.PendingAttestation{
+				Data: &ethpb.AttestationData{
+					Slot:            slot,
+					CommitteeIndex:  c,
+					BeaconBlockRoot: headRoot,
+					Source:          source,
+					Target: &ethpb.Checkpoint{
+						Epoch: epoch,
+						Root:  targetRoot,
+					},
+				},
+				AggregationBits: aggregationBits,
+				InclusionDelay:  inclusionDelay,
+				ProposerIndex:   proposerIndex,
+			})
+		}
+	}
+	return pendingAtts, nil
+}
+
+// GenerateStateWithPendingAttestations returns a copy of the given state with its current
+// and previous epoch pending attestations replaced by the given lists, so epoch processing
+// can be tested without generating and processing blocks.
+func GenerateStateWithPendingAttestations(
+	bState *stateTrie.BeaconState,
+	current []*pb.PendingAttestation,
+	previous []*pb.PendingAttestation,
+) (*stateTrie.BeaconState, error) {
+	bState = bState.Copy()
+	if err := bState.SetCurrentEpochAttestations(current); err != nil {
+		return nil, err
+	}
+	if err := bState.SetPreviousEpochAttestations(previous); err != nil {
+		return nil, err
+	}
+	return bState, nil
+}
+
+// GenerateStateWithBalance returns a copy of the given state with the balance of each of
+// the given validator indices set to the given value. It is useful for crafting states
+// close to the bounds of the balance arithmetic, such as a balance near the maximum uint64.
+func GenerateStateWithBalance(bState *stateTrie.BeaconState, indices []uint64, balance uint64) (*stateTrie.BeaconState, error) {
+	bState = bState.Copy()
+	for _, idx := range indices {
+		if err := bState.UpdateBalancesAtIndex(idx, balance); err != nil {
+			return nil, fmt.Errorf("could not set balance of validator %d: %v", idx, err)
+		}
+	}
+	return bState, nil
+}
+
+// GenerateStateWithSlashedValidators returns a copy of the given state with the given
+// validators slashed at its current epoch as by block processing: each is queued for exit,
+// withdrawable EPOCHS_PER_SLASHINGS_VECTOR epochs later, penalized, and its effective
+// balance is added to the slashings of the epoch, ready for testing the slashing penalties
+// of epoch processing. The proposer of the current slot is rewarded as the whistleblower.
+func GenerateStateWithSlashedValidators(bState *stateTrie.BeaconState, indices []uint64) (*stateTrie.BeaconState, error) {
+	bState = bState.Copy()
+	for _, idx := range indices {
+		val, err := bState.ValidatorAtIndexReadOnly(idx)
+		if err != nil {
+			return nil, err
+		}
+		if val.Slashed() {
+			return nil, fmt.Errorf("validator %d is already slashed", idx)
+		}
+		bState, err = validators.SlashValidator(bState, idx, 0)
+		if err != nil {
+			return nil, fmt.Errorf("could not slash validator %d: %v", idx, err)
+		}
+	}
+	return bState, nil
+}
+
+// GenerateStateWithEffectiveBalance returns a copy of the given state with the effective
+// balance of each of the given validator indices set to the given value, e.g. to pin the
+// effective balance the slashing penalties and whistleblower rewards are computed from.
+func GenerateStateWithEffectiveBalance(
+	bState *stateTrie.BeaconState,
+	indices []uint64,
+	effectiveBalance uint64,
+) (*stateTrie.BeaconState, error) {
+	bState = bState.Copy()
+	for _, idx := range indices {
+		val, err := bState.ValidatorAtIndex(idx)
+		if err != nil {
+			return nil, fmt.Errorf("could not get validator %d: %v", idx, err)
+		}
+		val.EffectiveBalance = effectiveBalance
+		if err := bState.UpdateValidatorAtIndex(idx, val); err != nil {
+			return nil, fmt.Errorf("could not set effective balance of validator %d: %v", idx, err)
+		}
+	}
+	return bState, nil
+}
+
+// GenerateStateWithShardedCommittees returns a deterministic genesis state with just enough
+// validators for every slot to be assigned the maximum MAX_COMMITTEES_PER_SLOT committees
+// of TARGET_COMMITTEE_SIZE validators, along with the validators' private keys. It is meant
+// to stress committee computation, e.g. when benchmarking attestation generation.
+func GenerateStateWithShardedCommittees(t testing.TB) (*stateTrie.BeaconState, []*bls.SecretKey) {
+	cfg := params.BeaconConfig()
+	numValidators := cfg.MaxCommitteesPerSlot * cfg.TargetCommitteeSize * cfg.SlotsPerEpoch
+	return DeterministicGenesisState(t, numValidators)
+}
+
+// GenerateStateWithEffectiveBalanceHysteresis returns a copy of the given state where the
+// first four validators sit exactly at the edges of the effective balance hysteresis:
+//
+//	validator 0: balance one Gwei below its effective balance, so it decreases.
+//	validator 1: balance equal to its effective balance, so it is unchanged.
+//	validator 2: balance exactly 1.5 increments above its effective balance, so it is unchanged.
+//	validator 3: balance one Gwei more than validator 2, so it increases.
+//
+// Validators 2 and 3 have their effective balance lowered two increments below the maximum
+// to leave room for the increase. The state must have at least four validators.
+func GenerateStateWithEffectiveBalanceHysteresis(bState *stateTrie.BeaconState) (*stateTrie.BeaconState, error) {
+	if bState.NumValidators() < 4 {
+		return nil, fmt.Errorf("state needs at least 4 validators, has %d", bState.NumValidators())
+	}
+	bState = bState.Copy()
+	increment := params.BeaconConfig().EffectiveBalanceIncrement
+	lowered := params.BeaconConfig().MaxEffectiveBalance - 2*increment
+	upwardThreshold := lowered + 3*increment/2
+	for idx := uint64(0); idx < 4; idx++ {
+		val, err := bState.ValidatorAtIndex(idx)
+		if err != nil {
+			return nil, err
+		}
+		var balance uint64
+		switch idx {
+		case 0:
+			balance = val.EffectiveBalance - 1
+		case 1:
+			balance = val.EffectiveBalance
+		case 2:
+			val.EffectiveBalance = lowered
+			balance = upwardThreshold
+		case 3:
+			val.EffectiveBalance = lowered
+			balance = upwardThreshold + 1
+		}
+		if err := bState.UpdateValidatorAtIndex(idx, val); err != nil {
+			return nil, err
+		}
+		if err := bState.UpdateBalancesAtIndex(idx, balance); err != nil {
+			return nil, err
+		}
+	}
+	return bState, nil
+}
+
+// GenerateEmptySlots returns a copy of the given state advanced by numSlots slots without
+// applying any block, as if the proposers of those slots were missing. Epoch processing is
+// run for every epoch boundary crossed.
+func GenerateEmptySlots(t testing.TB, bState *stateTrie.BeaconState, numSlots uint64) *stateTrie.BeaconState {
+	advanced, err := state.ProcessSlots(context.Background(), bState.Copy(), bState.Slot()+numSlots)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return advanced
+}
+
+// AdvanceStateByEpochs returns a copy of the given state advanced by the given number of
+// epochs with a block in every slot, each block carrying the attestations of all the
+// committees of the previous slot. Unlike GenerateEmptySlots, every validator attests
+// on time, so balances are not drained by inactivity penalties and the chain justifies
+// and finalizes as it would with full participation.
+func AdvanceStateByEpochs(
+	t testing.TB,
+	bState *stateTrie.BeaconState,
+	privs []*bls.SecretKey,
+	epochs uint64,
+) *stateTrie.BeaconState {
+	activeCount, err := helpers.ActiveValidatorCount(bState, helpers.CurrentEpoch(bState))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := &BlockGenConfig{
+		NumAttestations: helpers.SlotCommitteeCount(activeCount),
+	}
+	_, advanced, err := GenerateFullBlockChain(bState, privs, conf, epochs*params.BeaconConfig().SlotsPerEpoch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return advanced
+}
@@ -0,0 +1,283 @@
+package testutil
+
+import (
+	"bytes"
+	"context"
+	"math"
+	"testing"
+
+	ethpb "github.com/prysmaticlabs/ethereumapis/eth/v1alpha1"
+	"github.com/prysmaticlabs/prysm/beacon-chain/core/epoch"
+	"github.com/prysmaticlabs/prysm/beacon-chain/core/epoch/precompute"
+	"github.com/prysmaticlabs/prysm/beacon-chain/core/helpers"
+	"github.com/prysmaticlabs/prysm/beacon-chain/core/state"
+	"github.com/prysmaticlabs/prysm/shared/params"
+)
+
+func TestGenerateStateWithPendingAttestations_CreditsAttesters(t *testing.T) {
+	params.OverrideBeaconConfig(params.MinimalSpecConfig())
+	defer params.OverrideBeaconConfig(params.MainnetConfig())
+	beaconState, _ := DeterministicGenesisState(t, 64)
+	beaconState, err := state.ProcessSlots(context.Background(), beaconState, 2*params.BeaconConfig().SlotsPerEpoch-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proposerIndex := uint64(5)
+	previous, err := GeneratePendingAttestations(beaconState, 0, 1, proposerIndex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := GenerateStateWithPendingAttestations(beaconState, nil, previous)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.PreviousEpochAttestations()) != len(previous) {
+		t.Fatalf("Expected %d previous epoch attestations, received %d", len(previous), len(s.PreviousEpochAttestations()))
+	}
+
+	vp, bp := precompute.New(context.Background(), s)
+	vp, bp, err = precompute.ProcessAttestations(context.Background(), s, vp, bp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, v := range vp {
+		if !v.IsPrevEpochAttester || !v.IsPrevEpochTargetAttester || !v.IsPrevEpochHeadAttester {
+			t.Errorf("Expected validator %d to be credited as a previous epoch attester", i)
+		}
+		if v.InclusionDistance != 1 || v.ProposerIndex != proposerIndex {
+			t.Errorf("Expected validator %d to be included at distance 1 by proposer %d, received distance %d by proposer %d",
+				i, proposerIndex, v.InclusionDistance, v.ProposerIndex)
+		}
+	}
+
+	s, err = precompute.ProcessRewardsAndPenaltiesPrecompute(s, bp, vp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proposerBalance, err := s.BalanceAtIndex(proposerIndex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherBalance, err := s.BalanceAtIndex(proposerIndex + 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if otherBalance <= params.BeaconConfig().MaxEffectiveBalance {
+		t.Errorf("Expected attester to be rewarded, received balance %d", otherBalance)
+	}
+	if proposerBalance <= otherBalance {
+		t.Errorf("Expected proposer to receive inclusion rewards, received balance %d <= %d", proposerBalance, otherBalance)
+	}
+}
+
+func TestGenerateStateWithBalance_NearMaxUint64(t *testing.T) {
+	beaconState, _ := DeterministicGenesisState(t, 64)
+	balance := uint64(math.MaxUint64 - 1)
+	newState, err := GenerateStateWithBalance(beaconState, []uint64{3, 5}, balance)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for idx, bal := range newState.Balances() {
+		want := params.BeaconConfig().MaxEffectiveBalance
+		if idx == 3 || idx == 5 {
+			want = balance
+		}
+		if bal != want {
+			t.Errorf("Expected balance %d for validator %d, received %d", want, idx, bal)
+		}
+	}
+	if _, err := newState.HashTreeRoot(); err != nil {
+		t.Fatal(err)
+	}
+	if beaconState.Balances()[3] != params.BeaconConfig().MaxEffectiveBalance {
+		t.Error("Expected the given state to not be mutated")
+	}
+
+	if _, err := GenerateStateWithBalance(beaconState, []uint64{64}, balance); err == nil {
+		t.Error("Expected error for a validator index out of range")
+	}
+}
+
+func TestGenerateStateWithShardedCommittees_MaxCommitteesPerSlot(t *testing.T) {
+	params.OverrideBeaconConfig(params.MinimalSpecConfig())
+	defer params.OverrideBeaconConfig(params.MainnetConfig())
+	beaconState, privs := GenerateStateWithShardedCommittees(t)
+	if len(privs) != beaconState.NumValidators() {
+		t.Fatalf("Expected %d private keys, received %d", beaconState.NumValidators(), len(privs))
+	}
+	activeCount, err := helpers.ActiveValidatorCount(beaconState, helpers.CurrentEpoch(beaconState))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count := helpers.SlotCommitteeCount(activeCount); count != params.BeaconConfig().MaxCommitteesPerSlot {
+		t.Errorf("Expected %d committees per slot, received %d", params.BeaconConfig().MaxCommitteesPerSlot, count)
+	}
+}
+
+func BenchmarkGenerateAttestations_ShardedCommittees(b *testing.B) {
+	params.OverrideBeaconConfig(params.MinimalSpecConfig())
+	defer params.OverrideBeaconConfig(params.MainnetConfig())
+	beaconState, privs := GenerateStateWithShardedCommittees(b)
+	beaconState, err := state.ProcessSlots(context.Background(), beaconState, 1)
+	if err != nil {
+		b.Fatal(err)
+	}
+	committeesPerSlot := params.BeaconConfig().MaxCommitteesPerSlot
+
+	// Committee computation alone, without the shuffling cache, so the time spent
+	// there can be compared with the full generation including signing.
+	b.Run("committee computation", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			helpers.ClearCache()
+			for c := uint64(0); c < committeesPerSlot; c++ {
+				if _, err := helpers.BeaconCommitteeFromState(beaconState, 0, c); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+	b.Run("committee computation and signing", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			helpers.ClearCache()
+			if _, err := GenerateAttestationsForSlot(beaconState, privs, committeesPerSlot, 0); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestGenerateStateWithEffectiveBalanceHysteresis_ProcessFinalUpdates(t *testing.T) {
+	beaconState, _ := DeterministicGenesisState(t, 64)
+	s, err := GenerateStateWithEffectiveBalanceHysteresis(beaconState)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err = epoch.ProcessFinalUpdates(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	increment := params.BeaconConfig().EffectiveBalanceIncrement
+	maxBalance := params.BeaconConfig().MaxEffectiveBalance
+	wanted := []uint64{
+		maxBalance - increment,
+		maxBalance,
+		maxBalance - 2*increment,
+		maxBalance - increment,
+	}
+	for idx, want := range wanted {
+		val, err := s.ValidatorAtIndexReadOnly(uint64(idx))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if val.EffectiveBalance() != want {
+			t.Errorf("Expected validator %d effective balance %d, received %d", idx, want, val.EffectiveBalance())
+		}
+	}
+	val, err := s.ValidatorAtIndexReadOnly(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val.EffectiveBalance() != maxBalance {
+		t.Errorf("Expected untouched validator effective balance %d, received %d", maxBalance, val.EffectiveBalance())
+	}
+}
+
+func TestGenerateEmptySlots_KeepsLatestBlock(t *testing.T) {
+	params.OverrideBeaconConfig(params.MinimalSpecConfig())
+	defer params.OverrideBeaconConfig(params.MainnetConfig())
+	beaconState, _ := DeterministicGenesisState(t, 64)
+	numSlots := params.BeaconConfig().SlotsPerEpoch + 3
+	advanced := GenerateEmptySlots(t, beaconState, numSlots)
+
+	if advanced.Slot() != beaconState.Slot()+numSlots {
+		t.Errorf("Expected slot %d, received %d", beaconState.Slot()+numSlots, advanced.Slot())
+	}
+	if beaconState.Slot() != 0 {
+		t.Errorf("Expected original state to be unchanged, received slot %d", beaconState.Slot())
+	}
+	genesisRoot, err := helpers.BlockRootAtSlot(advanced, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for slot := uint64(1); slot < advanced.Slot(); slot++ {
+		root, err := helpers.BlockRootAtSlot(advanced, slot)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(root, genesisRoot) {
+			t.Errorf("Expected block root of empty slot %d to be the genesis block root", slot)
+		}
+	}
+}
+
+func TestAdvanceStateByEpochs_NoInactivityLeak(t *testing.T) {
+	params.OverrideBeaconConfig(params.MinimalSpecConfig())
+	defer params.OverrideBeaconConfig(params.MainnetConfig())
+	beaconState, privs := DeterministicGenesisState(t, 64)
+	epochs := uint64(4)
+	advanced := AdvanceStateByEpochs(t, beaconState, privs, epochs)
+
+	if advanced.Slot() != epochs*params.BeaconConfig().SlotsPerEpoch {
+		t.Errorf("Expected slot %d, received %d", epochs*params.BeaconConfig().SlotsPerEpoch, advanced.Slot())
+	}
+	if beaconState.Slot() != 0 {
+		t.Errorf("Expected original state to be unchanged, received slot %d", beaconState.Slot())
+	}
+	if advanced.FinalizedCheckpointEpoch() == 0 {
+		t.Error("Expected the chain to finalize with full participation")
+	}
+	for idx, balance := range advanced.Balances() {
+		if balance < params.BeaconConfig().MaxEffectiveBalance {
+			t.Errorf("Expected validator %d not to be penalized, received balance %d", idx, balance)
+		}
+	}
+}
+
+func TestGenerateStateWithSlashedValidators_PenalizedBySlashingsSweep(t *testing.T) {
+	params.OverrideBeaconConfig(params.MinimalSpecConfig())
+	defer params.OverrideBeaconConfig(params.MainnetConfig())
+	beaconState, _ := DeterministicGenesisState(t, 64)
+	slashedState, err := GenerateStateWithSlashedValidators(beaconState, []uint64{1, 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := slashedState.HashTreeRoot(); err != nil {
+		t.Fatal(err)
+	}
+	totalSlashed := uint64(0)
+	for _, slashing := range slashedState.Slashings() {
+		totalSlashed += slashing
+	}
+	if totalSlashed != 2*params.BeaconConfig().MaxEffectiveBalance {
+		t.Errorf("Expected %d slashed balance, received %d", 2*params.BeaconConfig().MaxEffectiveBalance, totalSlashed)
+	}
+	for _, idx := range []uint64{1, 2} {
+		val, err := slashedState.ValidatorAtIndexReadOnly(idx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !val.Slashed() || val.WithdrawableEpoch() != params.BeaconConfig().EpochsPerSlashingsVector {
+			t.Errorf("Expected validator %d slashed and withdrawable at epoch %d, received %t and %d",
+				idx, params.BeaconConfig().EpochsPerSlashingsVector, val.Slashed(), val.WithdrawableEpoch())
+		}
+	}
+
+	// The slashings sweep penalizes the validators halfway to their withdrawable epoch.
+	if err := slashedState.SetSlot(helpers.StartSlot(params.BeaconConfig().EpochsPerSlashingsVector / 2)); err != nil {
+		t.Fatal(err)
+	}
+	preBalance := slashedState.Balances()[1]
+	slashedState, err = epoch.ProcessSlashings(slashedState)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if slashedState.Balances()[1] >= preBalance {
+		t.Errorf("Expected the slashings sweep to penalize validator 1, balance went from %d to %d", preBalance, slashedState.Balances()[1])
+	}
+
+	if _, err := GenerateStateWithSlashedValidators(slashedState, []uint64{1}); err == nil {
+		t.Error("Expected error slashing a validator which is already slashed")
+	}
+}